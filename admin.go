@@ -0,0 +1,255 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/awslabs/ecs-task-kite/lib/proxy"
+)
+
+// proxySnapshot holds a copy of each target's current port -> proxy map so
+// that it can be read by the admin endpoint while the task update loops modify
+// their own.
+type proxySnapshot struct {
+	l sync.RWMutex
+	// proxies holds the proxies of each target, by the target's key
+	proxies   map[string]map[uint16]*proxy.Proxy
+	refreshed time.Time
+	// polledTargets are the targets for which a poll for tasks has
+	// completed, even if it found nothing to proxy to
+	polledTargets map[string]bool
+
+	// targets is how many targets are being proxied to
+	targets int
+}
+
+func (s *proxySnapshot) set(target string, proxies map[uint16]*proxy.Proxy) {
+	proxiesCopy := make(map[uint16]*proxy.Proxy, len(proxies))
+	for port, p := range proxies {
+		proxiesCopy[port] = p
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.proxies == nil {
+		s.proxies = make(map[string]map[uint16]*proxy.Proxy)
+	}
+	s.proxies[target] = proxiesCopy
+	s.refreshed = time.Now()
+}
+
+// lastRefresh returns when the proxies were last updated from a task list
+func (s *proxySnapshot) lastRefresh() time.Time {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.refreshed
+}
+
+// markPolled records that a poll for the target's tasks has completed
+func (s *proxySnapshot) markPolled(target string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.polledTargets == nil {
+		s.polledTargets = make(map[string]bool)
+	}
+	s.polledTargets[target] = true
+}
+
+// polled returns whether a poll for tasks has completed for every target
+func (s *proxySnapshot) polled() bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return len(s.polledTargets) > 0 && len(s.polledTargets) >= s.targets
+}
+
+// healthy returns whether any proxy has a backend passing its health checks
+func (s *proxySnapshot) healthy() bool {
+	for _, p := range s.sorted() {
+		for _, weight := range p.Weights() {
+			if weight.Healthy {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ready returns whether there is at least one proxy with backends
+func (s *proxySnapshot) ready() bool {
+	for _, p := range s.sorted() {
+		if len(p.Backends()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted returns the current proxies of every target ordered by the port they
+// listen on
+func (s *proxySnapshot) sorted() []*proxy.Proxy {
+	s.l.RLock()
+	var out []*proxy.Proxy
+	for _, proxies := range s.proxies {
+		for _, p := range proxies {
+			out = append(out, p)
+		}
+	}
+	s.l.RUnlock()
+	return sortByPort(out)
+}
+
+// byTarget returns the keys of the targets with proxies, sorted, and the
+// current proxies of each ordered by the port they listen on
+func (s *proxySnapshot) byTarget() ([]string, map[string][]*proxy.Proxy) {
+	s.l.RLock()
+	var keys []string
+	out := make(map[string][]*proxy.Proxy, len(s.proxies))
+	for key, proxies := range s.proxies {
+		keys = append(keys, key)
+		for _, p := range proxies {
+			out[key] = append(out[key], p)
+		}
+	}
+	s.l.RUnlock()
+	sort.Strings(keys)
+	for key, proxies := range out {
+		out[key] = sortByPort(proxies)
+	}
+	return keys, out
+}
+
+func sortByPort(proxies []*proxy.Proxy) []*proxy.Proxy {
+	ports := make(map[*proxy.Proxy]int, len(proxies))
+	for _, p := range proxies {
+		ports[p] = p.Settings().Port
+	}
+	sort.Slice(proxies, func(i, j int) bool { return ports[proxies[i]] < ports[proxies[j]] })
+	return proxies
+}
+
+func serveAdmin(addr string, snapshot *proxySnapshot) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeStatus(w, snapshot)
+	})
+	mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+		settings := []proxy.Settings{}
+		for _, p := range snapshot.sorted() {
+			settings = append(settings, p.Settings())
+		}
+		writeJSON(w, settings)
+	})
+	mux.HandleFunc("/connections/slowest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, connectionsByPort(snapshot, r, (*proxy.Proxy).SlowestConnections))
+	})
+	mux.HandleFunc("/connections/largest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, connectionsByPort(snapshot, r, (*proxy.Proxy).LargestConnections))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]proxy.ProxyStats)
+		for _, p := range snapshot.sorted() {
+			stats[strconv.Itoa(p.Settings().Port)] = p.Stats()
+		}
+		writeJSON(w, stats)
+	})
+	mux.HandleFunc("/backends/weights", func(w http.ResponseWriter, r *http.Request) {
+		weights := make(map[string][]proxy.BackendWeight)
+		for _, p := range snapshot.sorted() {
+			weights[strconv.Itoa(p.Settings().Port)] = p.Weights()
+		}
+		writeJSON(w, weights)
+	})
+	log.Info("Serving admin endpoint on ", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Error("Error serving admin endpoint: ", err)
+		}
+	}()
+}
+
+// defaultConnectionsLimit is how many connections per port the connections
+// endpoints return unless a 'limit' query parameter is given
+const defaultConnectionsLimit = 10
+
+func connectionsByPort(snapshot *proxySnapshot, r *http.Request, connections func(*proxy.Proxy, int) []proxy.ConnectionRecord) map[string][]proxy.ConnectionRecord {
+	limit := defaultConnectionsLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	out := make(map[string][]proxy.ConnectionRecord)
+	for _, p := range snapshot.sorted() {
+		out[strconv.Itoa(p.Settings().Port)] = connections(p, limit)
+	}
+	return out
+}
+
+// writeStatus renders a plain text summary of every proxy, grouped by the
+// target, and so the container, it proxies to, for reading at a glance rather
+// than by tools
+func writeStatus(w http.ResponseWriter, snapshot *proxySnapshot) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if refreshed := snapshot.lastRefresh(); refreshed.IsZero() {
+		fmt.Fprintln(w, "Last refresh: never")
+	} else {
+		fmt.Fprintf(w, "Last refresh: %v (%v ago)\n", refreshed.Format(time.RFC3339), time.Since(refreshed).Round(time.Second))
+	}
+
+	keys, proxies := snapshot.byTarget()
+	if len(keys) == 0 {
+		fmt.Fprintln(w, "\nNot proxying any ports")
+		return
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "\nContainer: %v\n", key)
+		if len(proxies[key]) == 0 {
+			fmt.Fprintln(w, "  Not proxying any ports")
+		}
+		for _, p := range proxies[key] {
+			weights := p.Weights()
+			fmt.Fprintf(w, "\n  Port %v: %v backends\n", p.Settings().Port, len(weights))
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "    BACKEND\tHEALTH\tCONNECTIONS")
+			for _, weight := range weights {
+				health := "healthy"
+				if !weight.Healthy {
+					health = "unhealthy"
+				}
+				fmt.Fprintf(tw, "    %v\t%v\t%v\n", weight.Backend, health, weight.ActiveConnections)
+			}
+			tw.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Warn("Error writing admin response: ", err)
+	}
+}
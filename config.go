@@ -0,0 +1,261 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/taskhelpers"
+)
+
+// targetConfig is one entry of a -config file: a set of tasks to proxy to,
+// described as the discovery flags would for a single one
+type targetConfig struct {
+	Cluster     string `json:"cluster"`
+	Family      string `json:"family"`
+	Service     string `json:"service"`
+	TaskArn     string `json:"task-arn"`
+	Name        string `json:"name"`
+	NameMatch   string `json:"name-match"`
+	RequirePort uint   `json:"require-port"`
+	// PortOverride maps container ports to the port to listen on for them
+	// instead, e.g. when two targets' containers listen on the same port
+	PortOverride map[string]uint16 `json:"port-override"`
+	Protocol     string            `json:"protocol"`
+	Public       bool              `json:"public"`
+	// PublicPorts are container ports proxied to public IPs even if Public
+	// is not set
+	PublicPorts []uint16 `json:"public-ports"`
+	// Environment holds the environment variables the container must have
+	Environment map[string]string `json:"environment"`
+}
+
+// loadTargetConfigs reads and validates the JSON list of targets in a -config
+// file
+func loadTargetConfigs(path string) ([]targetConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config: %v", err)
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	var configs []targetConfig
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("Could not parse config %v: %v", path, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("Config %v has no targets", path)
+	}
+	listenPorts := make(map[uint16]int)
+	for i := range configs {
+		if err := configs[i].validate(); err != nil {
+			return nil, fmt.Errorf("Target %v in %v: %v", i, path, err)
+		}
+		overrides, _ := configs[i].portOverrides()
+		for _, port := range overrides {
+			if other, ok := listenPorts[port]; ok {
+				return nil, fmt.Errorf("Targets %v and %v in %v both override a port to %v", other, i, path, port)
+			}
+			listenPorts[port] = i
+		}
+	}
+	return configs, nil
+}
+
+// validate checks an entry for the mistakes that the discovery flags would
+// refuse, and fills in their defaults
+func (c *targetConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("Name is required")
+	}
+	set := 0
+	for _, field := range []string{c.Family, c.Service, c.TaskArn} {
+		if field != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return errors.New("One of family, service or task-arn is required")
+	}
+	if set > 1 {
+		return errors.New("Only one of family, service or task-arn may be set")
+	}
+	if c.Protocol != "" {
+		if err := taskhelpers.ValidateProtocol(c.Protocol); err != nil {
+			return err
+		}
+		if c.Protocol != "tcp" {
+			return fmt.Errorf("Protocol %q is not supported; only tcp ports are proxied", c.Protocol)
+		}
+	}
+	if c.Cluster == "" {
+		c.Cluster = "default"
+	}
+	if c.NameMatch == "" {
+		c.NameMatch = "exact"
+	}
+	if _, err := parseNameMatchers(c.NameMatch, c.Name); err != nil {
+		return err
+	}
+	_, err := c.portOverrides()
+	return err
+}
+
+// portOverrides returns the entry's port overrides keyed by container port
+func (c *targetConfig) portOverrides() (map[uint16]uint16, error) {
+	overrides := make(map[uint16]uint16, len(c.PortOverride))
+	for containerPort, listenPort := range c.PortOverride {
+		port, err := strconv.ParseUint(containerPort, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("Port-override key %q is not a port", containerPort)
+		}
+		if listenPort == 0 {
+			return nil, fmt.Errorf("Port-override of port %v must be to a port", port)
+		}
+		overrides[uint16(port)] = listenPort
+	}
+	return overrides, nil
+}
+
+// proxyTarget is one set of tasks to proxy to, from either the discovery
+// flags or an entry of a -config file
+type proxyTarget struct {
+	// key identifies the target in logs and the proxy snapshot
+	key             string
+	client          ecsclient.ECSSimpleClient
+	family, service *string
+	names           []ecsclient.NameMatcher
+	requirePort     *uint
+	ips             taskhelpers.IPChoice
+	// env holds the environment variables the container must have
+	env map[string]string
+	// portOverrides maps container ports to the port to listen on for them
+	portOverrides map[uint16]uint16
+	// zone, if set, is the availability zone whose tasks are preferred
+	zone string
+	// weighted is whether backends are weighted by their reservations
+	weighted bool
+	// listenPorts, if set, is shared by every target of a -config file
+	listenPorts *listenPorts
+}
+
+// listenPort returns the port to listen on for a container port
+func (t proxyTarget) listenPort(containerPort uint16) uint16 {
+	if port, ok := t.portOverrides[containerPort]; ok {
+		return port
+	}
+	return containerPort
+}
+
+// listenPorts records which target listens on each port, so that two targets
+// whose containers expose the same port without a port-override are refused
+// rather than both trying to listen on it. It is safe for concurrent use.
+type listenPorts struct {
+	l      sync.Mutex
+	owners map[uint16]string
+}
+
+// claim records that the target with the given key listens on the port,
+// unless another target already does, in which case that target's key is
+// returned. A nil listenPorts allows every claim.
+func (p *listenPorts) claim(port uint16, key string) (string, bool) {
+	if p == nil {
+		return "", true
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	if owner, ok := p.owners[port]; ok && owner != key {
+		return owner, false
+	}
+	if p.owners == nil {
+		p.owners = make(map[uint16]string)
+	}
+	p.owners[port] = key
+	return "", true
+}
+
+// release frees a port claimed by the target with the given key
+func (p *listenPorts) release(port uint16, key string) {
+	if p == nil {
+		return
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.owners[port] == key {
+		delete(p.owners, port)
+	}
+}
+
+// ipChoice returns whether each container port is proxied to public IPs
+func (c *targetConfig) ipChoice() taskhelpers.IPChoice {
+	publicPorts := make(map[uint16]bool, len(c.PublicPorts))
+	for _, port := range c.PublicPorts {
+		publicPorts[port] = true
+	}
+	return taskhelpers.IPChoice{Public: c.Public, PublicPorts: publicPorts}
+}
+
+// targets returns every target to proxy to: one per entry of the -config
+// file if one was given, or the single target of the discovery flags
+func (d *discoveryFlags) targets() ([]proxyTarget, error) {
+	if d.config == nil || *d.config == "" {
+		return []proxyTarget{{
+			key:           *d.name,
+			client:        d.client(),
+			family:        d.family,
+			service:       d.service,
+			names:         d.matchers,
+			requirePort:   d.requirePort,
+			ips:           d.ips,
+			env:           d.env,
+			portOverrides: d.portMap,
+			weighted:      d.weighted(),
+		}}, nil
+	}
+	if len(d.portMap) > 0 {
+		return nil, errors.New("-port-map cannot be used with -config; give each target a port-override instead")
+	}
+	configs, err := loadTargetConfigs(*d.config)
+	if err != nil {
+		return nil, err
+	}
+	var targets []proxyTarget
+	ports := &listenPorts{}
+	for i, c := range configs {
+		c := c
+		names, _ := parseNameMatchers(c.NameMatch, c.Name)
+		overrides, _ := c.portOverrides()
+		targets = append(targets, proxyTarget{
+			key:           fmt.Sprintf("%v/%v", i, c.Name),
+			client:        d.clientFor(c.Cluster, c.TaskArn, len(c.Environment) > 0 || d.weighted()),
+			family:        &c.Family,
+			service:       &c.Service,
+			names:         names,
+			requirePort:   &c.RequirePort,
+			ips:           c.ipChoice(),
+			env:           c.Environment,
+			portOverrides: overrides,
+			weighted:      d.weighted(),
+			listenPorts:   ports,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/proxy"
+)
+
+func TestValidateTargetConfig(t *testing.T) {
+	tests := []struct {
+		config targetConfig
+		err    string
+	}{
+		{targetConfig{Name: "app", Family: "app"}, ""},
+		{targetConfig{Name: "app", Service: "app", Protocol: "tcp"}, ""},
+		{targetConfig{Name: "app", TaskArn: "arn"}, ""},
+		{targetConfig{Family: "app"}, "Name is required"},
+		{targetConfig{Name: "app"}, "One of family, service or task-arn is required"},
+		{targetConfig{Name: "app", Family: "app", Service: "app"}, "Only one of"},
+		{targetConfig{Name: "app", Service: "app", TaskArn: "arn"}, "Only one of"},
+		{targetConfig{Name: "app", Family: "app", Protocol: "udp"}, "only tcp"},
+		{targetConfig{Name: "app", Family: "app", Protocol: "tpc"}, "tpc"},
+		{targetConfig{Name: "app", Family: "app", NameMatch: "glob"}, "glob"},
+		{targetConfig{Name: "app", Family: "app", PortOverride: map[string]uint16{"http": 80}}, "not a port"},
+	}
+	for _, test := range tests {
+		config := test.config
+		err := config.validate()
+		if test.err == "" && err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", test.config, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Expected %+v to be refused with %q, got %v", test.config, test.err, err)
+		}
+	}
+
+	config := targetConfig{Name: "app", Family: "app"}
+	config.validate()
+	if config.Cluster != "default" || config.NameMatch != "exact" {
+		t.Errorf("Expected the defaults to be filled in, got %+v", config)
+	}
+}
+
+func TestPortOverrides(t *testing.T) {
+	config := targetConfig{PortOverride: map[string]uint16{"80": 8080, "443": 8443}}
+	overrides, err := config.portOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[uint16]uint16{80: 8080, 443: 8443}; !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("Expected %v, got %v", expected, overrides)
+	}
+
+	for _, invalid := range []map[string]uint16{
+		{"0": 80},
+		{"65536": 80},
+		{"http": 80},
+		{"80": 0},
+	} {
+		config := targetConfig{PortOverride: invalid}
+		if _, err := config.portOverrides(); err == nil {
+			t.Errorf("Expected %v to be refused", invalid)
+		}
+	}
+}
+
+// configFile writes a -config file, returning its path
+func configFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "ecs-task-kite-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadTargetConfigs(t *testing.T) {
+	path := configFile(t, `[
+  {"service": "frontend", "name": "nginx"},
+  {"cluster": "data", "family": "redis:3", "name": "redis", "port-override": {"6379": 6380}}
+]`)
+	defer os.Remove(path)
+	configs, err := loadTargetConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].Cluster != "default" || configs[1].PortOverride["6379"] != 6380 {
+		t.Errorf("Unexpected targets: %+v", configs)
+	}
+
+	tests := []struct {
+		contents string
+		err      string
+	}{
+		{`[]`, "has no targets"},
+		{`{"name": "app"}`, "Could not parse"},
+		{`[{"name": "app", "family": "app", "unknown": true}]`, "unknown"},
+		{`[{"name": "app"}]`, "Target 0"},
+		{`[{"name": "a", "family": "a", "port-override": {"80": 8080}},
+		   {"name": "b", "family": "b", "port-override": {"81": 8080}}]`, "both override a port to 8080"},
+	}
+	for _, test := range tests {
+		path := configFile(t, test.contents)
+		defer os.Remove(path)
+		if _, err := loadTargetConfigs(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected %v to be refused with %q, got %v", test.contents, test.err, err)
+		}
+	}
+	if _, err := loadTargetConfigs(path + ".missing"); err == nil {
+		t.Error("Expected a missing config to be refused")
+	}
+}
+
+func TestTargetsExposingTheSamePortAreNotBothProxied(t *testing.T) {
+	port := freePort(t)
+	ports := &listenPorts{}
+	requirePort := uint(0)
+	tasks := []ecsclient.AugmentedTask{&fakeTask{arn: "task", hostPort: 8080}}
+	var targets []proxyTarget
+	var managers []*proxy.Manager
+	for _, key := range []string{"0/a", "1/b"} {
+		manager := testManager()
+		defer manager.Drain(0)
+		target := proxyTarget{
+			key:           key,
+			names:         []ecsclient.NameMatcher{ecsclient.ExactName("app")},
+			requirePort:   &requirePort,
+			portOverrides: map[uint16]uint16{80: port},
+			listenPorts:   ports,
+		}
+		proxyNewPorts(target, tasks, nil, []uint16{80}, manager)
+		targets = append(targets, target)
+		managers = append(managers, manager)
+	}
+	if first := managers[0].Ports(); len(first) != 1 || first[0] != port {
+		t.Errorf("Expected the first target to listen on %v, got %v", port, first)
+	}
+	if second := managers[1].Ports(); len(second) != 0 {
+		t.Errorf("Expected the second target not to listen on the same port, got %v", second)
+	}
+
+	// once the first target stops listening on it, the second may
+	unproxyRemovedPorts(targets[0], nil, managers[0])
+	proxyNewPorts(targets[1], tasks, nil, []uint16{80}, managers[1])
+	if second := managers[1].Ports(); len(second) != 1 || second[0] != port {
+		t.Errorf("Expected the second target to listen on %v once it was free, got %v", port, second)
+	}
+}
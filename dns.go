@@ -0,0 +1,63 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/awslabs/ecs-task-kite/lib/dnsserver"
+	"github.com/awslabs/ecs-task-kite/lib/taskhelpers"
+)
+
+// dnsCommand polls for tasks like the proxy does, but rather than proxying to
+// them serves their backends as DNS records for clients to connect to directly
+func dnsCommand(args []string) int {
+	d := newDiscoveryFlags("dns")
+	flags := d.flags
+	addr := flags.String("dns-addr", ":53", "Address to answer DNS queries on, over both UDP and TCP")
+	dnsName := flags.String("dns-name", "", "Name to answer A, AAAA and SRV queries for with the backends; the first -name if empty")
+	ttl := flags.Duration("dns-ttl", dnsserver.DefaultTTL, "How long resolvers may cache answers")
+	if !d.parse(args) {
+		return 1
+	}
+
+	if *dnsName == "" {
+		*dnsName = strings.TrimSpace(strings.Split(*d.name, ",")[0])
+	}
+	server := dnsserver.New(*dnsName)
+	server.SetTTL(*ttl)
+	go func() {
+		err := server.Serve(*addr)
+		if err != nil {
+			log.Fatal("Error serving DNS on ", *addr, ": ", err)
+		}
+	}()
+	log.Infof("Serving DNS for %v on %v", *dnsName, *addr)
+
+	ctx, stop := context.WithCancel(context.Background())
+	stopOnSignal(stop)
+	for tasks := range collectTaskUpdates(ctx, d.client(), d.family, d.service, d.schedule(), nil, func() {}) {
+		tasks = taskhelpers.FilterEnvironment(tasks, d.matchers, d.env)
+		var backends []string
+		for _, port := range taskhelpers.ContainerPortsMulti(tasks, d.matchers, "tcp") {
+			backends = append(backends, taskhelpers.FilterIPPortMulti(tasks, d.matchers, port, uint16(*d.requirePort), d.ips.PublicIP(port))...)
+		}
+		log.Debugf("Serving %v backends over DNS", len(backends))
+		server.UpdateBackends(backends)
+	}
+	server.Close()
+	return 0
+}
@@ -14,142 +14,952 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/metrics"
 	"github.com/awslabs/ecs-task-kite/lib/proxy"
 	"github.com/awslabs/ecs-task-kite/lib/taskhelpers"
 )
 
 func main() {
-	os.Exit(_main())
+	os.Exit(_main(os.Args[1:]))
 }
 
-func _main() int {
-	public := flag.Bool("public", false, "Proxy to public ips, not private")
-	cluster := flag.String("cluster", "default", "Cluster")
-	family := flag.String("family", "", "Family, optionally with revision")
-	service := flag.String("service", "", "Service to proxy to; *must* be the service name")
-	name := flag.String("name", "", "Container name within that task family or service")
-	loglevel := flag.String("loglevel", "info", "Loglevel panic|fatal|error|warn|info|debug")
+// commands maps each subcommand to the function which runs it with the
+// remaining arguments
+var commands = map[string]func(args []string) int{
+	"proxy":   proxyCommand,
+	"resolve": resolveCommand,
+	"watch":   watchCommand,
+	"dns":     dnsCommand,
+	"version": versionCommand,
+}
+
+func _main(args []string) int {
+	// With no subcommand, behave as 'proxy' so existing invocations which only
+	// pass flags keep working
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return proxyCommand(args)
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return 1
+	}
+	return command(args[1:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  proxy    proxy to the tasks of a family or service (the default)
+  resolve  print the current backends of a family or service and exit
+  watch    print the backends of a family or service whenever they change
+  dns      serve the backends of a family or service as DNS records
+  version  print the version and exit
+
+Run '%s <command> -h' for the flags of a command.
+`, os.Args[0], os.Args[0])
+}
+
+// discoveryFlags are the flags shared by every command which finds tasks
+type discoveryFlags struct {
+	flags *flag.FlagSet
+
+	public            *bool
+	publicPorts       *string
+	cluster           *string
+	partialClusters   *bool
+	family            *string
+	service           *string
+	taskArn           *string
+	name              *string
+	nameMatch         *string
+	requirePort       *uint
+	awsDebug          *bool
+	loglevel          *string
+	availabilityZones *string
+	tags              tagFlag
+	env               tagFlag
+	refreshDeadline   *time.Duration
+	cacheTTL          *time.Duration
+	roleARN           *string
+	externalID        *string
+	endpoint          *string
+	userAgentComment  *string
+	pollInterval      *time.Duration
+	pollJitter        *float64
+	// config is only registered by commands which can proxy to several
+	// targets from a file
+	config *string
+	// portMap is only registered by the proxy command, and maps container
+	// ports to the ports to listen on for them
+	portMap portMapFlag
+	// weightByReservation is only registered by the proxy command
+	weightByReservation *bool
+
+	// matchers are built from name and nameMatch by parse, one per name
+	matchers []ecsclient.NameMatcher
+	// ips is built from public and publicPorts by parse
+	ips taskhelpers.IPChoice
+}
 
-	flag.Parse()
+func newDiscoveryFlags(command string) *discoveryFlags {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	d := &discoveryFlags{
+		flags:             flags,
+		public:            flags.Bool("public", false, "Proxy to public ips, not private"),
+		publicPorts:       flags.String("public-ports", "", "Comma separated container ports to proxy to public ips for, whatever -public says, e.g. '443'"),
+		cluster:           flags.String("cluster", "default", "Cluster; several may be given separated by commas to merge their tasks"),
+		partialClusters:   flags.Bool("partial-clusters", false, "With several clusters, proxy to the tasks of those which could be listed when others fail, rather than failing the whole poll"),
+		family:            flags.String("family", "", "Family, optionally with revision"),
+		service:           flags.String("service", "", "Service to proxy to; the start of its name is enough if no other service's name starts the same way"),
+		taskArn:           flags.String("task-arn", "", "ARN of a single task to proxy to instead of a family or service, e.g. to debug one instance"),
+		name:              flags.String("name", "", "Container name within that task family or service; several may be given separated by commas, except with -name-match=regex"),
+		nameMatch:         flags.String("name-match", "exact", "How -name is matched against container names: exact|prefix|regex"),
+		requirePort:       flags.Uint("require-port", 0, "Only proxy to tasks whose container also has a binding for this container port"),
+		awsDebug:          flags.Bool("aws-debug", false, "Log every AWS API request and response in full; may log sensitive data"),
+		loglevel:          flags.String("loglevel", "info", "Loglevel panic|fatal|error|warn|info|debug"),
+		availabilityZones: flags.String("availability-zones", "", "Comma separated availability zones to limit backends to, e.g. 'us-east-1a'; all zones if empty"),
+		refreshDeadline:   flags.Duration("refresh-deadline", 0, "Maximum time to spend on one refresh of the task list before proxying to the tasks resolved so far; unlimited if 0"),
+		cacheTTL:          flags.Duration("task-cache-ttl", 0, "How long to reuse a listed set of tasks before listing them again; disabled if 0"),
+		roleARN:           flags.String("role-arn", "", "ARN of an IAM role to assume to discover tasks, e.g. in another account"),
+		externalID:        flags.String("external-id", "", "External ID to pass when assuming -role-arn, if its trust policy requires one"),
+		pollInterval:      flags.Duration("poll-interval", 5*time.Second, "How long to wait between polls for tasks, before jitter"),
+		pollJitter:        flags.Float64("poll-jitter", 1, "Up to this fraction of -poll-interval is added at random to each wait, so that many Task Kites don't poll in step"),
+		endpoint:          flags.String("aws-endpoint", "", "URL to send ECS and EC2 API calls to instead of the public endpoints, e.g. LocalStack's"),
+		userAgentComment:  flags.String("user-agent-comment", "", "Comment to append to the User-Agent of AWS API calls, e.g. to tell fleets apart in CloudTrail"),
+		tags:              tagFlag{},
+		env:               tagFlag{},
+	}
+	flags.Var(d.env, "env", "Only proxy to tasks whose container has this 'key=value' environment variable; may be repeated to require several")
+	flags.Var(d.tags, "tag", "Only proxy to tasks on EC2 instances with this 'key=value' tag; may be repeated to require several")
+	return d
+}
+
+// tagFlag collects repeated 'key=value' flags into a map
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	var pairs []string
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Tag %q is not of the form key=value", value)
+	}
+	t[parts[0]] = parts[1]
+	return nil
+}
+
+// portMapFlag collects repeated 'listenPort:containerPort' flags into a map
+// of container port to listen port
+type portMapFlag map[uint16]uint16
+
+func (m portMapFlag) String() string {
+	var pairs []string
+	for containerPort, listenPort := range m {
+		pairs = append(pairs, fmt.Sprintf("%v:%v", listenPort, containerPort))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-	lvl, lvlerr := log.ParseLevel(*loglevel)
+func (m portMapFlag) Set(value string) error {
+	for _, mapping := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(mapping), ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Port mapping %q is not of the form listenPort:containerPort", mapping)
+		}
+		listenPort, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || listenPort == 0 {
+			return fmt.Errorf("Listen port %q is not a port", parts[0])
+		}
+		containerPort, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || containerPort == 0 {
+			return fmt.Errorf("Container port %q is not a port", parts[1])
+		}
+		if _, ok := m[uint16(containerPort)]; ok {
+			return fmt.Errorf("Container port %v is mapped more than once", containerPort)
+		}
+		for _, other := range m {
+			if other == uint16(listenPort) {
+				return fmt.Errorf("Listen port %v is mapped more than once", listenPort)
+			}
+		}
+		m[uint16(containerPort)] = uint16(listenPort)
+	}
+	return nil
+}
+
+// parse parses the command's arguments, sets up logging, and checks that the
+// tasks to find were specified. It returns false, having printed the usage,
+// if they were not.
+func (d *discoveryFlags) parse(args []string) bool {
+	d.flags.Parse(args)
+
+	lvl, lvlerr := log.ParseLevel(*d.loglevel)
 	if lvlerr != nil {
 		lvl = log.InfoLevel
 	}
 	log.SetLevel(lvl)
+	logTaskARN()
+	ecsclient.UserAgentComment = *d.userAgentComment
+
+	if *d.pollInterval <= 0 || *d.pollJitter < 0 {
+		log.Errorf("Invalid poll interval %v with jitter %v; the interval must be positive and the jitter not negative", *d.pollInterval, *d.pollJitter)
+		d.flags.PrintDefaults()
+		return false
+	}
+
+	publicPorts, err := taskhelpers.ParsePorts(*d.publicPorts)
+	if err != nil {
+		log.Error("Invalid -public-ports: ", err)
+		d.flags.PrintDefaults()
+		return false
+	}
+	d.ips = taskhelpers.IPChoice{Public: *d.public, PublicPorts: publicPorts}
+
+	// the targets of a config file are validated as it is loaded
+	if d.config != nil && *d.config != "" {
+		return true
+	}
+
+	if *d.name == "" {
+		d.flags.PrintDefaults()
+		return false
+	}
+
+	if *d.family == "" && *d.service == "" && *d.taskArn == "" {
+		d.flags.PrintDefaults()
+		return false
+	}
+
+	matchers, err := parseNameMatchers(*d.nameMatch, *d.name)
+	if err != nil {
+		log.Error(err)
+		d.flags.PrintDefaults()
+		return false
+	}
+	d.matchers = matchers
+	return true
+}
+
+// parseNameMatchers returns a matcher for each of the comma separated names
+func parseNameMatchers(nameMatch, name string) ([]ecsclient.NameMatcher, error) {
+	// commas are common in regular expressions, so several can only be
+	// matched with an alternation
+	names := []string{name}
+	if nameMatch != "regex" {
+		names = strings.Split(name, ",")
+	}
+	var matchers []ecsclient.NameMatcher
+	for _, name := range names {
+		matcher, err := ecsclient.ParseNameMatcher(nameMatch, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// schedule returns how often to poll for tasks
+func (d *discoveryFlags) schedule() pollSchedule {
+	return pollSchedule{interval: *d.pollInterval, jitter: *d.pollJitter}
+}
+
+// client returns an ECS client configured by the flags
+func (d *discoveryFlags) client() ecsclient.ECSSimpleClient {
+	return d.clientFor(*d.cluster, *d.taskArn, len(d.env) > 0 || d.weighted())
+}
+
+// weighted returns whether backends are weighted by their reservations, which
+// needs the task definitions to be described
+func (d *discoveryFlags) weighted() bool {
+	return d.weightByReservation != nil && *d.weightByReservation
+}
+
+// clientFor returns an ECS client configured by the flags for the given
+// cluster, which only finds the given task if its ARN is not empty. Task
+// definitions are only described, for the environment and reservations they
+// give containers, if describeDefinitions is set.
+func (d *discoveryFlags) clientFor(cluster, taskArn string, describeDefinitions bool) ecsclient.ECSSimpleClient {
+	var client ecsclient.ECSSimpleClient
+	if clusters := strings.Split(cluster, ","); len(clusters) > 1 {
+		var clients []ecsclient.ECSSimpleClient
+		for _, cluster := range clusters {
+			clients = append(clients, d.clusterClient(strings.TrimSpace(cluster), describeDefinitions))
+		}
+		multi := ecsclient.NewMulti(clients...)
+		multi.PartialResults = *d.partialClusters
+		client = multi
+	} else {
+		client = d.clusterClient(cluster, describeDefinitions)
+	}
+	if *d.cacheTTL > 0 {
+		client = ecsclient.NewCached(client, *d.cacheTTL)
+	}
+	if taskArn != "" {
+		log.Info("Only proxying to task ", taskArn)
+		return pinnedClient{client, taskArn}
+	}
+	return client
+}
+
+// clusterClient returns an ECS client configured by the flags for a single
+// cluster
+func (d *discoveryFlags) clusterClient(cluster string, describeDefinitions bool) *ecsclient.ECSClient {
+	var awsConfigs []*aws.Config
+	if *d.awsDebug {
+		awsConfigs = append(awsConfigs, awsDebugConfig())
+	}
+	if *d.endpoint != "" {
+		awsConfigs = append(awsConfigs, &aws.Config{
+			Endpoint:   d.endpoint,
+			DisableSSL: aws.Bool(strings.HasPrefix(*d.endpoint, "http://")),
+		})
+	}
+	var client ecsclient.ECSSimpleClient
+	if *d.roleARN != "" {
+		log.Info("Assuming role ", *d.roleARN)
+		client = ecsclient.NewWithRole(cluster, "", *d.roleARN, *d.externalID, nil, nil, awsConfigs...)
+	} else {
+		client = ecsclient.New(cluster, "", nil, nil, awsConfigs...)
+	}
+	ecsClient := client.(*ecsclient.ECSClient)
+	ecsClient.RefreshDeadline = *d.refreshDeadline
+	ecsClient.DescribeTaskDefinitions = describeDefinitions
+	if *d.availabilityZones != "" {
+		ecsClient.AvailabilityZones = strings.Split(*d.availabilityZones, ",")
+	}
+	if len(d.tags) > 0 {
+		ecsClient.InstanceTags = d.tags
+	}
+	return ecsClient
+}
+
+// pinnedClient only ever finds a single task, by ARN, whichever family or
+// service it is asked for
+type pinnedClient struct {
+	ecsclient.ECSSimpleClient
+	taskArn string
+}
+
+func (c pinnedClient) Tasks(_, _ *string) ([]ecsclient.AugmentedTask, error) {
+	return c.TasksByArns([]*string{&c.taskArn})
+}
+
+func (c pinnedClient) TasksWithContext(ctx context.Context, _, _ *string) ([]ecsclient.AugmentedTask, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Tasks(nil, nil)
+}
+
+func (c pinnedClient) StreamTasks(ctx context.Context, _, _ *string, fn func([]ecsclient.AugmentedTask) bool) error {
+	tasks, err := c.TasksWithContext(ctx, nil, nil)
+	if err != nil {
+		return err
+	}
+	fn(tasks)
+	return nil
+}
+
+func versionCommand(args []string) int {
+	fmt.Println("ECS Task Kite", ecsclient.Version)
+	return 0
+}
+
+func proxyCommand(args []string) int {
+	d := newDiscoveryFlags("proxy")
+	flags := d.flags
+	adminAddr := flags.String("admin-addr", "", "Address to serve the admin endpoint on, e.g. ':8080'; disabled if empty")
+	healthAddr := flags.String("health-addr", "", "Address to serve HTTP health checks on at /healthz and /ready, e.g. ':8081'; disabled if empty")
+	grpcHealthAddr := flags.String("grpc-health-addr", "", "Address to serve the gRPC health checking protocol on, e.g. ':50051'; disabled if empty")
+	metricsAddr := flags.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. ':9102'; disabled if empty")
+	strategyName := flags.String("strategy", "random", "How to choose a backend for each connection: random|consistent-hash|least-connections")
+	connectionBudget := flags.Int("connection-budget", 0, "Total concurrent connections to allow across all backends of a port, split evenly between them as they scale; unlimited if 0")
+	dialTimeout := flags.Duration("dial-timeout", 10*time.Second, "How long to wait for a backend dial to succeed before closing the client's connection")
+	dialRetries := flags.Int("dial-retries", 0, "How many other backends to try, in turn, when dialing a connection's backend fails")
+	maxConcurrentDials := flags.Int("max-concurrent-dials", 0, "Maximum backend dials in flight at once across all ports; further connections wait for a free slot; unlimited if 0")
+	clientSubnets := flags.String("client-subnets", "", "Comma separated CIDRs to break connection outcome metrics down by client subnet, e.g. '10.0.0.0/24,10.0.1.0/24'")
+	healthCheckInterval := flags.Duration("health-check-interval", 0, "How often to check each backend by dialing it; disabled if 0")
+	healthCheckThreshold := flags.Int("health-check-threshold", 3, "Consecutive failed health checks after which a backend is taken out of rotation until it passes one")
+	healthFailClosed := flags.Bool("health-fail-closed", false, "Close new connections while every backend is failing its health checks, rather than using them all anyway")
+	errorDecay := flags.Duration("error-decay", 10*time.Second, "How long it takes for half of a backend's recent dial errors to be forgiven when choosing backends at random; errors are ignored if 0")
+	acceptParallelism := flags.Int("accept-parallelism", 1, "Number of goroutines accepting connections on each port")
+	refreshFailures := flags.Int("refresh-failure-threshold", 0, "Refresh the task list immediately when this many backend dials fail within a second on one port; disabled if 0")
+	bindRetryTimeout := flags.Duration("bind-retry-timeout", 10*time.Second, "How long to keep retrying to listen on a port that is already in use, e.g. during a fast restart")
+	stoppedGrace := flags.Duration("stopped-task-grace", 0, "How long to keep proxying, as a last resort, to a task after it stops being listed as running; disabled if 0")
+	maxBackends := flags.Int("max-backends", 0, "Proxy each port to at most this many of its backends, e.g. to canary traffic to a few tasks; unlimited if 0")
+	connectionPool := flags.Int("connection-pool", 0, "Keep this many connections to each backend dialed ahead of time, each handed to one new client connection; disabled if 0")
+	preferPooled := flags.Bool("prefer-pooled-backends", false, "Choose backends with a -connection-pool connection ready over those without, while any have one")
+	acceptRate := flags.Int("accept-rate", 0, "Maximum new connections accepted per second per port; further connections wait to be accepted; unlimited if 0")
+	acceptBurst := flags.Int("accept-burst", 1, "How many connections -accept-rate lets through at once after a quiet period")
+	maxConnections := flags.Int("max-connections", 0, "Maximum concurrent connections per port; further connections are closed as soon as they are accepted; unlimited if 0")
+	closeOnRemoval := flags.Bool("close-on-backend-removal", false, "Close connections to a task's backend as soon as the task is no longer running, rather than letting them finish")
+	accessLog := flags.Bool("access-log", false, "Log a line with the client, backend, duration and bytes each way as each proxied connection closes")
+	idleTimeout := flags.Duration("idle-timeout", 0, "Close proxied connections once no bytes have flowed either way for this long; disabled if 0")
+	tlsCert := flags.String("tls-cert", "", "PEM certificate file to terminate TLS with on every port; requires -tls-key")
+	tlsKey := flags.String("tls-key", "", "PEM private key file for -tls-cert")
+	backendTLS := flags.Bool("backend-tls", false, "Dial backends over TLS")
+	backendTLSCA := flags.String("backend-tls-ca", "", "PEM file of CA certificates to verify backends with; the system's by default")
+	backendTLSServerName := flags.String("backend-tls-server-name", "", "Name to verify backend certificates against; each backend's IP by default")
+	backendTLSCert := flags.String("backend-tls-cert", "", "PEM client certificate file to present to backends requiring mutual TLS; requires -backend-tls-key")
+	backendTLSKey := flags.String("backend-tls-key", "", "PEM private key file for -backend-tls-cert")
+	bindAddress := flags.String("bind-address", "", "Local IP to listen on, e.g. a private interface; all interfaces if empty")
+	proxyProtocol := flags.Bool("proxy-protocol", false, "Send each backend a PROXY protocol v1 header with the client's address before its data; only for backends which expect one")
+	drainTimeout := flags.Duration("drain-timeout", 25*time.Second, "On SIGTERM, how long to wait for open connections to finish before closing them; set just under the task's ECS stopTimeout")
+	transparentPort := flags.Uint("transparent-port", 0, "If set, listen only on this port for connections redirected by iptables and proxy each to the backends for its original destination port (linux only)")
+	preferLocalAZ := flags.Bool("prefer-local-az", false, "Only proxy to tasks in this instance's availability zone, as read from the instance metadata, while there are any; every zone if false")
+	list := flags.Bool("list", false, "Find the tasks once, print the backends each port would be proxied to as '<listenPort> <containerPort> <ip:port>' lines, and exit without listening")
+	d.weightByReservation = flags.Bool("weight-by-reservation", false, "Send each task a share of connections in proportion to the cpu, or else memory, its container reserves in its task definition; equal shares if false")
+	d.portMap = portMapFlag{}
+	flags.Var(d.portMap, "port-map", "Listen on a different port than the container exposes, as 'listenPort:containerPort', e.g. '80:8080'; may be repeated or comma separated")
+	d.config = flags.String("config", "", "JSON file listing several targets to proxy to at once, each with the fields of the discovery flags; replaces -cluster, -family, -service, -task-arn, -name, -name-match, -require-port, -env, -public and -public-ports")
+
+	if !d.parse(args) {
+		return 1
+	}
+
+	strategy, err := proxy.ParseStrategy(*strategyName)
+	if err != nil {
+		log.Error(err)
+		flags.PrintDefaults()
+		return 1
+	}
+
+	if *dialTimeout <= 0 {
+		log.Errorf("Invalid dial timeout %v; it must be positive", *dialTimeout)
+		flags.PrintDefaults()
+		return 1
+	}
+
+	if *transparentPort != 0 && *acceptParallelism > 1 {
+		log.Error("-accept-parallelism cannot be used with -transparent-port, whose one listener accepts the connections of every port")
+		flags.PrintDefaults()
+		return 1
+	}
+
+	if *bindAddress != "" && net.ParseIP(*bindAddress) == nil {
+		log.Errorf("Invalid bind address %q", *bindAddress)
+		flags.PrintDefaults()
+		return 1
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Error("-tls-cert and -tls-key must be given together")
+		flags.PrintDefaults()
+		return 1
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Error("Could not load TLS certificate: ", err)
+			return 1
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
-	if *name == "" {
-		flag.PrintDefaults()
+	var backendTLSConfig *tls.Config
+	if *backendTLS {
+		backendTLSConfig, err = loadBackendTLS(*backendTLSCA, *backendTLSServerName, *backendTLSCert, *backendTLSKey)
+		if err != nil {
+			log.Error(err)
+			flags.PrintDefaults()
+			return 1
+		}
+	}
+
+	subnets, err := parseSubnets(*clientSubnets)
+	if err != nil {
+		log.Error(err)
+		flags.PrintDefaults()
 		return 1
 	}
 
-	if *family == "" && *service == "" {
-		flag.PrintDefaults()
+	targets, err := d.targets()
+	if err != nil {
+		log.Error(err)
 		return 1
 	}
+	if *preferLocalAZ {
+		zone, err := ecsclient.LocalAvailabilityZone()
+		if err != nil {
+			log.Warn("Could not find this instance's availability zone; proxying to every zone: ", err)
+		} else {
+			log.Info("Preferring tasks in availability zone ", zone)
+		}
+		for i := range targets {
+			targets[i].zone = zone
+		}
+	}
+	if *list {
+		return listTargets(targets, *maxBackends)
+	}
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
 
-	client := ecsclient.New(*cluster, "", nil, nil)
-	proxyTasks(client, family, service, name, public)
+	var transparent *proxy.Transparent
+	if *transparentPort != 0 {
+		transparent = serveTransparent(uint16(*transparentPort))
+	}
+
+	snapshot := &proxySnapshot{targets: len(targets)}
+	if *adminAddr != "" {
+		serveAdmin(*adminAddr, snapshot)
+	}
+	if *healthAddr != "" {
+		serveHealth(*healthAddr, snapshot)
+	}
+	if *grpcHealthAddr != "" {
+		serveGRPCHealth(*grpcHealthAddr, snapshot)
+	}
+
+	// on SIGTERM, the transparent listener shared by every target is
+	// closed, polling for tasks stops, and then proxyTasks drains every proxy
+	// before returning
+	ctx, stopPolling := context.WithCancel(context.Background())
+	stopOnSignal(func() {
+		if transparent != nil {
+			transparent.Close()
+		}
+		stopPolling()
+	})
+
+	proxy.SetMaxConcurrentDials(*maxConcurrentDials)
+
+	// newProxy returns a function creating the proxies of one target, whose
+	// refresh channel is signalled to poll for its tasks without waiting for
+	// the next update
+	newProxy := func(refresh chan<- struct{}) func(uint16) *proxy.Proxy {
+		return func(port uint16) *proxy.Proxy {
+			p := proxy.New(port)
+			p.SetStrategy(strategy)
+			p.SetConnectionBudget(*connectionBudget)
+			p.SetBindRetryTimeout(*bindRetryTimeout)
+			p.SetBindAddress(*bindAddress)
+			p.EnableTLS(tlsConfig)
+			p.EnableBackendTLS(backendTLSConfig)
+			p.SetCloseOnBackendRemoval(*closeOnRemoval)
+			p.SetDialTimeout(*dialTimeout)
+			p.SetDialRetries(*dialRetries)
+			p.SetIdleTimeout(*idleTimeout)
+			p.SetAccessLog(*accessLog)
+			if *proxyProtocol {
+				p.EnableProxyProtocol()
+			}
+			p.SetMaxConnections(*maxConnections)
+			p.SetAcceptRate(*acceptRate, *acceptBurst)
+			p.EnableConnectionPool(*connectionPool)
+			p.SetPreferPooledBackends(*preferPooled)
+			p.SetMaxBackends(*maxBackends)
+			p.SetAcceptParallelism(*acceptParallelism)
+			p.SetErrorDecay(*errorDecay)
+			p.SetClientSubnets(subnets)
+			p.EnableHealthChecks(*healthCheckInterval, *healthCheckThreshold)
+			p.SetHealthFailClosed(*healthFailClosed)
+			p.SetFailureSpikeHandler(*refreshFailures, func() {
+				select {
+				case refresh <- struct{}{}:
+				default:
+				}
+			})
+			return p
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target proxyTarget) {
+			defer wg.Done()
+			refresh := make(chan struct{}, 1)
+			grace := newStoppedTaskGrace(*stoppedGrace)
+			proxyTasks(ctx, target, d.schedule(), newProxy(refresh), transparent, refresh, snapshot, grace, *drainTimeout)
+		}(target)
+	}
+	wg.Wait()
+	// every target has stopped polling, so their idle API connections can
+	// be released
+	for _, target := range targets {
+		target.client.Close()
+	}
 	return 0
 }
 
-func proxyTasks(client ecsclient.ECSSimpleClient, family, service, name *string, public *bool) {
-	taskUpdates := collectTaskUpdates(client, family, service)
-	// map of port -> proxy
-	proxies := make(map[uint16]*proxy.Proxy)
+// proxyTasks keeps proxies listening for the ports of the found tasks until
+// the context is done, and then drains them before returning
+func proxyTasks(ctx context.Context, target proxyTarget, schedule pollSchedule, newProxy func(uint16) *proxy.Proxy, transparent *proxy.Transparent, refresh <-chan struct{}, snapshot *proxySnapshot, grace *stoppedTaskGrace, drainTimeout time.Duration) {
+	names := target.names
+	taskUpdates := collectTaskUpdates(ctx, target.client, target.family, target.service, schedule, refresh, func() { snapshot.markPolled(target.key) })
+	manager := proxy.NewManager(newProxy, transparent)
 	for tasks := range taskUpdates {
 		// Get changes to what tasks are running in the given family/service
 		if len(tasks) == 0 {
 			log.Debug("No tasks in update; ignoring")
 			continue
 		}
+		tasks = taskhelpers.FilterEnvironment(tasks, names, target.env)
+		if summary := ecsclient.Summarize(tasks); summary.WithoutInstance > 0 {
+			log.Debugf("%v of %v tasks have no EC2 instance, and so no IP to proxy to; %v of them are on a container instance whose EC2 instance was not resolved", summary.WithoutInstance, summary.Total, summary.Unresolved)
+		}
+		stopped := grace.update(tasks)
 		// Find what ports those containers are listening on so we can pretend to be them
-		containerPorts := taskhelpers.ContainerPorts(tasks, *name, "tcp")
+		containerPorts := taskhelpers.ContainerPortsMulti(tasks, names, "tcp")
 		if len(containerPorts) == 0 {
+			for _, name := range names {
+				if other, ok := taskhelpers.OtherProtocolWithPorts(tasks, name, "tcp"); ok {
+					log.Warnf("Container %v has no tcp port bindings, only %v ones; only tcp ports are proxied", name, other)
+				}
+			}
 			log.Warn("No container ports; not proxying anything")
 			// Continue anyway to ensure that we remove any stale listeners
 		}
 		// If there are any ports that are no longer needed (e.g. someone updates a
 		// service to be of a task that no longer listens on port 80 and 8080, only
 		// 80, we stop listening on 8080 here and close any existing connections)
-		unproxyRemovedPorts(containerPorts, proxies)
+		unproxyRemovedPorts(target, containerPorts, manager)
 
 		// Verify that we *are* listening on all the ports the given container is
 		// and proxying appropriately; create any missing proxies, and update the
 		// hosts behind all proxies
-		proxyNewPorts(tasks, name, public, containerPorts, proxies)
+		proxyNewPorts(target, tasks, stopped, containerPorts, manager)
+		snapshot.set(target.key, manager.Proxies())
 	}
+	drainProxies(manager, drainTimeout)
+}
+
+// pollSchedule is how long to wait between polls for tasks: the interval plus
+// up to 'jitter' times it again, chosen at random each time
+type pollSchedule struct {
+	interval time.Duration
+	jitter   float64
+}
+
+func (p pollSchedule) next() time.Duration {
+	return p.interval + time.Duration(rand.Float64()*p.jitter*float64(p.interval))
 }
 
-func collectTaskUpdates(client ecsclient.ECSSimpleClient, family, service *string) <-chan []ecsclient.AugmentedTask {
+// collectTaskUpdates polls for tasks until the context is done, which also
+// abandons any poll in progress, and then closes the returned channel.
+// 'polled' is called after each poll that completes successfully.
+func collectTaskUpdates(ctx context.Context, client ecsclient.ECSSimpleClient, family, service *string, schedule pollSchedule, refresh <-chan struct{}, polled func()) <-chan []ecsclient.AugmentedTask {
 	taskUpdates := make(chan []ecsclient.AugmentedTask, 0)
 	go func() {
+		defer close(taskUpdates)
+		initial := true
+		// whether this poll was requested early, in which case any cached
+		// tasks are known to be stale
+		refreshing := false
 		for {
 			log.Debug("Updating task list")
-			tasks, err := client.Tasks(family, service)
-			if err != nil {
-				log.Warn("Error listing tasks", err)
+			wait := schedule.next()
+			if initial {
+				initial = !streamInitialTasks(ctx, client, family, service, taskUpdates)
+				if ctx.Err() != nil {
+					log.Debug("Stopped polling for tasks")
+					return
+				}
+				if !initial {
+					polled()
+				}
 			} else {
-				log.Debug("listed tasks")
-				taskUpdates <- tasks
+				pollCtx := ctx
+				if refreshing {
+					pollCtx = ecsclient.Uncached(ctx)
+				}
+				tasks, err := client.TasksWithContext(pollCtx, family, service)
+				if ctx.Err() != nil {
+					log.Debug("Stopped polling for tasks")
+					return
+				}
+				if err != nil {
+					log.Warn("Error listing tasks", err)
+					if clusterChanged(err) && wait > time.Second {
+						wait = time.Second
+					}
+				} else {
+					log.Debug("listed tasks")
+					taskUpdates <- tasks
+					polled()
+				}
 			}
 			log.Debug("Sleeping until next update")
-			time.Sleep((time.Duration(rand.Intn(5)) + 5) * time.Second)
+			refreshing = false
+			select {
+			case <-time.After(wait):
+			case <-refresh:
+				log.Info("Refreshing task list early due to backend dial failures")
+				refreshing = true
+			case <-ctx.Done():
+				log.Debug("Stopped polling for tasks")
+				return
+			}
 		}
 	}()
 	return taskUpdates
 }
 
-func unproxyRemovedPorts(containerPorts []uint16, proxies map[uint16]*proxy.Proxy) {
-	var currentPorts []uint16
-	for port := range proxies {
-		currentPorts = append(currentPorts, port)
-	}
-	for _, port := range currentPorts {
-		hasListener := false
-		for _, containerPort := range containerPorts {
-			if port == containerPort {
-				hasListener = true
-				break
-			}
+// clusterChanged returns whether a failure to list tasks was caused by tasks or
+// instances going away while they were being described, in which case the
+// next poll is likely to succeed and is worth making sooner
+func clusterChanged(err error) bool {
+	var describeErr *ecsclient.TaskDescribeError
+	return errors.As(err, &describeErr) ||
+		errors.Is(err, ecsclient.ErrNoContainerInstances) ||
+		errors.Is(err, ecsclient.ErrNoReservations)
+}
+
+// streamInitialTasks sends a growing list of tasks as each page of the first
+// poll is resolved, so that proxying to early backends of a very large cluster
+// can begin before every task has been described. It returns whether the poll
+// completed successfully; once the context is done, it is abandoned.
+func streamInitialTasks(ctx context.Context, client ecsclient.ECSSimpleClient, family, service *string, taskUpdates chan<- []ecsclient.AugmentedTask) bool {
+	var seen []ecsclient.AugmentedTask
+	err := client.StreamTasks(ctx, family, service, func(tasks []ecsclient.AugmentedTask) bool {
+		seen = append(seen, tasks...)
+		partial := make([]ecsclient.AugmentedTask, len(seen))
+		copy(partial, seen)
+		log.Debug("listed partial tasks: ", len(partial))
+		select {
+		case taskUpdates <- partial:
+			return true
+		case <-ctx.Done():
+			return false
 		}
-		if !hasListener {
+	})
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		log.Warn("Error listing tasks", err)
+		return false
+	}
+	return true
+}
+
+func unproxyRemovedPorts(target proxyTarget, containerPorts []uint16, manager *proxy.Manager) {
+	listenPorts := make(map[uint16]bool, len(containerPorts))
+	for _, containerPort := range containerPorts {
+		listenPorts[target.listenPort(containerPort)] = true
+	}
+	for _, port := range manager.Ports() {
+		if !listenPorts[port] {
 			// Containers we're immitating not listening on it, time to pack up
-			log.Warnf("No longer listening on 'stale' port: %v", port)
-			staleProxy := proxies[port]
-			staleProxy.Close()
-			delete(proxies, port)
+			manager.RemovePort(port)
+			target.listenPorts.release(port, target.key)
 		}
 	}
 }
 
-func proxyNewPorts(tasks []ecsclient.AugmentedTask, name *string, public *bool, containerPorts []uint16, proxies map[uint16]*proxy.Proxy) {
+// proxyNewPorts updates the backends of every port, creating proxies for new
+// ports. Backends of the stopped tasks are kept, but only as draining backends.
+// A port already proxied is left without backends, rather than with its old
+// ones, if none of the tasks can be proxied to, so that its outage is reported.
+// Backends all have weight 1 unless the target is weighted by reservation.
+func proxyNewPorts(target proxyTarget, tasks, stopped []ecsclient.AugmentedTask, containerPorts []uint16, manager *proxy.Manager) {
+	names, requirePort := target.names, uint16(*target.requirePort)
+	proxies := manager.Proxies()
 	for _, port := range containerPorts {
-		ipPortPairs := taskhelpers.FilterIPPort(tasks, *name, port, *public)
-		if len(ipPortPairs) == 0 {
+		public := target.ips.PublicIP(port)
+		backends := make(map[string]int)
+		for _, backend := range taskhelpers.FilterIPPortPreferZone(tasks, names, port, requirePort, public, target.zone) {
+			backends[backend] = 1
+		}
+		listenPort := target.listenPort(port)
+		if _, proxied := proxies[listenPort]; len(backends) == 0 && !proxied {
 			continue
 		}
-		existingProxy, exists := proxies[port]
-		if exists {
-			existingProxy.UpdateBackendHosts(ipPortPairs)
-		} else {
-			newProxy := proxy.New(port)
-			log.Info("Now proxying on port", port)
-			newProxy.UpdateBackendHosts(ipPortPairs)
-			go func() {
-				err := newProxy.Serve()
-				if err != nil {
-					log.Warn("Error listening on port", port)
+		if owner, ok := target.listenPorts.claim(listenPort, target.key); !ok {
+			log.Errorf("Targets %v and %v both listen on port %v; not proxying container port %v of %v, which needs a port-override", owner, target.key, listenPort, port, target.key)
+			continue
+		}
+		var draining []string
+		for _, backend := range taskhelpers.FilterIPPortMulti(stopped, names, port, requirePort, public) {
+			if _, ok := backends[backend]; !ok {
+				draining = append(draining, backend)
+				backends[backend] = 1
+			}
+		}
+		if target.weighted {
+			// running and stopped backends are weighed together, so that
+			// they are all weighed by cpu or all by memory
+			all := append(append([]ecsclient.AugmentedTask(nil), tasks...), stopped...)
+			for backend, weight := range taskhelpers.FilterIPPortWeighted(all, names, port, requirePort, public) {
+				// only backends chosen above, e.g. in the preferred zone
+				if _, ok := backends[backend]; ok {
+					backends[backend] = weight
 				}
-			}()
-			proxies[port] = newProxy
+			}
+		}
+		if _, err := manager.EnsurePort(listenPort, "tcp", backends, draining); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// stoppedTaskGrace remembers tasks for a while after they stop being listed as
+// running. ECS stops listing a task as soon as it is asked to stop, but it
+// may well keep serving until its stop timeout, which smooths rolling deploys.
+type stoppedTaskGrace struct {
+	window time.Duration
+	seen   map[string]seenTask
+}
+
+type seenTask struct {
+	task     ecsclient.AugmentedTask
+	lastSeen time.Time
+}
+
+func newStoppedTaskGrace(window time.Duration) *stoppedTaskGrace {
+	return &stoppedTaskGrace{window: window, seen: make(map[string]seenTask)}
+}
+
+// update records the given running tasks, and returns those which are no
+// longer running but were within the grace window
+func (g *stoppedTaskGrace) update(tasks []ecsclient.AugmentedTask) []ecsclient.AugmentedTask {
+	if g.window <= 0 {
+		return nil
+	}
+	now := time.Now()
+	running := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		arn := aws.StringValue(task.ECSTask().TaskArn)
+		running[arn] = true
+		g.seen[arn] = seenTask{task: task, lastSeen: now}
+	}
+	var stopped []ecsclient.AugmentedTask
+	for arn, seen := range g.seen {
+		if running[arn] {
+			continue
+		}
+		if now.Sub(seen.lastSeen) > g.window {
+			delete(g.seen, arn)
+			continue
+		}
+		stopped = append(stopped, seen.task)
+	}
+	return stopped
+}
+
+// parseSubnets parses a comma separated list of CIDRs
+func parseSubnets(cidrs string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
 		}
+		subnets = append(subnets, subnet)
 	}
+	return subnets, nil
+}
+
+func serveTransparent(port uint16) *proxy.Transparent {
+	transparent := proxy.NewTransparent(port)
+	log.Info("Now transparently proxying redirected connections on port", port)
+	go func() {
+		err := transparent.Serve()
+		if err != nil {
+			log.Error("Error listening on transparent port ", port, ": ", err)
+		}
+	}()
+	return transparent
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Info("Serving metrics on ", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Error("Error serving metrics: ", err)
+		}
+	}()
+}
+
+// loadBackendTLS returns the configuration to dial backends over TLS with
+// from the -backend-tls flags
+func loadBackendTLS(caFile, serverName, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read backend CA certificates: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-backend-tls-cert and -backend-tls-key must be given together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load backend TLS client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// stopOnSignal calls stop once the process is asked to stop, as ECS does with
+// SIGTERM before it sends SIGKILL
+func stopOnSignal(stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stopOn(signals, stop)
+}
+
+// stopOn calls stop once a signal is received
+func stopOn(signals <-chan os.Signal, stop func()) {
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v; shutting down", sig)
+		stop()
+	}()
+}
+
+// drainProxies stops accepting connections and gracefully closes every proxy,
+// waiting up to the timeout for their open connections to finish
+func drainProxies(manager *proxy.Manager, timeout time.Duration) {
+	log.Infof("Draining connections for up to %v", timeout)
+	manager.Drain(timeout)
 }
@@ -0,0 +1,152 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The grpc.health.v1.Health service is small enough that it is implemented
+// here directly on top of net/http's cleartext HTTP/2 support, rather than
+// pulling in all of grpc and protobuf for it. Only the unary Check method is
+// supported; Watch returns UNIMPLEMENTED.
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcHealthWatchPath = "/grpc.health.v1.Health/Watch"
+
+	// HealthCheckResponse.ServingStatus values
+	grpcServing    = 1
+	grpcNotServing = 2
+
+	// grpc status codes
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcNotFound      = 5
+	grpcUnimplemented = 12
+
+	// the largest HealthCheckRequest accepted; it only holds a service name
+	maxGRPCHealthRequest = 4096
+)
+
+// serveGRPCHealth serves the standard gRPC health checking protocol on the
+// given address. The kite reports SERVING for the overall ("") service once it
+// is proxying to at least one backend, and NOT_SERVING otherwise.
+func serveGRPCHealth(addr string, snapshot *proxySnapshot) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: addr, Handler: grpcHealthHandler(snapshot), Protocols: &protocols}
+	log.Info("Serving gRPC health checks on ", addr)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Error("Error serving gRPC health checks: ", err)
+		}
+	}()
+}
+
+// grpcHealthHandler serves the health service's methods from the snapshot
+func grpcHealthHandler(snapshot *proxySnapshot) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcHealthCheckPath, func(w http.ResponseWriter, r *http.Request) {
+		service, err := readGRPCHealthRequest(r.Body)
+		if err != nil {
+			writeGRPCError(w, grpcInvalidArg, err.Error())
+			return
+		}
+		if service != "" {
+			writeGRPCError(w, grpcNotFound, "unknown service "+service)
+			return
+		}
+		status := grpcNotServing
+		if snapshot.ready() {
+			status = grpcServing
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		// HealthCheckResponse{status: <status>}, i.e. field 1 as a varint
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(status)})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+	})
+	mux.HandleFunc(grpcHealthWatchPath, func(w http.ResponseWriter, r *http.Request) {
+		writeGRPCError(w, grpcUnimplemented, "Watch is not supported")
+	})
+	return mux
+}
+
+// readGRPCHealthRequest reads a single length-prefixed HealthCheckRequest and
+// returns the service it asks about
+func readGRPCHealthRequest(body io.Reader) (string, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		return "", errors.New("Could not read request message")
+	}
+	if prefix[0] != 0 {
+		return "", errors.New("Compressed requests are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCHealthRequest {
+		return "", errors.New("Request message too large")
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(body, int64(length)))
+	if err != nil || uint32(len(msg)) != length {
+		return "", errors.New("Could not read request message")
+	}
+
+	// HealthCheckRequest has a single field, 'service' (1, a string). Any
+	// others are skipped, as protobuf requires.
+	var service string
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errors.New("Malformed request message")
+		}
+		msg = msg[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return "", errors.New("Malformed request message")
+			}
+			msg = msg[n:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return "", errors.New("Malformed request message")
+			}
+			if field == 1 {
+				service = string(msg[n : n+int(size)])
+			}
+			msg = msg[n+int(size):]
+		default:
+			return "", errors.New("Unsupported field in request message")
+		}
+	}
+	return service, nil
+}
+
+// writeGRPCError fails a call with a "trailers-only" response, which carries
+// the grpc status in its headers and has no body
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
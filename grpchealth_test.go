@@ -0,0 +1,141 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/awslabs/ecs-task-kite/lib/proxy"
+)
+
+// grpcHealthServer serves the snapshot's health over cleartext HTTP/2, as
+// serveGRPCHealth does, and returns a client which speaks it
+func grpcHealthServer(t *testing.T, snapshot *proxySnapshot) (*httptest.Server, *http.Client) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := httptest.NewUnstartedServer(grpcHealthHandler(snapshot))
+	server.Config.Protocols = &protocols
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+type grpcResult struct {
+	status  string
+	message string
+	body    []byte
+}
+
+func callGRPC(t *testing.T, client *http.Client, url string, body []byte) grpcResult {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected an HTTP/2 response, got %v", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200, got %v", resp.StatusCode)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a trailers-only response has its status in the headers instead
+	result := grpcResult{status: resp.Trailer.Get("Grpc-Status"), body: respBody}
+	if status := resp.Header.Get("Grpc-Status"); status != "" {
+		result.status, result.message = status, resp.Header.Get("Grpc-Message")
+	}
+	return result
+}
+
+// healthCheckRequest encodes a length-prefixed HealthCheckRequest{service}
+func healthCheckRequest(service string) []byte {
+	msg := []byte{}
+	if service != "" {
+		msg = append([]byte{0x0a, byte(len(service))}, service...)
+	}
+	return append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+}
+
+func TestGRPCHealthCheckServingStatus(t *testing.T) {
+	snapshot := &proxySnapshot{}
+	server, client := grpcHealthServer(t, snapshot)
+	url := server.URL + grpcHealthCheckPath
+
+	result := callGRPC(t, client, url, healthCheckRequest(""))
+	if result.status != "0" || !bytes.Equal(result.body, []byte{0, 0, 0, 0, 2, 0x08, grpcNotServing}) {
+		t.Errorf("Expected NOT_SERVING without any proxies, got %+v", result)
+	}
+
+	p := proxy.New(80)
+	snapshot.set("target", map[uint16]*proxy.Proxy{80: p})
+	result = callGRPC(t, client, url, healthCheckRequest(""))
+	if result.status != "0" || !bytes.Equal(result.body, []byte{0, 0, 0, 0, 2, 0x08, grpcNotServing}) {
+		t.Errorf("Expected NOT_SERVING with a proxy without backends, got %+v", result)
+	}
+
+	p.UpdateBackendHosts([]string{"10.0.0.1:80"})
+	result = callGRPC(t, client, url, healthCheckRequest(""))
+	if result.status != "0" || !bytes.Equal(result.body, []byte{0, 0, 0, 0, 2, 0x08, grpcServing}) {
+		t.Errorf("Expected SERVING with a backend, got %+v", result)
+	}
+}
+
+func TestGRPCHealthErrorsAreTrailersOnly(t *testing.T) {
+	server, client := grpcHealthServer(t, &proxySnapshot{})
+	check := server.URL + grpcHealthCheckPath
+
+	for _, c := range []struct {
+		name   string
+		url    string
+		body   []byte
+		status string
+	}{
+		{"unknown service", check, healthCheckRequest("other"), "5"},
+		{"watch", server.URL + grpcHealthWatchPath, healthCheckRequest(""), "12"},
+		{"empty body", check, nil, "3"},
+		{"truncated prefix", check, []byte{0, 0, 0}, "3"},
+		{"truncated message", check, []byte{0, 0, 0, 0, 7, 0x0a, 5, 'a'}, "3"},
+		{"truncated field", check, []byte{0, 0, 0, 0, 3, 0x0a, 5, 'a'}, "3"},
+		{"compressed", check, []byte{1, 0, 0, 0, 0}, "3"},
+		{"too large", check, []byte{0, 0, 0, 0x10, 0x01}, "3"},
+	} {
+		result := callGRPC(t, client, c.url, c.body)
+		if result.status != c.status || result.message == "" || len(result.body) != 0 {
+			t.Errorf("%v: expected a trailers-only status %v, got %+v", c.name, c.status, result)
+		}
+	}
+}
+
+func TestReadGRPCHealthRequestSkipsUnknownFields(t *testing.T) {
+	// an unknown varint field 2 before, and an unknown string field 3 after
+	msg := []byte{0x10, 0x96, 0x01, 0x0a, 3, 'a', 'p', 'i', 0x1a, 1, 'x'}
+	body := append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+	service, err := readGRPCHealthRequest(bytes.NewReader(body))
+	if err != nil || service != "api" {
+		t.Errorf("Expected the service \"api\", got %q, %v", service, err)
+	}
+}
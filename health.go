@@ -0,0 +1,51 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// serveHealth serves plain HTTP health checks on the given address, for
+// container or load balancer health checks. '/healthz' is 200 while at least
+// one port has a healthy backend and 503 otherwise, and '/ready' is 200 once
+// the first poll for tasks has completed and 503 until then.
+func serveHealth(addr string, snapshot *proxySnapshot) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, snapshot.healthy())
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, snapshot.polled())
+	})
+	log.Info("Serving health checks on ", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Error("Error serving health checks: ", err)
+		}
+	}()
+}
+
+func writeHealth(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,438 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+// Package dnsserver answers DNS queries for a single name with the current
+// backends of the proxied tasks: A and AAAA records with their IPs, and SRV
+// records with their ports. It implements just enough of the DNS wire format
+// for that, over UDP and TCP.
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Record types and classes answered
+const (
+	typeA    uint16 = 1
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	typeANY  uint16 = 255
+	classIN  uint16 = 1
+	classANY uint16 = 255
+)
+
+// Response codes
+const (
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeNameError      = 3
+	rcodeNotImplemented = 4
+)
+
+const (
+	headerLength = 12
+	// maxUDPLength is the largest response sent without EDNS; larger ones
+	// are truncated and flagged as such, so that clients retry over TCP
+	maxUDPLength = 512
+	// maxTCPLength is the largest response a TCP message's length prefix
+	// allows
+	maxTCPLength = 65535
+	// tcpIdleTimeout is how long a TCP connection is kept open waiting for
+	// the next query
+	tcpIdleTimeout = 10 * time.Second
+	// DefaultTTL is how long resolvers may cache answers unless SetTTL is
+	// called
+	DefaultTTL = 5 * time.Second
+)
+
+var errMalformed = errors.New("Malformed DNS message")
+
+// backend is one 'ip:port' a task can be reached at
+type backend struct {
+	ip   net.IP
+	port uint16
+}
+
+// Server answers queries for its name, and for a host name under it for each
+// backend IP, which SRV records point to. The backends are replaced with
+// UpdateBackends as tasks change.
+type Server struct {
+	// name is fully qualified and lower case, e.g. "web."
+	name     string
+	ttl      uint32
+	conn     net.PacketConn
+	listener net.Listener
+
+	l        sync.RWMutex
+	backends []backend
+}
+
+// New returns a server answering for the given name once 'Serve' is called
+func New(name string) *Server {
+	return &Server{name: canonicalName(name), ttl: uint32(DefaultTTL / time.Second)}
+}
+
+// SetTTL sets how long resolvers may cache answers, which bounds how long
+// they keep using tasks that have stopped
+func (s *Server) SetTTL(ttl time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.ttl = uint32(ttl / time.Second)
+}
+
+// UpdateBackends replaces the backends answered with. Each is an 'ip:port'
+// pair, as returned by taskhelpers.FilterIPPort; invalid ones are skipped.
+func (s *Server) UpdateBackends(backends []string) {
+	var parsed []backend
+	for _, b := range backends {
+		host, portStr, err := net.SplitHostPort(b)
+		if err != nil {
+			log.Warn("Not serving invalid backend ", b, ": ", err)
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if ip == nil || err != nil {
+			log.Warn("Not serving invalid backend ", b)
+			continue
+		}
+		parsed = append(parsed, backend{ip: ip, port: uint16(port)})
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		if c := strings.Compare(parsed[i].ip.String(), parsed[j].ip.String()); c != 0 {
+			return c < 0
+		}
+		return parsed[i].port < parsed[j].port
+	})
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.backends = parsed
+}
+
+// Serve begins answering queries on the given address, over both UDP and TCP.
+// It will block until Close is called, so it's likely best to call with a
+// goroutine. If it's unable to listen it will return an error.
+func (s *Server) Serve(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// on the same port as UDP, which matters if that was chosen for us
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.l.Lock()
+	s.conn = conn
+	s.listener = listener
+	s.l.Unlock()
+	go s.serveTCP(listener)
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Warn("Error reading DNS query: ", err)
+			continue
+		}
+		response := s.respond(buf[:n], maxUDPLength)
+		if response == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(response, from); err != nil {
+			log.Debug("Error answering DNS query from ", from, ": ", err)
+		}
+	}
+}
+
+// serveTCP answers queries on connections to the listener until it is closed
+func (s *Server) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Warn("Error accepting DNS connection: ", err)
+			continue
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// handleTCP answers each query on a connection, every one of them prefixed
+// with its length, until the client closes it or is idle for too long
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	length := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := s.respond(query, maxTCPLength)
+		if response == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(length, uint16(len(response)))
+		if _, err := conn.Write(append(length, response...)); err != nil {
+			log.Debug("Error answering DNS query from ", conn.RemoteAddr(), ": ", err)
+			return
+		}
+	}
+}
+
+// Addr returns the address the server is listening on, or nil if it is not
+func (s *Server) Addr() net.Addr {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Close stops serving
+func (s *Server) Close() {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// respond returns the response to a query, of at most maxLength bytes, or nil
+// if it should be ignored because it is not even a well formed query
+func (s *Server) respond(query []byte, maxLength int) []byte {
+	if len(query) < headerLength {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&0x8000 != 0 {
+		// a response, not a query
+		return nil
+	}
+	// echo the ID, opcode and whether recursion was desired, as an
+	// authoritative response
+	header := []byte{query[0], query[1], 0x84 | byte(flags>>8)&0x79, 0}
+	opcode := (flags >> 11) & 0xf
+	if opcode != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return withRcode(header, rcodeNotImplemented)
+	}
+	name, qtype, qclass, end, err := parseQuestion(query, headerLength)
+	if err != nil {
+		return withRcode(header, rcodeFormatError)
+	}
+	question := query[headerLength:end]
+
+	answers, additional, known := s.answer(name, qtype, qclass)
+	rcode := rcodeSuccess
+	if !known {
+		rcode = rcodeNameError
+	}
+
+	out := append(header, 0, 1, 0, 0, 0, 0, 0, 0)
+	out[3] = byte(rcode)
+	out = append(out, question...)
+	// only whole records are sent; if they don't all fit, the client is told
+	// to retry over TCP, which at least tells it that it has some of them
+	var ancount, arcount uint16
+	for _, rr := range answers {
+		if len(out)+len(rr) > maxLength {
+			out[2] |= 0x02
+			break
+		}
+		out = append(out, rr...)
+		ancount++
+	}
+	for _, rr := range additional {
+		if out[2]&0x02 != 0 || len(out)+len(rr) > maxLength {
+			break
+		}
+		out = append(out, rr...)
+		arcount++
+	}
+	binary.BigEndian.PutUint16(out[6:], ancount)
+	binary.BigEndian.PutUint16(out[10:], arcount)
+	return out
+}
+
+func withRcode(header []byte, rcode byte) []byte {
+	out := append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+	out[3] = rcode
+	return out
+}
+
+// answer returns the answer and additional records for a question, and
+// whether the name is one the server answers for at all
+func (s *Server) answer(name string, qtype, qclass uint16) ([][]byte, [][]byte, bool) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if qclass != classIN && qclass != classANY {
+		return nil, nil, name == s.name || s.hostBackend(name) != nil
+	}
+
+	if name != s.name {
+		ip := s.hostBackend(name)
+		if ip == nil {
+			return nil, nil, false
+		}
+		return nonNil([][]byte{s.addressRecord(name, ip, qtype)}), nil, true
+	}
+
+	var answers, additional [][]byte
+	seen := make(map[string]bool)
+	for _, b := range s.backends {
+		if (qtype == typeSRV || qtype == typeANY) && b.port != 0 {
+			answers = append(answers, s.srvRecord(b))
+		}
+		if seen[b.ip.String()] {
+			continue
+		}
+		seen[b.ip.String()] = true
+		if qtype == typeSRV {
+			additional = append(additional, s.addressRecord(s.hostName(b.ip), b.ip, typeANY))
+		} else if rr := s.addressRecord(name, b.ip, qtype); rr != nil {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, additional, true
+}
+
+func nonNil(records [][]byte) [][]byte {
+	var out [][]byte
+	for _, rr := range records {
+		if rr != nil {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// hostName is the name under the server's name for a backend IP, e.g.
+// "10-0-0-1.web."
+func (s *Server) hostName(ip net.IP) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()) + "." + s.name
+}
+
+// hostBackend returns the backend IP with the given host name, if any
+func (s *Server) hostBackend(name string) net.IP {
+	if !strings.HasSuffix(name, "."+s.name) {
+		return nil
+	}
+	for _, b := range s.backends {
+		if s.hostName(b.ip) == name {
+			return b.ip
+		}
+	}
+	return nil
+}
+
+// addressRecord returns an A or AAAA record for the IP, whichever it is, if
+// that is the type asked for
+func (s *Server) addressRecord(name string, ip net.IP, qtype uint16) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != typeA && qtype != typeANY {
+			return nil
+		}
+		return s.record(name, typeA, ip4)
+	}
+	if qtype != typeAAAA && qtype != typeANY {
+		return nil
+	}
+	return s.record(name, typeAAAA, ip.To16())
+}
+
+// srvRecord returns an SRV record pointing at a backend's host name and port
+func (s *Server) srvRecord(b backend) []byte {
+	data := make([]byte, 6)
+	// priority and weight are left at 0 so that clients choose at random
+	binary.BigEndian.PutUint16(data[4:], b.port)
+	return s.record(s.name, typeSRV, append(data, encodeName(s.hostName(b.ip))...))
+}
+
+func (s *Server) record(name string, rrtype uint16, data []byte) []byte {
+	rr := encodeName(name)
+	fields := make([]byte, 10)
+	binary.BigEndian.PutUint16(fields[0:], rrtype)
+	binary.BigEndian.PutUint16(fields[2:], classIN)
+	binary.BigEndian.PutUint32(fields[4:], s.ttl)
+	binary.BigEndian.PutUint16(fields[8:], uint16(len(data)))
+	return append(append(rr, fields...), data...)
+}
+
+// parseQuestion reads the question at the given offset, returning its name
+// in canonical form and the offset just past it. Compressed names are not
+// accepted, since no client compresses the only name in a query.
+func parseQuestion(msg []byte, offset int) (string, uint16, uint16, int, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, 0, 0, errMalformed
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(msg) {
+			return "", 0, 0, 0, errMalformed
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return "", 0, 0, 0, errMalformed
+	}
+	qtype := binary.BigEndian.Uint16(msg[offset:])
+	qclass := binary.BigEndian.Uint16(msg[offset+2:])
+	return canonicalName(strings.Join(labels, ".")), qtype, qclass, offset + 4, nil
+}
+
+func encodeName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// canonicalName returns a name fully qualified and in lower case
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
@@ -0,0 +1,258 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package dnsserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRecord is a decoded resource record from a response
+type testRecord struct {
+	name   string
+	rrtype uint16
+	data   string
+}
+
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, encodeName(name)...)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+// decodeName reads an uncompressed name, as the server always writes them
+func decodeName(msg []byte, offset int) (string, int) {
+	name := ""
+	for msg[offset] != 0 {
+		length := int(msg[offset])
+		name += string(msg[offset+1:offset+1+length]) + "."
+		offset += 1 + length
+	}
+	return name, offset + 1
+}
+
+// decode returns the response code, whether the response was truncated, and
+// its answer and additional records
+func decode(t *testing.T, msg []byte) (int, bool, []testRecord, []testRecord) {
+	if len(msg) < headerLength || msg[0] != 0x12 || msg[1] != 0x34 || msg[2]&0x80 == 0 {
+		t.Fatalf("Not a response to the query: %v", msg)
+	}
+	offset := headerLength
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, offset = decodeName(msg, offset)
+		offset += 4
+	}
+	var records []testRecord
+	count := int(binary.BigEndian.Uint16(msg[6:]) + binary.BigEndian.Uint16(msg[8:]) + binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < count; i++ {
+		var rr testRecord
+		rr.name, offset = decodeName(msg, offset)
+		rr.rrtype = binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		data := msg[offset+10 : offset+10+length]
+		switch rr.rrtype {
+		case typeA, typeAAAA:
+			rr.data = net.IP(data).String()
+		case typeSRV:
+			target, _ := decodeName(data, 6)
+			rr.data = fmt.Sprintf("%v %v", binary.BigEndian.Uint16(data[4:]), target)
+		}
+		records = append(records, rr)
+		offset += 10 + length
+	}
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	return int(msg[3] & 0xf), msg[2]&0x02 != 0, records[:answers], records[answers:]
+}
+
+func testServer() *Server {
+	s := New("Web")
+	s.UpdateBackends([]string{"10.0.0.2:80", "10.0.0.1:80", "10.0.0.1:8080", "[fd00::1]:80", "invalid"})
+	return s
+}
+
+func TestAnswersA(t *testing.T) {
+	rcode, _, answers, _ := decode(t, testServer().respond(query("web", typeA), maxUDPLength))
+	expected := []testRecord{{"web.", typeA, "10.0.0.1"}, {"web.", typeA, "10.0.0.2"}}
+	if rcode != rcodeSuccess || !reflect.DeepEqual(answers, expected) {
+		t.Errorf("Expected %v, got %v with rcode %v", expected, answers, rcode)
+	}
+
+	_, _, answers, _ = decode(t, testServer().respond(query("WEB.", typeAAAA), maxUDPLength))
+	expected = []testRecord{{"web.", typeAAAA, "fd00::1"}}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Errorf("Expected %v, got %v", expected, answers)
+	}
+}
+
+func TestAnswersSRV(t *testing.T) {
+	_, _, answers, additional := decode(t, testServer().respond(query("web", typeSRV), maxUDPLength))
+	expected := []testRecord{
+		{"web.", typeSRV, "80 10-0-0-1.web."},
+		{"web.", typeSRV, "8080 10-0-0-1.web."},
+		{"web.", typeSRV, "80 10-0-0-2.web."},
+		{"web.", typeSRV, "80 fd00--1.web."},
+	}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Errorf("Expected %v, got %v", expected, answers)
+	}
+	expected = []testRecord{
+		{"10-0-0-1.web.", typeA, "10.0.0.1"},
+		{"10-0-0-2.web.", typeA, "10.0.0.2"},
+		{"fd00--1.web.", typeAAAA, "fd00::1"},
+	}
+	if !reflect.DeepEqual(additional, expected) {
+		t.Errorf("Expected additional %v, got %v", expected, additional)
+	}
+
+	// SRV targets resolve too
+	_, _, answers, _ = decode(t, testServer().respond(query("10-0-0-2.web", typeA), maxUDPLength))
+	expected = []testRecord{{"10-0-0-2.web.", typeA, "10.0.0.2"}}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Errorf("Expected %v, got %v", expected, answers)
+	}
+}
+
+func TestUnknownNames(t *testing.T) {
+	for _, name := range []string{"api", "10-0-0-3.web", "notweb"} {
+		rcode, _, answers, _ := decode(t, testServer().respond(query(name, typeA), maxUDPLength))
+		if rcode != rcodeNameError || len(answers) != 0 {
+			t.Errorf("Expected NXDOMAIN for %v, got rcode %v with %v", name, rcode, answers)
+		}
+	}
+	// a known name with no records of the type is not an error
+	rcode, _, answers, _ := decode(t, testServer().respond(query("10-0-0-2.web", typeAAAA), maxUDPLength))
+	if rcode != rcodeSuccess || len(answers) != 0 {
+		t.Errorf("Expected an empty answer, got rcode %v with %v", rcode, answers)
+	}
+}
+
+func TestMalformedQueries(t *testing.T) {
+	s := testServer()
+	if s.respond([]byte{1, 2, 3}, maxUDPLength) != nil {
+		t.Error("Expected a runt message to be ignored")
+	}
+	truncated := query("web", typeA)
+	rcode, _, _, _ := decode(t, s.respond(truncated[:len(truncated)-2], maxUDPLength))
+	if rcode != rcodeFormatError {
+		t.Errorf("Expected a format error, got %v", rcode)
+	}
+}
+
+func TestTruncatesLargeAnswers(t *testing.T) {
+	s := New("web")
+	var backends []string
+	for i := 0; i < 100; i++ {
+		backends = append(backends, fmt.Sprintf("10.0.%v.%v:80", i/250, i%250+1))
+	}
+	s.UpdateBackends(backends)
+	response := s.respond(query("web", typeA), maxUDPLength)
+	_, truncated, answers, _ := decode(t, response)
+	if !truncated || len(response) > maxUDPLength || len(answers) == 0 {
+		t.Errorf("Expected a truncated response of at most %v bytes, got %v bytes with %v answers (truncated: %v)", maxUDPLength, len(response), len(answers), truncated)
+	}
+}
+
+// serve starts the server on a free port, and waits for it to listen
+func serve(t *testing.T, s *Server) {
+	go s.Serve("127.0.0.1:0")
+	for i := 0; s.Addr() == nil; i++ {
+		if i > 100 {
+			t.Fatal("Server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	s := testServer()
+	s.SetTTL(time.Minute)
+	serve(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(query("web", typeA))
+	buf := make([]byte, maxUDPLength)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, answers, _ := decode(t, buf[:n])
+	if len(answers) != 2 {
+		t.Errorf("Expected 2 answers, got %v", answers)
+	}
+	// the TTL is the 4 bytes after the first answer's name, type and class
+	ttl := binary.BigEndian.Uint32(buf[headerLength+len(encodeName("web"))+4+len(encodeName("web"))+4:])
+	if ttl != 60 {
+		t.Errorf("Expected a TTL of 60, got %v", ttl)
+	}
+}
+
+func TestServeTCPAnswersTruncatedQueriesInFull(t *testing.T) {
+	s := New("web")
+	var backends []string
+	for i := 0; i < 100; i++ {
+		backends = append(backends, fmt.Sprintf("10.0.%v.%v:80", i/250, i%250+1))
+	}
+	s.UpdateBackends(backends)
+	serve(t, s)
+	defer s.Close()
+
+	// too many answers for UDP, so the client is told to retry over TCP
+	udp, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(time.Second))
+	udp.Write(query("web", typeSRV))
+	buf := make([]byte, maxUDPLength)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, truncated, _, _ := decode(t, buf[:n]); !truncated {
+		t.Fatal("Expected the UDP response to be truncated")
+	}
+
+	tcp, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(time.Second))
+	msg := query("web", typeSRV)
+	tcp.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(tcp, length); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(tcp, response); err != nil {
+		t.Fatal(err)
+	}
+	_, truncated, answers, additional := decode(t, response)
+	if truncated || len(answers) != 100 || len(additional) != 100 {
+		t.Errorf("Expected every SRV record and address over TCP, got %v answers and %v additional (truncated: %v)", len(answers), len(additional), truncated)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// stsRegion is the region whose STS endpoint, the global one, is used
+	stsRegion = "us-east-1"
+
+	// roleSessionDuration is how long each set of temporary credentials is
+	// requested for
+	roleSessionDuration = 15 * time.Minute
+	// roleExpiryWindow is how long before they expire that credentials are
+	// refreshed
+	roleExpiryWindow = time.Minute
+)
+
+// NewWithRole is like New, but the clients it constructs use temporary
+// credentials for the given role, e.g. in another account, assumed with the
+// ambient credentials. The externalID is passed to AssumeRole if it is not
+// empty. Credentials are refreshed shortly before they expire.
+func NewWithRole(cluster, region, roleARN, externalID string, ecsclient ecsiface.ECSAPI, ec2client ec2iface.EC2API, cfgs ...*aws.Config) ECSSimpleClient {
+	assumer := sts.New(&aws.Config{
+		Region:      aws.String(stsRegion),
+		Credentials: defaults.DefaultChainCredentials,
+		HTTPClient:  &http.Client{Timeout: 5 * time.Second},
+	})
+	return newWithRole(cluster, region, roleARN, externalID, assumer, ecsclient, ec2client, cfgs...)
+}
+
+func newWithRole(cluster, region, roleARN, externalID string, assumer stscreds.AssumeRoler, ecsclient ecsiface.ECSAPI, ec2client ec2iface.EC2API, cfgs ...*aws.Config) ECSSimpleClient {
+	provider := &stscreds.AssumeRoleProvider{
+		Client:          assumer,
+		RoleARN:         roleARN,
+		RoleSessionName: "ecs-task-kite-" + strconv.FormatInt(time.Now().Unix(), 10),
+		Duration:        roleSessionDuration,
+		ExpiryWindow:    roleExpiryWindow,
+	}
+	if externalID != "" {
+		provider.ExternalID = aws.String(externalID)
+	}
+	cfgs = append(cfgs, &aws.Config{Credentials: credentials.NewCredentials(provider)})
+	return New(cluster, region, ecsclient, ec2client, cfgs...)
+}
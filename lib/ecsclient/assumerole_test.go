@@ -0,0 +1,133 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type fakeAssumer struct {
+	roleARN    string
+	externalID string
+	calls      int
+}
+
+func (f *fakeAssumer) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.roleARN = aws.StringValue(input.RoleArn)
+	f.externalID = aws.StringValue(input.ExternalId)
+	f.calls++
+	expiration := time.Now().Add(time.Hour)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("ASIATEMP"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      &expiration,
+	}}, nil
+}
+func TestNewWithRoleUsesAssumedCredentials(t *testing.T) {
+	assumer := &fakeAssumer{}
+	client := newWithRole("cluster", "us-east-1", "arn:aws:iam::123456789012:role/kite", "external", assumer, nil, nil)
+
+	for _, config := range []*aws.Config{
+		client.(*ECSClient).ecs.(*ecs.ECS).Config,
+		client.(*ECSClient).ec2.(*ec2.EC2).Config,
+	} {
+		value, err := config.Credentials.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.AccessKeyID != "ASIATEMP" || value.SessionToken != "token" {
+			t.Errorf("Expected the assumed role's credentials, got %v", value)
+		}
+	}
+	if assumer.calls != 1 {
+		t.Errorf("Expected credentials to be shared and assumed once, assumed %v times", assumer.calls)
+	}
+	if assumer.roleARN != "arn:aws:iam::123456789012:role/kite" || assumer.externalID != "external" {
+		t.Errorf("Wrong role assumed: %v %v", assumer.roleARN, assumer.externalID)
+	}
+}
+
+// stsServer returns an STS client for a server answering with the given
+// status and body, and checking that requests are signed AssumeRole calls
+func stsServer(t *testing.T, status int, body string) (*sts.STS, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("Request not signed: %v", r.Header.Get("Authorization"))
+		}
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRole" || r.Form.Get("RoleArn") != "role" || r.Form.Get("ExternalId") != "external" {
+			t.Errorf("Unexpected request: %v", r.Form)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	client := sts.New(&aws.Config{
+		Region:      aws.String(stsRegion),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	return client, server.Close
+}
+
+func TestAssumeRoleWithSTS(t *testing.T) {
+	assumer, stop := stsServer(t, http.StatusOK, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIATEMP</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`)
+	defer stop()
+
+	client := newWithRole("cluster", "us-east-1", "role", "external", assumer, nil, nil)
+	creds := client.(*ECSClient).ecs.(*ecs.ECS).Config.Credentials
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ASIATEMP" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+		t.Errorf("Wrong credentials: %v", value)
+	}
+	if creds.IsExpired() {
+		t.Error("Expected the credentials to last until they expire")
+	}
+}
+
+func TestAssumeRoleWithSTSError(t *testing.T) {
+	assumer, stop := stsServer(t, http.StatusForbidden, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`)
+	defer stop()
+
+	client := newWithRole("cluster", "us-east-1", "role", "external", assumer, nil, nil)
+	_, err := client.(*ECSClient).ecs.(*ecs.ECS).Config.Credentials.Get()
+	awsErr, ok := err.(awserr.RequestFailure)
+	if !ok || awsErr.Code() != "AccessDenied" || awsErr.StatusCode() != http.StatusForbidden {
+		t.Errorf("Expected an AccessDenied request failure, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cachedClient memoizes the tasks listed for each family and service
+type cachedClient struct {
+	ECSSimpleClient
+	ttl time.Duration
+
+	l       sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	family, service string
+}
+
+type cacheEntry struct {
+	tasks   []AugmentedTask
+	fetched time.Time
+}
+
+// uncachedKey marks a context under which cached tasks are not reused
+type uncachedKey struct{}
+
+// Uncached returns a context under which a client made by NewCached lists
+// the tasks again rather than returning the ones it has cached, e.g. when
+// they are known to be stale. The newly listed tasks are cached as usual.
+func Uncached(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uncachedKey{}, true)
+}
+
+// NewCached wraps an ECSSimpleClient so that Tasks only calls through to it
+// once per 'ttl' for each family and service, returning the tasks it last
+// listed in between. This keeps many Task Kites from hitting the API rate
+// limits. StreamTasks and TasksByArns are not cached. Each call returns its
+// own copy of the tasks, so callers may modify it. It is safe for concurrent
+// use.
+func NewCached(inner ECSSimpleClient, ttl time.Duration) ECSSimpleClient {
+	return &cachedClient{
+		ECSSimpleClient: inner,
+		ttl:             ttl,
+		entries:         make(map[cacheKey]cacheEntry),
+	}
+}
+
+// Tasks implements ECSSimpleClient
+func (c *cachedClient) Tasks(family, service *string) ([]AugmentedTask, error) {
+	return c.TasksWithContext(context.Background(), family, service)
+}
+
+// TasksWithContext implements ECSSimpleClient
+func (c *cachedClient) TasksWithContext(ctx context.Context, family, service *string) ([]AugmentedTask, error) {
+	key := cacheKey{}
+	if family != nil {
+		key.family = *family
+	}
+	if service != nil {
+		key.service = *service
+	}
+
+	if ctx.Value(uncachedKey{}) == nil {
+		c.l.Lock()
+		entry, ok := c.entries[key]
+		c.l.Unlock()
+		if ok && time.Since(entry.fetched) < c.ttl {
+			return copyTasks(entry.tasks), nil
+		}
+	}
+
+	// The lock is not held while listing, so concurrent misses may each call
+	// through; the last to finish is kept
+	tasks, err := c.ECSSimpleClient.TasksWithContext(ctx, family, service)
+	if err != nil {
+		return nil, err
+	}
+	c.l.Lock()
+	c.entries[key] = cacheEntry{tasks: copyTasks(tasks), fetched: time.Now()}
+	c.l.Unlock()
+	return tasks, nil
+}
+
+func copyTasks(tasks []AugmentedTask) []AugmentedTask {
+	copied := make([]AugmentedTask, len(tasks))
+	copy(copied, tasks)
+	return copied
+}
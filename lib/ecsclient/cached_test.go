@@ -0,0 +1,105 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+)
+
+func TestCachedTasksWithinTTL(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+	cached := ecsclient.NewCached(client, time.Minute)
+
+	family := strptr("family")
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster, Family: family})
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Tasks(family, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other families are cached separately
+	other := strptr("other")
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster, Family: other})
+	if _, err := cached.Tasks(other, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedTasksRefreshAfterTTL(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+	cached := ecsclient.NewCached(client, time.Millisecond)
+
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster})
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster})
+	cached.Tasks(nil, nil)
+	time.Sleep(5 * time.Millisecond)
+	cached.Tasks(nil, nil)
+}
+
+// countingClient lists the same tasks on every call, counting the calls
+type countingClient struct {
+	ecsclient.ECSSimpleClient
+	tasks []ecsclient.AugmentedTask
+	calls int
+}
+
+func (c *countingClient) TasksWithContext(ctx context.Context, family, service *string) ([]ecsclient.AugmentedTask, error) {
+	c.calls++
+	return append([]ecsclient.AugmentedTask(nil), c.tasks...), nil
+}
+
+type fakeTask struct {
+	ecsclient.AugmentedTask
+}
+
+func TestCachedTasksAreCopied(t *testing.T) {
+	inner := &countingClient{tasks: []ecsclient.AugmentedTask{&fakeTask{}}}
+	cached := ecsclient.NewCached(inner, time.Minute)
+
+	first, _ := cached.TasksWithContext(context.Background(), nil, nil)
+	first[0] = nil
+	second, _ := cached.TasksWithContext(context.Background(), nil, nil)
+	second[0] = nil
+	third, _ := cached.TasksWithContext(context.Background(), nil, nil)
+	if third[0] == nil {
+		t.Error("Expected modifying the returned tasks to leave the cached tasks alone")
+	}
+	if inner.calls != 1 {
+		t.Errorf("Expected the tasks to be listed once, got %v", inner.calls)
+	}
+}
+
+func TestUncachedTasksAreListedAgain(t *testing.T) {
+	inner := &countingClient{}
+	cached := ecsclient.NewCached(inner, time.Minute)
+
+	cached.TasksWithContext(context.Background(), nil, nil)
+	cached.TasksWithContext(ecsclient.Uncached(context.Background()), nil, nil)
+	if inner.calls != 2 {
+		t.Errorf("Expected an uncached call to list the tasks again, got %v calls", inner.calls)
+	}
+	// and the newly listed tasks are cached
+	cached.TasksWithContext(context.Background(), nil, nil)
+	if inner.calls != 2 {
+		t.Errorf("Expected the listed tasks to be cached, got %v calls", inner.calls)
+	}
+}
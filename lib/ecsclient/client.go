@@ -16,15 +16,19 @@
 package ecsclient
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs"
@@ -34,16 +38,25 @@ import (
 // ecsChunkSize is the maximum number of elements to pass into a describe api
 const ecsChunkSize = 100
 
-const instanceIdentityDocumentResource = "http://169.254.169.254/2014-11-05/dynamic/instance-identity/document"
+// defaultDescribeConcurrency is how many chunks of container instances are
+// described at once unless DescribeConcurrency is changed
+const defaultDescribeConcurrency = 4
+
+// maxWarnedUnresolved bounds how many task ARNs are remembered as already
+// warned about; once exceeded, they are forgotten and warned about again
+const maxWarnedUnresolved = 4096
 
 // AugmentedTask is a task that has been augmented with additional convenience
 // methods.
 type AugmentedTask interface {
 	PublicIP() string
 	PrivateIP() string
-	Container(string) AugmentedContainer
+	Container(NameMatcher) AugmentedContainer
+	ContainerAt(int) AugmentedContainer
 	ECSTask() *ecs.Task
 	EC2Instance() *ec2.Instance
+	TaskDefinitionARN() string
+	AvailabilityZone() string
 }
 
 // AugmentedContainer is a container that has been augmented with additioanl
@@ -52,6 +65,8 @@ type AugmentedContainer interface {
 	ContainerPorts(string) []uint16
 	ResolvePort(uint16) uint16
 	Running() bool
+	Environment() map[string]string
+	Reservation() (cpu, memory int64)
 	ECSContainer() *ecs.Container
 }
 
@@ -61,12 +76,16 @@ type AugmentedContainer interface {
 type task struct {
 	*ecs.Task
 	ec2Instance *ec2.Instance
+	// definition is only set if ECSClient.DescribeTaskDefinitions is
+	definition *ecs.TaskDefinition
 }
 
 // Container wraps the ECS container and augments it with helper functions.
 // It may be directly instantiated from any ecs.Container object
 type container struct {
 	*ecs.Container
+	// task is the task the container is part of, if known
+	task *task
 }
 
 // ContainerPorts returns the container side of all the port bindings specified
@@ -95,6 +114,9 @@ func (c *container) ContainerPorts(protocol string) []uint16 {
 // ResolvePort returns the host port that a given container port is bound to, or 0 if it is not bound
 func (c *container) ResolvePort(containerPort uint16) uint16 {
 	for _, binding := range c.NetworkBindings {
+		if binding == nil {
+			continue
+		}
 		if binding.ContainerPort != nil && *binding.ContainerPort == int64(containerPort) && binding.HostPort != nil {
 			return uint16(*binding.HostPort)
 		}
@@ -145,21 +167,61 @@ func (t *task) PrivateIP() string {
 	return ""
 }
 
-// Container returns the container by the given name within a task. If no such
-// container exists, it returns nil
-func (t *task) Container(name string) AugmentedContainer {
+// AvailabilityZone returns the availability zone of the EC2 instance a task is
+// running on. If it cannot be found, it returns the empty string.
+func (t *task) AvailabilityZone() string {
+	instance := t.EC2Instance()
+	if instance != nil && instance.Placement != nil {
+		return aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	return ""
+}
+
+// Container returns the container matching the given name within a task. If
+// no such container exists, it returns nil.
+// If several containers match, the first one in the task's container list is
+// always the one returned; use ContainerAt to select another.
+func (t *task) Container(name NameMatcher) AugmentedContainer {
+	var match *ecs.Container
 	for _, ecsContainer := range t.Containers {
-		if ecsContainer.Name != nil && *ecsContainer.Name == name {
-			return &container{ecsContainer}
+		if ecsContainer == nil || ecsContainer.Name == nil || !name.MatchName(*ecsContainer.Name) {
+			continue
+		}
+		if match != nil {
+			log.Debugf("Task %v has multiple containers matching %v (%v and %v); using the first", aws.StringValue(t.TaskArn), name, *match.Name, *ecsContainer.Name)
+			break
 		}
+		match = ecsContainer
 	}
-	return nil
+	if match == nil {
+		return nil
+	}
+	return &container{Container: match, task: t}
+}
+
+// ContainerAt returns the container at the given index within the task's
+// container list. If the index is out of range, it returns nil
+func (t *task) ContainerAt(index int) AugmentedContainer {
+	if index < 0 || index >= len(t.Containers) || t.Containers[index] == nil {
+		return nil
+	}
+	return &container{Container: t.Containers[index], task: t}
 }
 
 func (t *task) ECSTask() *ecs.Task {
 	return t.Task
 }
 
+// TaskDefinitionARN returns the ARN, including revision, of the task
+// definition a task was started from. If it is not known, it returns the
+// empty string.
+func (t *task) TaskDefinitionARN() string {
+	if t == nil || t.Task == nil {
+		return ""
+	}
+	return aws.StringValue(t.TaskDefinitionArn)
+}
+
 // ECSSimpleClient is an abstraction over the ECS API that does the following:
 // 1) Combines list+describe for you, handily dealing with any pagination and
 //    chunking.
@@ -167,6 +229,11 @@ func (t *task) ECSTask() *ecs.Task {
 //    EC2Instance field of the returned structs
 type ECSSimpleClient interface {
 	Tasks(family, serviceName *string) ([]AugmentedTask, error)
+	TasksWithContext(ctx context.Context, family, serviceName *string) ([]AugmentedTask, error)
+	StreamTasks(ctx context.Context, family, serviceName *string, fn func([]AugmentedTask) bool) error
+	TasksByArns(taskArns []*string) ([]AugmentedTask, error)
+	// Close releases the client's idle connections, e.g. when discarding it
+	Close()
 }
 
 // ECSClient implements ECSSimpleClient. It is exposed for cross-package testing
@@ -175,6 +242,56 @@ type ECSClient struct {
 	ec2 ec2iface.EC2API
 
 	cluster string
+	// transport is that of the ECS and EC2 clients New constructed, or nil if
+	// it was given both
+	transport *http.Transport
+
+	// RefreshDeadline bounds how long a single call to Tasks may spend
+	// describing tasks and instances. Once it is exceeded, no further pages or
+	// chunks are described and the tasks resolved so far are returned. Zero
+	// means no deadline.
+	RefreshDeadline time.Duration
+
+	// AvailabilityZones, if not empty, limits the EC2 instances described to
+	// those in the given availability zones. Tasks on instances in other zones
+	// are returned without an EC2 instance, and so without an IP.
+	AvailabilityZones []string
+
+	// InstanceTags, if not empty, limits the EC2 instances used to those
+	// with every one of the given tag keys set to its value. Tasks on other
+	// instances are returned without an EC2 instance, and so without an IP.
+	InstanceTags map[string]string
+
+	// RetryAttempts is how many times each API call is made before giving
+	// up when it fails with throttling, a server error or a network error;
+	// other errors are not retried. The SDK's own retries are disabled.
+	// RetryBaseDelay is the delay before the first retry, which doubles for
+	// each one after it.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+
+	// DescribeTaskDefinitions, if set, describes the task definition of each
+	// task, once per definition, so that the Environment of its containers
+	// includes the environment the definition gives them and not only that
+	// of the task's overrides, and so that their Reservation is known
+	DescribeTaskDefinitions bool
+	definitionLock          sync.Mutex
+	definitions             map[string]*ecs.TaskDefinition
+
+	// DescribeConcurrency is how many DescribeContainerInstances calls, one
+	// per chunk of container instances, may be in flight at once. Values
+	// below 1 mean one at a time.
+	DescribeConcurrency int
+
+	// services maps partial service names to the services they were
+	// resolved to by resolveService, so that they are only resolved once
+	serviceLock sync.Mutex
+	services    map[string]string
+
+	// warnedUnresolved holds the tasks logUnresolved has warned about, so
+	// that each is only warned about once
+	warnedLock       sync.Mutex
+	warnedUnresolved map[string]bool
 }
 
 // New creates a new ECSSimpleClient. The 'ecsclient' and 'ec2client' arguments
@@ -182,7 +299,9 @@ type ECSClient struct {
 // If region is the empty string, it will be inferred from the environment or
 // instance metadata service (in that order of preference). If a region cannot
 // be found, this function will panic.
-func New(cluster string, region string, ecsclient ecsiface.ECSAPI, ec2client ec2iface.EC2API) ECSSimpleClient {
+// Any 'cfgs' given are merged, in order, into the configuration of the
+// clients constructed here, e.g. to enable the SDK's debug logging.
+func New(cluster string, region string, ecsclient ecsiface.ECSAPI, ec2client ec2iface.EC2API, cfgs ...*aws.Config) ECSSimpleClient {
 	// lazily init the http client in case it's not needed
 
 	if region == "" {
@@ -194,9 +313,8 @@ func New(cluster string, region string, ecsclient ecsiface.ECSAPI, ec2client ec2
 
 	if region == "" {
 		log.Debug("Trying to get region from EC2 Metadata")
-		ec2MetadataClient := ec2metadata.New(nil)
 		var err error
-		region, err = ec2MetadataClient.Region()
+		region, err = metadataRegion()
 		if err != nil {
 			log.Errorf("Could not get region from EC2 metadata or environment: %v", err)
 		}
@@ -206,13 +324,21 @@ func New(cluster string, region string, ecsclient ecsiface.ECSAPI, ec2client ec2
 	}
 	log.Info("Region: " + region)
 
+	var transport *http.Transport
 	if ecsclient == nil || ec2client == nil {
+		transport = newAPITransport()
 		// Create a custom client to add our useragent
 		customClient := &http.Client{
 			Timeout:   3 * time.Second,
-			Transport: &userAgentedRoundTripper{},
+			Transport: &userAgentedRoundTripper{transport},
 		}
 		cfg := &aws.Config{Region: aws.String(region), HTTPClient: customClient}
+		for _, extra := range cfgs {
+			cfg = cfg.Merge(extra)
+		}
+		// Retries are made by retryable, which backs off with jitter and
+		// gives up once the context is done
+		cfg.MaxRetries = aws.Int(0)
 		if ecsclient == nil {
 			ecsclient = ecs.New(cfg)
 		}
@@ -222,52 +348,177 @@ func New(cluster string, region string, ecsclient ecsiface.ECSAPI, ec2client ec2
 	}
 
 	return &ECSClient{
-		cluster: cluster,
-		ecs:     ecsclient,
-		ec2:     ec2client,
+		cluster:             cluster,
+		ecs:                 ecsclient,
+		ec2:                 ec2client,
+		transport:           transport,
+		RetryAttempts:       defaultRetryAttempts,
+		RetryBaseDelay:      defaultRetryBaseDelay,
+		DescribeConcurrency: defaultDescribeConcurrency,
 	}
 }
 
+// NewWithConfig constructs an ECSSimpleClient whose ECS and EC2 clients are
+// both built from 'cfg', e.g. with an Endpoint and DisableSSL set to talk to
+// LocalStack or a VPC endpoint rather than the public endpoints. The region
+// is taken from cfg, or inferred as in New if it is not set.
+func NewWithConfig(cluster string, cfg *aws.Config) ECSSimpleClient {
+	return New(cluster, aws.StringValue(cfg.Region), nil, nil, cfg)
+}
+
 // Tasks returns an array of tasks filtered optionally by family or service.
 // The returned Task will be augmented with an EC2 instance element if an instance can be successfully associated.
 func (c *ECSClient) Tasks(family, service *string) ([]AugmentedTask, error) {
-	output := []AugmentedTask{}
+	return c.TasksWithContext(context.Background(), family, service)
+}
+
+// TasksWithContext is like Tasks, but stops early and returns the context's
+// error once it is done, cancelling any request in flight.
+func (c *ECSClient) TasksWithContext(ctx context.Context, family, service *string) ([]AugmentedTask, error) {
+	var deadline time.Time
+	if c.RefreshDeadline > 0 {
+		deadline = time.Now().Add(c.RefreshDeadline)
+	}
+	tasks, err := c.allTasks(ctx, family, service, deadline)
+	if err != nil {
+		return nil, err
+	}
+	running := taskArr(tasks).selectStatus("RUNNING").selectRevision(familyRevision(family))
+	return c.augmentTasks(ctx, running, deadline)
+}
+
+// StreamTasks is like Tasks, but rather than building the entire list in
+// memory it calls 'fn' with the augmented running tasks of each page of
+// results as soon as that page has been resolved. This lets callers start
+// using the first tasks of a very large cluster while later pages are still
+// being fetched. If 'fn' returns false, no further pages are fetched. Once
+// the context is done, it stops as TasksWithContext does.
+func (c *ECSClient) StreamTasks(ctx context.Context, family, service *string, fn func([]AugmentedTask) bool) error {
+	var pageErr error
+	err := c.listTasksPages(ctx, family, service, func(taskArns *ecs.ListTasksOutput, _ bool) bool {
+		if len(taskArns.TaskArns) == 0 {
+			return false
+		}
+		tasks, err := c.describeTasks(ctx, taskArns.TaskArns)
+		if err != nil {
+			pageErr = err
+			return false
+		}
+		running := taskArr(tasks).selectStatus("RUNNING").selectRevision(familyRevision(family))
+		augmented, err := c.augmentTasks(ctx, running, time.Time{})
+		if err != nil {
+			pageErr = err
+			return false
+		}
+		if len(augmented) == 0 {
+			return true
+		}
+		return fn(augmented)
+	})
+	if pageErr != nil {
+		return pageErr
+	}
+	return err
+}
 
-	tasks, err := c.allTasks(family, service)
+// TasksByArns returns the given tasks, augmented with their EC2 instances,
+// without listing the cluster. Unlike Tasks, the tasks are returned whatever
+// their status.
+func (c *ECSClient) TasksByArns(taskArns []*string) ([]AugmentedTask, error) {
+	tasks, err := c.describeTasks(context.Background(), taskArns)
 	if err != nil {
 		return nil, err
 	}
-	tasks = taskArr(tasks).selectStatus("RUNNING")
+	return c.augmentTasks(context.Background(), tasks, time.Time{})
+}
+
+// pastDeadline returns whether the given deadline, if any, has passed
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// augmentTasks resolves the container instances and EC2 instances for the
+// given tasks. If the deadline passes after the first chunk, no further
+// container instances are described and the tasks on the remaining ones are
+// left without an instance. Once the context is done, its error is returned.
+// A chunk of container instances which fails to be described is logged and
+// its tasks are left without an instance; an error is only returned if every
+// chunk fails, or ErrNoContainerInstances if none of the tasks' container
+// instances exist any more.
+func (c *ECSClient) augmentTasks(ctx context.Context, tasks []*ecs.Task, deadline time.Time) ([]AugmentedTask, error) {
+	output := []AugmentedTask{}
 
 	if len(tasks) == 0 {
 		return []AugmentedTask{}, nil
 	}
 
+	// Tasks without a container instance (e.g. on Fargate) have no EC2
+	// instance to describe
 	containerInstanceArns := taskArr(tasks).allContainerInstanceArns()
+	log.Debug("Total container instance arns: ", len(containerInstanceArns))
 
-	if len(containerInstanceArns) == 0 {
-		return nil, fmt.Errorf("No container instances for found tasks")
+	// chunks are described concurrently, up to DescribeConcurrency at a
+	// time, but started in order so that the deadline still stops the later
+	// ones being started
+	var chunks [][]*string
+	for i := 0; i < len(containerInstanceArns); i += ecsChunkSize {
+		end := i + ecsChunkSize
+		if end > len(containerInstanceArns) {
+			end = len(containerInstanceArns)
+		}
+		chunks = append(chunks, containerInstanceArns[i:end])
+	}
+	outputs := make([]*ecs.DescribeContainerInstancesOutput, len(chunks))
+	errs := make([]error, len(chunks))
+	slots := make(chan struct{}, c.describeConcurrency())
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i > 0 && pastDeadline(deadline) {
+			log.Warnf("Refresh deadline exceeded; only described %v of %v container instances", i*ecsChunkSize, len(containerInstanceArns))
+			break
+		}
+		wg.Add(1)
+		go func(i int, chunk []*string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = c.retryable(ctx, func() error {
+				var req *request.Request
+				req, outputs[i] = c.ecs.DescribeContainerInstancesRequest(&ecs.DescribeContainerInstancesInput{
+					Cluster:            &c.cluster,
+					ContainerInstances: chunk,
+				})
+				return send(ctx, req)
+			})
+		}(i, chunk)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	log.Debug("Total container instance arns: ", len(containerInstanceArns))
 
 	ec2InstanceIds := []*string{}
 	containerInstances := map[string]*ecs.ContainerInstance{}
-	for i := 0; i < len(containerInstanceArns); i += ecsChunkSize {
-		var chunk []*string
-		if i+ecsChunkSize > len(containerInstanceArns) {
-			chunk = containerInstanceArns[i:len(containerInstanceArns)]
-		} else {
-			chunk = containerInstanceArns[i : i+ecsChunkSize]
+	var chunkErr error
+	described := 0
+	for i, output := range outputs {
+		if errs[i] != nil {
+			log.Warnf("Error describing %v container instances; their tasks will have no instance: %v", len(chunks[i]), errs[i])
+			chunkErr = errs[i]
+			continue
 		}
-		descrContainerInstances, err := c.ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
-			Cluster:            &c.cluster,
-			ContainerInstances: chunk,
-		})
-		if err != nil {
-			return nil, err
+		if output == nil {
+			// not started before the deadline
+			continue
 		}
-		for _, containerInstance := range descrContainerInstances.ContainerInstances {
+		described++
+		for _, containerInstance := range output.ContainerInstances {
 			if containerInstance.Ec2InstanceId != nil {
 				ec2InstanceIds = append(ec2InstanceIds, containerInstance.Ec2InstanceId)
 			}
@@ -275,37 +526,163 @@ func (c *ECSClient) Tasks(family, service *string) ([]AugmentedTask, error) {
 		}
 	}
 
-	descrInstanceResponse, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: ec2InstanceIds})
+	if described == 0 && chunkErr != nil {
+		return nil, chunkErr
+	}
+	if described > 0 && len(containerInstances) == 0 {
+		return nil, ErrNoContainerInstances
+	}
+	ec2Instances, err := c.describeInstances(ctx, ec2InstanceIds)
 	if err != nil {
 		return nil, err
 	}
+	var definitions map[string]*ecs.TaskDefinition
+	if c.DescribeTaskDefinitions {
+		definitions, err = c.taskDefinitions(ctx, tasks)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	for _, ecsTask := range tasks {
+		var containerInstance *ecs.ContainerInstance
+		if ecsTask.ContainerInstanceArn != nil {
+			containerInstance = containerInstances[*ecsTask.ContainerInstanceArn]
+		} else {
+			log.Debugf("Task %v has no container instance; it will have no EC2 instance", aws.StringValue(ecsTask.TaskArn))
+		}
+		var ec2Instance *ec2.Instance
+		if containerInstance != nil && containerInstance.Ec2InstanceId != nil {
+			ec2Instance = ec2Instances[*containerInstance.Ec2InstanceId]
+		}
+		if ecsTask.ContainerInstanceArn != nil && ec2Instance == nil {
+			c.logUnresolved(ecsTask, containerInstance)
+		}
+		output = append(output, &task{Task: ecsTask, ec2Instance: ec2Instance, definition: definitions[aws.StringValue(ecsTask.TaskDefinitionArn)]})
+	}
+
+	return output, nil
+}
+
+// logUnresolved explains why a task on a container instance has no EC2
+// instance, and so no IP to be proxied to. Each task is warned about once;
+// after that, at debug level.
+func (c *ECSClient) logUnresolved(ecsTask *ecs.Task, containerInstance *ecs.ContainerInstance) {
+	taskArn := aws.StringValue(ecsTask.TaskArn)
+	var reason string
+	switch {
+	case containerInstance == nil:
+		reason = fmt.Sprintf("its container instance %v was not described", aws.StringValue(ecsTask.ContainerInstanceArn))
+	case containerInstance.Ec2InstanceId == nil:
+		reason = fmt.Sprintf("its container instance %v has no EC2 instance ID", aws.StringValue(ecsTask.ContainerInstanceArn))
+	case len(c.AvailabilityZones) > 0 || len(c.InstanceTags) > 0:
+		// most likely filtered out on purpose
+		log.Debugf("Task %v is on EC2 instance %v, which was filtered out or not described", taskArn, *containerInstance.Ec2InstanceId)
+		return
+	default:
+		reason = fmt.Sprintf("its EC2 instance %v was not described", *containerInstance.Ec2InstanceId)
+	}
+	if c.firstUnresolved(taskArn) {
+		log.Warnf("Task %v has no EC2 instance, so no IP to proxy to: %v", taskArn, reason)
+	} else {
+		log.Debugf("Task %v has no EC2 instance, so no IP to proxy to: %v", taskArn, reason)
+	}
+}
+
+// firstUnresolved returns whether the task has not been warned about by
+// logUnresolved before, and remembers that it now has
+func (c *ECSClient) firstUnresolved(taskArn string) bool {
+	c.warnedLock.Lock()
+	defer c.warnedLock.Unlock()
+	if c.warnedUnresolved[taskArn] {
+		return false
+	}
+	if c.warnedUnresolved == nil || len(c.warnedUnresolved) >= maxWarnedUnresolved {
+		c.warnedUnresolved = make(map[string]bool)
+	}
+	c.warnedUnresolved[taskArn] = true
+	return true
+}
+
+// Close implements ECSSimpleClient by closing the idle connections of the
+// HTTP transport New constructed for the client, if any; other clients are
+// unaffected. The client may still be used afterwards.
+func (c *ECSClient) Close() {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+}
+
+func (c *ECSClient) describeConcurrency() int {
+	if c.DescribeConcurrency < 1 {
+		return 1
+	}
+	return c.DescribeConcurrency
+}
+
+// describeInstances returns the given EC2 instances by ID. If there are no
+// IDs, no call is made, since an empty list would describe every instance.
+func (c *ECSClient) describeInstances(ctx context.Context, instanceIds []*string) (map[string]*ec2.Instance, error) {
 	ec2Instances := map[string]*ec2.Instance{}
-	if descrInstanceResponse.Reservations == nil || len(descrInstanceResponse.Reservations) == 0 {
-		return nil, errors.New("No ec2 reservations")
+	if len(instanceIds) == 0 {
+		return ec2Instances, nil
+	}
+
+	describeInstancesInput := &ec2.DescribeInstancesInput{InstanceIds: instanceIds}
+	if len(c.AvailabilityZones) > 0 {
+		zones := make([]*string, len(c.AvailabilityZones))
+		for i := range c.AvailabilityZones {
+			zones[i] = &c.AvailabilityZones[i]
+		}
+		describeInstancesInput.Filters = []*ec2.Filter{{Name: aws.String("availability-zone"), Values: zones}}
+	}
+	var descrInstanceResponse *ec2.DescribeInstancesOutput
+	err := c.retryable(ctx, func() error {
+		var req *request.Request
+		req, descrInstanceResponse = c.ec2.DescribeInstancesRequest(describeInstancesInput)
+		return send(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// With an availability zone filter, it's expected that no instances match
+	if len(descrInstanceResponse.Reservations) == 0 && len(c.AvailabilityZones) == 0 {
+		return nil, ErrNoReservations
 	}
 	for _, reservation := range descrInstanceResponse.Reservations {
 		for _, ec2Instance := range reservation.Instances {
 			if ec2Instance.InstanceId == nil {
 				continue
 			}
+			if !hasTags(ec2Instance, c.InstanceTags) {
+				log.Debugf("Skipping instance %v without the required tags", *ec2Instance.InstanceId)
+				continue
+			}
 			ec2Instances[*ec2Instance.InstanceId] = ec2Instance
 		}
 	}
+	return ec2Instances, nil
+}
 
-	for _, ecsTask := range tasks {
-		containerInstance, ok := containerInstances[*ecsTask.ContainerInstanceArn]
-		var ec2Instance *ec2.Instance
-		if ok && containerInstance.Ec2InstanceId != nil {
-			ec2Instance = ec2Instances[*containerInstance.Ec2InstanceId]
+// hasTags returns whether the instance has every one of the given tags
+func hasTags(instance *ec2.Instance, tags map[string]string) bool {
+	for key, value := range tags {
+		found := false
+		for _, tag := range instance.Tags {
+			if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
 		}
-		output = append(output, &task{Task: ecsTask, ec2Instance: ec2Instance})
 	}
-
-	return output, nil
+	return true
 }
 
-func (c *ECSClient) allTasks(family, service *string) ([]*ecs.Task, error) {
+func (c *ECSClient) listTasksInput(family, service *string) *ecs.ListTasksInput {
 	input := &ecs.ListTasksInput{
 		Cluster:     &c.cluster,
 		Family:      family,
@@ -317,27 +694,50 @@ func (c *ECSClient) allTasks(family, service *string) ([]*ecs.Task, error) {
 	if family != nil && *family == "" {
 		input.Family = nil
 	}
+	if input.Family != nil {
+		// ListTasks only matches family names, so any revision is filtered on
+		// once the tasks are described
+		name := strings.SplitN(*family, ":", 2)[0]
+		input.Family = &name
+	}
+	return input
+}
 
+// familyRevision returns the revision of a "family:revision" family, or "" if
+// there is none
+func familyRevision(family *string) string {
+	if family == nil {
+		return ""
+	}
+	parts := strings.SplitN(*family, ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// allTasks lists and describes all tasks. If the deadline passes after the
+// first page, no further pages are fetched and the tasks described so far are
+// returned. Once the context is done, no further pages are fetched and its
+// error is returned.
+func (c *ECSClient) allTasks(ctx context.Context, family, service *string, deadline time.Time) ([]*ecs.Task, error) {
 	tasks := []*ecs.Task{}
 
 	var descrErr error
-	err := c.ecs.ListTasksPages(input, func(taskArns *ecs.ListTasksOutput, _ bool) bool {
+	err := c.listTasksPages(ctx, family, service, func(taskArns *ecs.ListTasksOutput, _ bool) bool {
 		if len(taskArns.TaskArns) == 0 {
 			return false
 		}
-		descrTasks, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
-			Cluster: &c.cluster,
-			Tasks:   taskArns.TaskArns,
-		})
-		if err != nil {
-			descrErr = err
+		if len(tasks) > 0 && pastDeadline(deadline) {
+			log.Warnf("Refresh deadline exceeded; only listed %v tasks", len(tasks))
 			return false
 		}
-		if len(descrTasks.Failures) != 0 {
-			descrErr = fmt.Errorf("Failure describing task: %v - %v", *descrTasks.Failures[0].Arn, *descrTasks.Failures[0].Reason)
+		descrTasks, err := c.describeTasks(ctx, taskArns.TaskArns)
+		if err != nil {
+			descrErr = err
 			return false
 		}
-		tasks = append(tasks, descrTasks.Tasks...)
+		tasks = append(tasks, descrTasks...)
 		return true
 	})
 	if descrErr != nil {
@@ -350,6 +750,48 @@ func (c *ECSClient) allTasks(family, service *string) ([]*ecs.Task, error) {
 	return tasks, nil
 }
 
+// describeTasks describes the given tasks, ignoring duplicate ARNs and
+// splitting them into as many DescribeTasks calls as needed. If any task
+// fails to be described, an error for the first failure is returned.
+func (c *ECSClient) describeTasks(ctx context.Context, taskArns []*string) ([]*ecs.Task, error) {
+	unique := make([]*string, 0, len(taskArns))
+	seen := make(map[string]bool, len(taskArns))
+	for _, arn := range taskArns {
+		if arn == nil || seen[*arn] {
+			continue
+		}
+		seen[*arn] = true
+		unique = append(unique, arn)
+	}
+
+	tasks := []*ecs.Task{}
+	failures := []*ecs.Failure{}
+	for i := 0; i < len(unique); i += ecsChunkSize {
+		end := i + ecsChunkSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		var descrTasks *ecs.DescribeTasksOutput
+		err := c.retryable(ctx, func() error {
+			var req *request.Request
+			req, descrTasks = c.ecs.DescribeTasksRequest(&ecs.DescribeTasksInput{
+				Cluster: &c.cluster,
+				Tasks:   unique[i:end],
+			})
+			return send(ctx, req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, descrTasks.Tasks...)
+		failures = append(failures, descrTasks.Failures...)
+	}
+	if len(failures) != 0 {
+		return nil, &TaskDescribeError{Arn: aws.StringValue(failures[0].Arn), Reason: aws.StringValue(failures[0].Reason)}
+	}
+	return tasks, nil
+}
+
 type taskArr []*ecs.Task
 
 func (tasks taskArr) selectStatus(status string) taskArr {
@@ -362,30 +804,72 @@ func (tasks taskArr) selectStatus(status string) taskArr {
 	return out
 }
 
-// returns the container instance arns present in this array of tasks, after uniq'ing them
+// selectRevision returns the tasks running the given revision of their task
+// definition, or all of them if revision is ""
+func (tasks taskArr) selectRevision(revision string) taskArr {
+	if revision == "" {
+		return tasks
+	}
+	out := []*ecs.Task{}
+	for _, task := range tasks {
+		if task.TaskDefinitionArn != nil && strings.HasSuffix(*task.TaskDefinitionArn, ":"+revision) {
+			out = append(out, task)
+		}
+	}
+	return out
+}
+
+// returns the container instance arns present in this array of tasks, after
+// uniq'ing them, in sorted order so that describe calls are chunked the same
+// way on every poll
 func (tasks taskArr) allContainerInstanceArns() []*string {
-	out := make(map[string]bool, 0)
+	seen := make(map[string]bool, 0)
+	var arns []string
 	for _, task := range tasks {
-		if task.ContainerInstanceArn != nil {
-			out[*task.ContainerInstanceArn] = true
+		if task.ContainerInstanceArn != nil && !seen[*task.ContainerInstanceArn] {
+			seen[*task.ContainerInstanceArn] = true
+			arns = append(arns, *task.ContainerInstanceArn)
 		}
 	}
-	outArr := make([]*string, len(out))
-	i := 0
-	for key := range out {
-		keyCopy := key
-		outArr[i] = &keyCopy
-		i++
+	sort.Strings(arns)
+	return aws.StringSlice(arns)
+}
+
+const (
+	// apiMaxIdleConnsPerHost is how many idle connections are kept to each
+	// endpoint; enough for the concurrent describe calls of a poll
+	apiMaxIdleConnsPerHost = 2 * defaultDescribeConcurrency
+	// apiIdleConnTimeout is comfortably longer than the time between polls
+	apiIdleConnTimeout     = 90 * time.Second
+	apiTLSHandshakeTimeout = 3 * time.Second
+)
+
+// newAPITransport returns the transport shared by the ECS and EC2 API calls
+// of a client, so that connections to the endpoints are kept alive and reused
+// from one poll to the next rather than made anew each time
+func newAPITransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   3 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   apiMaxIdleConnsPerHost,
+		IdleConnTimeout:       apiIdleConnTimeout,
+		TLSHandshakeTimeout:   apiTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
 	}
-	return outArr
 }
 
-type userAgentedRoundTripper struct{}
+type userAgentedRoundTripper struct {
+	transport *http.Transport
+}
 
-func (*userAgentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("User-Agent", "ECS Task Kite v0.0.1")
-	return http.DefaultTransport.RoundTrip(req)
+func (r *userAgentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", userAgent())
+	return r.transport.RoundTrip(req)
 }
-func (*userAgentedRoundTripper) CancelRequest(req *http.Request) {
-	http.DefaultTransport.(*http.Transport).CancelRequest(req)
+func (r *userAgentedRoundTripper) CancelRequest(req *http.Request) {
+	r.transport.CancelRequest(req)
 }
@@ -14,11 +14,19 @@
 package ecsclient
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
@@ -50,6 +58,209 @@ func networkBinding(port uint16, proto string) *ecs.NetworkBinding {
 	return &ecs.NetworkBinding{ContainerPort: aws.Int64(int64(port)), Protocol: aws.String(proto)}
 }
 
+func TestNewWithConfigEndpoint(t *testing.T) {
+	os.Clearenv()
+	cfg := &aws.Config{
+		Region:     aws.String("us-west-2"),
+		Endpoint:   aws.String("http://localhost:4566"),
+		DisableSSL: aws.Bool(true),
+	}
+	client := NewWithConfig("", cfg)
+
+	ecsConfig := client.(*ECSClient).ecs.(*ecs.ECS).Config
+	if aws.StringValue(ecsConfig.Endpoint) != "http://localhost:4566" || !aws.BoolValue(ecsConfig.DisableSSL) {
+		t.Errorf("ECS client didn't use the endpoint: %v", aws.StringValue(ecsConfig.Endpoint))
+	}
+	if aws.StringValue(ecsConfig.Region) != "us-west-2" {
+		t.Errorf("ECS client didn't use the region: %v", aws.StringValue(ecsConfig.Region))
+	}
+	ec2Config := client.(*ECSClient).ec2.(*ec2.EC2).Config
+	if aws.StringValue(ec2Config.Endpoint) != "http://localhost:4566" {
+		t.Errorf("EC2 client didn't use the endpoint: %v", aws.StringValue(ec2Config.Endpoint))
+	}
+}
+
+func TestClientsHaveKeepAliveTransports(t *testing.T) {
+	os.Clearenv()
+	first := New("", "us-east-1", nil, nil).(*ECSClient)
+	second := New("", "us-west-2", nil, nil).(*ECSClient)
+
+	ecsHTTP := first.ecs.(*ecs.ECS).Config.HTTPClient
+	if ecsHTTP != first.ec2.(*ec2.EC2).Config.HTTPClient {
+		t.Error("ECS and EC2 clients should share an HTTP client")
+	}
+	roundTripper, ok := ecsHTTP.Transport.(*userAgentedRoundTripper)
+	if !ok {
+		t.Fatalf("Expected a user agented round tripper, got %T", ecsHTTP.Transport)
+	}
+	transport := roundTripper.transport
+	if transport == nil || transport == http.DefaultTransport {
+		t.Fatal("Expected a dedicated transport")
+	}
+	if transport.MaxIdleConnsPerHost != apiMaxIdleConnsPerHost || transport.IdleConnTimeout != apiIdleConnTimeout {
+		t.Errorf("Unexpected idle settings: %v per host, %v timeout", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if transport.TLSHandshakeTimeout != apiTLSHandshakeTimeout || transport.DisableKeepAlives {
+		t.Error("Expected keep-alives and a TLS handshake timeout")
+	}
+
+	// so that closing one client leaves the other's connections alone
+	other := second.ecs.(*ecs.ECS).Config.HTTPClient.Transport.(*userAgentedRoundTripper)
+	if other.transport == transport {
+		t.Error("Each client should have a transport of its own")
+	}
+}
+
+func TestCloseReleasesIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	os.Clearenv()
+	client := New("", "us-east-1", nil, nil).(*ECSClient)
+	other := New("", "us-east-1", nil, nil).(*ECSClient)
+	get := func(client *ECSClient) {
+		resp, err := client.ecs.(*ecs.ECS).Config.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	get(client)
+	get(other)
+
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the idle connection to be closed")
+	}
+	// the other client's connection is left idle
+	select {
+	case <-closed:
+		t.Error("Expected only the closed client's connection to be closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	other.Close()
+
+	// clients given both API clients have no transport of their own
+	New("", "us-east-1", &ecs.ECS{}, &ec2.EC2{}).Close()
+}
+
+func TestCancellingAbortsRequestInFlight(t *testing.T) {
+	received := make(chan struct{}, 1)
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		// never answers
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	os.Clearenv()
+	client := NewWithConfig("", &aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	if _, err := client.TasksWithContext(ctx, nil, nil); err != context.Canceled {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	defer func(version, comment string) { Version, UserAgentComment = version, comment }(Version, UserAgentComment)
+	var agents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &userAgentedRoundTripper{newAPITransport()}}
+
+	Version = "v1.2.3"
+	for _, comment := range []string{"", "fleet-a"} {
+		UserAgentComment = comment
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expected := []string{"ECS Task Kite v1.2.3", "ECS Task Kite v1.2.3 (fleet-a)"}
+	if !reflect.DeepEqual(agents, expected) {
+		t.Errorf("Expected User-Agents %v, got %v", expected, agents)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tasks := []AugmentedTask{
+		&task{Task: &ecs.Task{LastStatus: aws.String("RUNNING")}, ec2Instance: &ec2.Instance{}},
+		&task{Task: &ecs.Task{LastStatus: aws.String("RUNNING")}},
+		&task{Task: &ecs.Task{LastStatus: aws.String("STOPPED")}, ec2Instance: &ec2.Instance{}},
+		&task{Task: &ecs.Task{LastStatus: aws.String("RUNNING"), ContainerInstanceArn: aws.String("ci1")}},
+	}
+	expected := Summary{Total: 4, Running: 3, WithInstance: 2, WithoutInstance: 2, Unresolved: 1}
+	if summary := Summarize(tasks); summary != expected {
+		t.Errorf("Expected %+v, got %+v", expected, summary)
+	}
+}
+
+func TestUnresolvedTasksAreWarnedAboutOnce(t *testing.T) {
+	c := &ECSClient{}
+	if !c.firstUnresolved("task1") {
+		t.Error("Expected the first time a task is unresolved to be warned about")
+	}
+	if c.firstUnresolved("task1") {
+		t.Error("Expected a task unresolved again not to be warned about")
+	}
+	if !c.firstUnresolved("task2") {
+		t.Error("Expected another task to be warned about")
+	}
+}
+
+func TestTaskDefinitionARN(t *testing.T) {
+	arn := "arn:aws:ecs:us-east-1:123456789012:task-definition/web:3"
+	if got := (&task{Task: &ecs.Task{TaskDefinitionArn: aws.String(arn)}}).TaskDefinitionARN(); got != arn {
+		t.Errorf("Expected %v, got %v", arn, got)
+	}
+	for _, empty := range []*task{nil, {}, {Task: &ecs.Task{}}} {
+		if got := empty.TaskDefinitionARN(); got != "" {
+			t.Errorf("Expected no task definition ARN, got %v", got)
+		}
+	}
+}
+
+func TestAvailabilityZone(t *testing.T) {
+	instance := &ec2.Instance{Placement: &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")}}
+	if zone := (&task{Task: &ecs.Task{}, ec2Instance: instance}).AvailabilityZone(); zone != "us-east-1a" {
+		t.Errorf("Expected the instance's availability zone, got %v", zone)
+	}
+	for _, unplaced := range []*task{nil, {}, {ec2Instance: &ec2.Instance{}}} {
+		if zone := unplaced.AvailabilityZone(); zone != "" {
+			t.Errorf("Expected no availability zone, got %v", zone)
+		}
+	}
+}
+
 func TestContainerPortsHelper(t *testing.T) {
 	pairs := []struct {
 		given    []*ecs.NetworkBinding
@@ -107,3 +318,157 @@ func TestContainerPortsHelperWithProtocol(t *testing.T) {
 		t.Fatalf("Expected container ports to be 9090; were %v", container.ContainerPorts("tcp"))
 	}
 }
+
+func TestContainerReturnsFirstDuplicate(t *testing.T) {
+	first := &ecs.Container{Name: aws.String("web"), ContainerArn: aws.String("first")}
+	second := &ecs.Container{Name: aws.String("web"), ContainerArn: aws.String("second")}
+	task := &task{Task: &ecs.Task{Containers: []*ecs.Container{first, second}}}
+
+	for i := 0; i < 3; i++ {
+		if task.Container(ExactName("web")).ECSContainer() != first {
+			t.Fatal("Expected the first container with a duplicate name to be returned")
+		}
+	}
+	if task.Container(ExactName("api")) != nil {
+		t.Error("Expected no container for a missing name")
+	}
+}
+
+func TestContainerAt(t *testing.T) {
+	first := &ecs.Container{Name: aws.String("web")}
+	second := &ecs.Container{Name: aws.String("web")}
+	task := &task{Task: &ecs.Task{Containers: []*ecs.Container{first, second}}}
+
+	if task.ContainerAt(1).ECSContainer() != second {
+		t.Error("Expected ContainerAt(1) to return the second container")
+	}
+	if task.ContainerAt(2) != nil || task.ContainerAt(-1) != nil {
+		t.Error("Expected out of range indexes to return nil")
+	}
+}
+
+func TestNilLastStatusIsNotRunning(t *testing.T) {
+	var nilContainer *container
+	if nilContainer.Running() {
+		t.Error("Expected a nil container not to be running")
+	}
+	if (&container{Container: &ecs.Container{}}).Running() {
+		t.Error("Expected a container with a nil LastStatus not to be running")
+	}
+	tasks := taskArr{&ecs.Task{}, &ecs.Task{LastStatus: aws.String("RUNNING")}}.selectStatus("RUNNING")
+	if len(tasks) != 1 {
+		t.Errorf("Expected only the task with a RUNNING status to be selected, got %v", len(tasks))
+	}
+}
+
+func TestAllContainerInstanceArnsAreSortedAndUnique(t *testing.T) {
+	tasks := taskArr{
+		{ContainerInstanceArn: aws.String("ci3")},
+		{ContainerInstanceArn: aws.String("ci1")},
+		{},
+		{ContainerInstanceArn: aws.String("ci3")},
+		{ContainerInstanceArn: aws.String("ci2")},
+		{ContainerInstanceArn: aws.String("ci1")},
+	}
+	expected := []string{"ci1", "ci2", "ci3"}
+	for i := 0; i < 10; i++ {
+		if arns := aws.StringValueSlice(tasks.allContainerInstanceArns()); !reflect.DeepEqual(arns, expected) {
+			t.Fatalf("Expected %v, got %v", expected, arns)
+		}
+	}
+}
+
+func TestContainerEnvironment(t *testing.T) {
+	ecsTask := &ecs.Task{
+		Containers: []*ecs.Container{{Name: aws.String("web")}, {Name: aws.String("sidecar")}},
+		Overrides: &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{{
+			Name:        aws.String("web"),
+			Environment: []*ecs.KeyValuePair{{Name: aws.String("STAGE"), Value: aws.String("canary")}},
+		}}},
+	}
+	definition := &ecs.TaskDefinition{ContainerDefinitions: []*ecs.ContainerDefinition{{
+		Name: aws.String("web"),
+		Environment: []*ecs.KeyValuePair{
+			{Name: aws.String("ROLE"), Value: aws.String("frontend")},
+			{Name: aws.String("STAGE"), Value: aws.String("prod")},
+		},
+	}}}
+
+	web := (&task{Task: ecsTask, definition: definition}).Container(ExactName("web"))
+	expected := map[string]string{"ROLE": "frontend", "STAGE": "canary"}
+	if env := web.Environment(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected the definition's environment with the override applied %v, got %v", expected, env)
+	}
+
+	// without the definition, only the overrides are known
+	web = (&task{Task: ecsTask}).Container(ExactName("web"))
+	if env := web.Environment(); !reflect.DeepEqual(env, map[string]string{"STAGE": "canary"}) {
+		t.Errorf("Expected only the override's environment, got %v", env)
+	}
+
+	sidecar := (&task{Task: ecsTask, definition: definition}).Container(ExactName("sidecar"))
+	if env := sidecar.Environment(); env == nil || len(env) != 0 {
+		t.Errorf("Expected an empty environment, got %v", env)
+	}
+	var nilContainer *container
+	if env := nilContainer.Environment(); env == nil || len(env) != 0 {
+		t.Errorf("Expected an empty environment, got %v", env)
+	}
+}
+
+func TestContainerReservation(t *testing.T) {
+	ecsTask := &ecs.Task{Containers: []*ecs.Container{{Name: aws.String("web")}, {Name: aws.String("sidecar")}}}
+	definition := &ecs.TaskDefinition{ContainerDefinitions: []*ecs.ContainerDefinition{{
+		Name:   aws.String("web"),
+		Cpu:    aws.Int64(512),
+		Memory: aws.Int64(1024),
+	}}}
+
+	web := (&task{Task: ecsTask, definition: definition}).Container(ExactName("web"))
+	if cpu, memory := web.Reservation(); cpu != 512 || memory != 1024 {
+		t.Errorf("Expected 512 cpu units and 1024 MiB, got %v and %v", cpu, memory)
+	}
+	sidecar := (&task{Task: ecsTask, definition: definition}).Container(ExactName("sidecar"))
+	if cpu, memory := sidecar.Reservation(); cpu != 0 || memory != 0 {
+		t.Errorf("Expected no reservation for a container not in the definition, got %v and %v", cpu, memory)
+	}
+	web = (&task{Task: ecsTask}).Container(ExactName("web"))
+	if cpu, memory := web.Reservation(); cpu != 0 || memory != 0 {
+		t.Errorf("Expected no reservation without the definition, got %v and %v", cpu, memory)
+	}
+}
+
+func TestResolvePortSkipsNilBindings(t *testing.T) {
+	c := container{Container: &ecs.Container{
+		NetworkBindings: []*ecs.NetworkBinding{
+			nil,
+			&ecs.NetworkBinding{ContainerPort: aws.Int64(80), HostPort: aws.Int64(32768)},
+		},
+	}}
+	if port := c.ResolvePort(80); port != 32768 {
+		t.Errorf("Expected port 80 to resolve to 32768, got %v", port)
+	}
+}
+
+func TestContainerNameMatchers(t *testing.T) {
+	web := &ecs.Container{Name: aws.String("web-v2")}
+	sidecar := &ecs.Container{Name: aws.String("log-router")}
+	task := &task{Task: &ecs.Task{Containers: []*ecs.Container{sidecar, web}}}
+
+	prefix, _ := ParseNameMatcher("prefix", "web")
+	regex, _ := ParseNameMatcher("regex", "^web-v[0-9]+$")
+	for _, matcher := range []NameMatcher{prefix, regex} {
+		if c := task.Container(matcher); c == nil || c.ECSContainer() != web {
+			t.Errorf("Expected %v to match the web container", matcher)
+		}
+	}
+	if task.Container(ExactName("web")) != nil {
+		t.Error("Expected an exact name not to match by prefix")
+	}
+	if _, err := ParseNameMatcher("regex", "web("); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+	if _, err := ParseNameMatcher("glob", "web"); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
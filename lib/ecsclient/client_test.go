@@ -14,9 +14,19 @@
 package ecsclient_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/service/serviceinfo"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
@@ -41,6 +51,41 @@ func setup(t *testing.T) (*gomock.Controller, ecsclient.ECSSimpleClient, *mock_e
 	return ctrl, ecsClient, mockecs, mockec2
 }
 
+// sent returns a request which sends nothing and then fails with err, if it is
+// not nil, for the mocks' *Request methods to return with their output
+func sent(err error) *request.Request {
+	req := request.New(serviceinfo.ServiceInfo{Config: aws.NewConfig()}, request.Handlers{}, nil, &request.Operation{Name: "Test"}, nil, nil)
+	if err != nil {
+		req.Handlers.Send.PushBack(func(r *request.Request) {
+			r.Error = err
+		})
+	}
+	return req
+}
+
+// expectTaskPages expects the tasks to be listed with the given input, one
+// page of ARNs at a time, or as a single empty page if no pages are given. It
+// returns the expected call for each page, in order.
+func expectTaskPages(mockecs *mock_ecsiface.MockECSAPI, input *ecs.ListTasksInput, pages ...[]*string) []*gomock.Call {
+	if len(pages) == 0 {
+		pages = [][]*string{nil}
+	}
+	var calls []*gomock.Call
+	for i, page := range pages {
+		pageInput := *input
+		output := &ecs.ListTasksOutput{TaskArns: page}
+		if i > 0 {
+			pageInput.NextToken = aws.String(strconv.Itoa(i))
+		}
+		if i < len(pages)-1 {
+			output.NextToken = aws.String(strconv.Itoa(i + 1))
+		}
+		calls = append(calls, mockecs.EXPECT().ListTasksRequest(&pageInput).Return(sent(nil), output))
+	}
+	gomock.InOrder(calls...)
+	return calls
+}
+
 func TestListAllTasks(t *testing.T) {
 	ctrl, ecsClient, mockecs, mockec2 := setup(t)
 	defer ctrl.Finish()
@@ -80,28 +125,28 @@ func TestListAllTasks(t *testing.T) {
 			PublicIpAddress: strptr("2.2.2.2"),
 		},
 	}
+	list := expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, mockTaskArns)
 	gomock.InOrder(
-		mockecs.EXPECT().ListTasksPages(&ecs.ListTasksInput{Cluster: pcluster}, gomock.Any()).Do(func(_, f interface{}) {
-			f.(func(*ecs.ListTasksOutput, bool) bool)(&ecs.ListTasksOutput{TaskArns: mockTaskArns}, true)
-		}).Return(nil),
-		mockecs.EXPECT().DescribeTasks(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: mockTaskArns}).Return(
+		list[0],
+		mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: mockTaskArns}).Return(
+			sent(nil),
 			&ecs.DescribeTasksOutput{
 				Tasks: mockTasks,
 			},
-			nil,
 		),
-		mockecs.EXPECT().DescribeContainerInstances(describeContainerInstanceMatcher{&ecs.DescribeContainerInstancesInput{Cluster: pcluster, ContainerInstances: mockCIArns}}).Return(
+		mockecs.EXPECT().DescribeContainerInstancesRequest(describeContainerInstanceMatcher{&ecs.DescribeContainerInstancesInput{Cluster: pcluster, ContainerInstances: mockCIArns}}).Return(
+			sent(nil),
 			&ecs.DescribeContainerInstancesOutput{
 				ContainerInstances: mockCIs,
 			},
-			nil,
 		),
-		mockec2.EXPECT().DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: mockEC2Ids}).Return(&ec2.DescribeInstancesOutput{
-			Reservations: []*ec2.Reservation{
-				&ec2.Reservation{Instances: mockEC2Instances},
+		mockec2.EXPECT().DescribeInstancesRequest(&ec2.DescribeInstancesInput{InstanceIds: mockEC2Ids}).Return(
+			sent(nil),
+			&ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{
+					&ec2.Reservation{Instances: mockEC2Instances},
+				},
 			},
-		},
-			nil,
 		),
 	)
 	tasks, err := ecsClient.Tasks(nil, nil)
@@ -150,3 +195,614 @@ func (lhs describeContainerInstanceMatcher) Matches(x interface{}) bool {
 func (describeContainerInstanceMatcher) String() string {
 	return "Container Instance Describe Matcher"
 }
+
+func TestStreamTasksCallsBackPerPage(t *testing.T) {
+	ctrl, ecsClient, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	pages := [][]*string{{strptr("task1")}, {strptr("task2")}}
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	for i, page := range pages {
+		ciArn := strptr("ci" + *page[0])
+		ec2ID := strptr("i-" + *page[0])
+		mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: page}).Return(sent(nil), &ecs.DescribeTasksOutput{
+			Tasks: []*ecs.Task{{TaskArn: page[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: ciArn}},
+		})
+		mockecs.EXPECT().DescribeContainerInstancesRequest(&ecs.DescribeContainerInstancesInput{Cluster: pcluster, ContainerInstances: []*string{ciArn}}).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: ciArn, Ec2InstanceId: ec2ID}},
+		})
+		mockec2.EXPECT().DescribeInstancesRequest(&ec2.DescribeInstancesInput{InstanceIds: []*string{ec2ID}}).Return(sent(nil), &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: ec2ID, PrivateIpAddress: strptr(ips[i])}}}},
+		})
+	}
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, pages...)
+
+	var streamed [][]ecsclient.AugmentedTask
+	err := ecsClient.StreamTasks(context.Background(), nil, nil, func(tasks []ecsclient.AugmentedTask) bool {
+		streamed = append(streamed, tasks)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != 2 {
+		t.Fatalf("Expected a callback per page, got %v", len(streamed))
+	}
+	if streamed[0][0].PrivateIP() != "10.0.0.1" || streamed[1][0].PrivateIP() != "10.0.0.2" {
+		t.Error("Streamed tasks were not augmented with their instances")
+	}
+}
+
+func TestTasksByArnsSkipsListing(t *testing.T) {
+	ctrl, ecsClient, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("task1")}
+	gomock.InOrder(
+		mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns}).Return(sent(nil), &ecs.DescribeTasksOutput{
+			Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+		}),
+		mockecs.EXPECT().DescribeContainerInstancesRequest(&ecs.DescribeContainerInstancesInput{Cluster: pcluster, ContainerInstances: []*string{strptr("ci1")}}).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")}},
+		}),
+		mockec2.EXPECT().DescribeInstancesRequest(&ec2.DescribeInstancesInput{InstanceIds: []*string{strptr("i-1")}}).Return(sent(nil), &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1"), PrivateIpAddress: strptr("10.0.0.1")}}}},
+		}),
+	)
+
+	tasks, err := ecsClient.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].PrivateIP() != "10.0.0.1" {
+		t.Errorf("Expected the described task with its instance, got %v", tasks)
+	}
+}
+
+func TestRefreshDeadlineReturnsPartialResults(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).RefreshDeadline = 10 * time.Millisecond
+
+	page1 := []*string{strptr("task1")}
+	page2 := []*string{strptr("task2")}
+	// the second page is listed, but not described
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, page1, page2)
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: page1}).Do(func(interface{}) {
+		time.Sleep(20 * time.Millisecond)
+	}).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: page1[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")}},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1")}}}},
+	})
+
+	tasks, err := client.Tasks(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || *tasks[0].ECSTask().TaskArn != "task1" {
+		t.Errorf("Expected only the first page of tasks, got %v", tasks)
+	}
+}
+
+func TestAvailabilityZonesFilterDescribeInstances(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).AvailabilityZones = []string{"us-east-1a"}
+
+	taskArns := []*string{strptr("task1"), strptr("task2")}
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns}).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{
+			{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")},
+			{TaskArn: taskArns[1], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci2")},
+		},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{
+			{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")},
+			{ContainerInstanceArn: strptr("ci2"), Ec2InstanceId: strptr("i-2")},
+		},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{strptr("i-1"), strptr("i-2")},
+		Filters:     []*ec2.Filter{{Name: strptr("availability-zone"), Values: []*string{strptr("us-east-1a")}}},
+	}).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1"), PrivateIpAddress: strptr("10.0.0.1")}}}},
+	})
+
+	tasks, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].PrivateIP() != "10.0.0.1" || tasks[1].PrivateIP() != "" {
+		t.Errorf("Expected only the task in the zone to have an IP, got %v", tasks)
+	}
+}
+
+func TestInstanceTagsFilterInstances(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).InstanceTags = map[string]string{"environment": "prod"}
+
+	taskArns := []*string{strptr("task1"), strptr("task2")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{
+			{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")},
+			{TaskArn: taskArns[1], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci2")},
+		},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{
+			{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")},
+			{ContainerInstanceArn: strptr("ci2"), Ec2InstanceId: strptr("i-2")},
+		},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+			{InstanceId: strptr("i-1"), PrivateIpAddress: strptr("10.0.0.1"), Tags: []*ec2.Tag{{Key: strptr("environment"), Value: strptr("prod")}}},
+			{InstanceId: strptr("i-2"), PrivateIpAddress: strptr("10.0.0.2"), Tags: []*ec2.Tag{{Key: strptr("environment"), Value: strptr("staging")}}},
+		}}},
+	})
+
+	tasks, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].PrivateIP() != "10.0.0.1" || tasks[1].PrivateIP() != "" {
+		t.Errorf("Expected only the task on the tagged instance to have an IP, got %v", tasks)
+	}
+}
+
+func TestTasksWithoutContainerInstancesSkipEC2(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	// Fargate tasks have no container instance, so neither
+	// DescribeContainerInstances nor DescribeInstances should be called
+	taskArns := []*string{strptr("task1")}
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns}).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING")}},
+	})
+
+	tasks, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].EC2Instance() != nil {
+		t.Errorf("Expected the task without an EC2 instance, got %v", tasks)
+	}
+}
+
+func TestMixedEC2AndFargateTasks(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("ec2task"), strptr("fargatetask")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{
+			{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")},
+			{TaskArn: taskArns[1], LastStatus: strptr("RUNNING")},
+		},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(&ecs.DescribeContainerInstancesInput{Cluster: pcluster, ContainerInstances: []*string{strptr("ci1")}}).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")}},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1"), PrivateIpAddress: strptr("10.0.0.1")}}}},
+	})
+
+	tasks, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].PrivateIP() != "10.0.0.1" || tasks[1].EC2Instance() != nil {
+		t.Errorf("Expected the EC2 task with its instance and the Fargate task without one, got %v", tasks)
+	}
+}
+
+func TestUnresolvedTasksAreCountedSeparately(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("resolved"), strptr("noinstance"), strptr("fargate")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{
+			{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")},
+			{TaskArn: taskArns[1], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci2")},
+			{TaskArn: taskArns[2], LastStatus: strptr("RUNNING")},
+		},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{
+			{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")},
+			{ContainerInstanceArn: strptr("ci2")},
+		},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1"), PrivateIpAddress: strptr("10.0.0.1")}}}},
+	})
+
+	tasks, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ecsclient.Summary{Total: 3, Running: 3, WithInstance: 1, WithoutInstance: 2, Unresolved: 1}
+	if summary := ecsclient.Summarize(tasks); summary != expected {
+		t.Errorf("Expected only the task on a container instance without an EC2 instance to be unresolved, got %+v", summary)
+	}
+}
+
+func TestTasksWithContextStopsWhenCancelled(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	page1 := []*string{strptr("task1")}
+	page2 := []*string{strptr("task2")}
+	// cancelled as the first page is described; nothing further is listed
+	// or described
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, page1, page2)[1].Times(0)
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: page1}).Do(func(interface{}) {
+		cancel()
+	}).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: page1[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+	})
+
+	_, err := client.TasksWithContext(ctx, nil, nil)
+	if err != context.Canceled {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+}
+
+func TestFailedContainerInstanceChunkIsSkipped(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	// enough container instances for two describe calls
+	taskArns := []*string{}
+	tasks := []*ecs.Task{}
+	containerInstances := []*ecs.ContainerInstance{}
+	for i := 0; i < 101; i++ {
+		taskArn, ciArn := strptr(fmt.Sprintf("task%d", i)), strptr(fmt.Sprintf("ci%d", i))
+		taskArns = append(taskArns, taskArn)
+		tasks = append(tasks, &ecs.Task{TaskArn: taskArn, LastStatus: strptr("RUNNING"), ContainerInstanceArn: ciArn})
+		containerInstances = append(containerInstances, &ecs.ContainerInstance{ContainerInstanceArn: ciArn, Ec2InstanceId: strptr("i-1")})
+	}
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns[:100]}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks[:100]})
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns[100:]}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks[100:]})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(errors.New("throttled")), nil)
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: containerInstances,
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1")}}}},
+	})
+
+	augmented, err := client.TasksByArns(taskArns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(augmented) != 101 {
+		t.Errorf("Expected every task despite the failed chunk, got %v", len(augmented))
+	}
+}
+
+func TestDescribeTasksIsChunkedAndDeduplicated(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{}
+	tasks := []*ecs.Task{}
+	for i := 0; i < 150; i++ {
+		taskArn := strptr(fmt.Sprintf("task%d", i))
+		taskArns = append(taskArns, taskArn)
+		tasks = append(tasks, &ecs.Task{TaskArn: taskArn, LastStatus: strptr("RUNNING")})
+	}
+	// a page repeating a task must not describe it twice
+	listed := append(taskArns, strptr("task0"))
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, listed)
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns[:100]}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks[:100]})
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns[100:]}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks[100:]})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Times(0)
+
+	augmented, err := client.Tasks(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(augmented) != 150 {
+		t.Errorf("Expected all 150 tasks, got %v", len(augmented))
+	}
+}
+
+func TestNoReservationsError(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("task1")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")}},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{})
+
+	_, err := client.TasksByArns(taskArns)
+	if !errors.Is(err, ecsclient.ErrNoReservations) {
+		t.Errorf("Expected ErrNoReservations, got %v", err)
+	}
+}
+
+func TestNoContainerInstancesError(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("task1")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{})
+
+	_, err := client.TasksByArns(taskArns)
+	if !errors.Is(err, ecsclient.ErrNoContainerInstances) {
+		t.Errorf("Expected ErrNoContainerInstances, got %v", err)
+	}
+}
+
+func TestTaskDescribeError(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Failures: []*ecs.Failure{{Arn: strptr("task1"), Reason: strptr("MISSING")}},
+	})
+
+	_, err := client.TasksByArns([]*string{strptr("task1")})
+	var describeErr *ecsclient.TaskDescribeError
+	if !errors.As(err, &describeErr) {
+		t.Fatalf("Expected a TaskDescribeError, got %v", err)
+	}
+	if describeErr.Arn != "task1" || describeErr.Reason != "MISSING" {
+		t.Errorf("Wrong failure: %v", describeErr)
+	}
+}
+
+func TestFamilyRevisionFiltersTasks(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("task41"), strptr("task42")}
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster, Family: strptr("web")}, taskArns)
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: []*ecs.Task{
+		{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), TaskDefinitionArn: strptr("arn:aws:ecs:us-east-1:123456789012:task-definition/web:41")},
+		{TaskArn: taskArns[1], LastStatus: strptr("RUNNING"), TaskDefinitionArn: strptr("arn:aws:ecs:us-east-1:123456789012:task-definition/web:42")},
+	}})
+
+	tasks, err := client.Tasks(strptr("web:42"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || *tasks[0].ECSTask().TaskArn != "task42" {
+		t.Errorf("Expected only the revision 42 task, got %v", tasks)
+	}
+}
+
+func TestAllContainerInstanceChunksFailing(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	taskArns := []*string{strptr("task1")}
+	mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+	})
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(errors.New("throttled")), nil)
+
+	if _, err := client.TasksByArns(taskArns); err == nil {
+		t.Error("Expected an error when no container instances could be described")
+	}
+}
+
+func TestTransientDescribeErrorsAreRetried(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).RetryBaseDelay = time.Millisecond
+
+	taskArns := []*string{strptr("task1")}
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: pcluster}, taskArns)
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	gomock.InOrder(
+		mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(throttled), nil),
+		mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(awserr.NewRequestFailure(awserr.New("ServerException", "", nil), 500, "")), nil),
+		mockecs.EXPECT().DescribeTasksRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeTasksOutput{
+			Tasks: []*ecs.Task{{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr("ci1")}},
+		}),
+	)
+	mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci1"), Ec2InstanceId: strptr("i-1")}},
+	})
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1")}}}},
+	})
+
+	tasks, err := client.Tasks(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].EC2Instance() == nil {
+		t.Errorf("Expected the task once describing it succeeded, got %v", tasks)
+	}
+}
+
+func TestPartialServiceNameIsResolved(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	notFound := awserr.New("ServiceNotFoundException", "Service not found.", nil)
+	services := &ecs.ListServicesOutput{ServiceArns: []*string{
+		strptr("arn:aws:ecs:us-east-1:123456789012:service/api-prod"),
+		strptr("arn:aws:ecs:us-east-1:123456789012:service/testCluster/web-prod-123"),
+	}}
+	resolved := &ecs.ListTasksInput{Cluster: pcluster, ServiceName: strptr("web-prod-123")}
+	gomock.InOrder(
+		mockecs.EXPECT().ListTasksRequest(&ecs.ListTasksInput{Cluster: pcluster, ServiceName: strptr("web")}).Return(sent(notFound), nil),
+		mockecs.EXPECT().ListServicesRequest(&ecs.ListServicesInput{Cluster: pcluster}).Return(sent(nil), services),
+		expectTaskPages(mockecs, resolved)[0],
+		// the resolved name is remembered for later polls
+		expectTaskPages(mockecs, resolved)[0],
+	)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Tasks(nil, strptr("web")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolvedServiceIsForgottenOnceNotFound(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	notFound := awserr.New("ServiceNotFoundException", "Service not found.", nil)
+	list := func(names ...string) *ecs.ListServicesOutput {
+		output := &ecs.ListServicesOutput{}
+		for _, name := range names {
+			output.ServiceArns = append(output.ServiceArns, strptr("arn:aws:ecs:us-east-1:123456789012:service/"+name))
+		}
+		return output
+	}
+	byName := func(name string) *ecs.ListTasksInput {
+		return &ecs.ListTasksInput{Cluster: pcluster, ServiceName: strptr(name)}
+	}
+	gomock.InOrder(
+		mockecs.EXPECT().ListTasksRequest(byName("web")).Return(sent(notFound), nil),
+		mockecs.EXPECT().ListServicesRequest(gomock.Any()).Return(sent(nil), list("web-1")),
+		expectTaskPages(mockecs, byName("web-1"))[0],
+		// web-1 is replaced by web-2, so the name is resolved again
+		mockecs.EXPECT().ListTasksRequest(byName("web-1")).Return(sent(notFound), nil),
+		mockecs.EXPECT().ListServicesRequest(gomock.Any()).Return(sent(nil), list("web-2")),
+		expectTaskPages(mockecs, byName("web-2"))[0],
+		expectTaskPages(mockecs, byName("web-2"))[0],
+	)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Tasks(nil, strptr("web")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAmbiguousServiceName(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockecs.EXPECT().ListTasksRequest(&ecs.ListTasksInput{Cluster: pcluster, ServiceName: strptr("web")}).Return(sent(awserr.New("ServiceNotFoundException", "Service not found.", nil)), nil)
+	mockecs.EXPECT().ListServicesRequest(&ecs.ListServicesInput{Cluster: pcluster}).Return(sent(nil), &ecs.ListServicesOutput{ServiceArns: []*string{
+		strptr("arn:aws:ecs:us-east-1:123456789012:service/web-staging"),
+		strptr("arn:aws:ecs:us-east-1:123456789012:service/web-prod"),
+	}})
+
+	_, err := client.Tasks(nil, strptr("web"))
+	var ambiguous *ecsclient.AmbiguousServiceError
+	if !errors.As(err, &ambiguous) || !reflect.DeepEqual(ambiguous.Matches, []string{"web-prod", "web-staging"}) {
+		t.Errorf("Expected an ambiguous service error listing both services, got %v", err)
+	}
+}
+
+func TestUnknownServiceName(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+
+	mockecs.EXPECT().ListTasksRequest(&ecs.ListTasksInput{Cluster: pcluster, ServiceName: strptr("web")}).Return(sent(awserr.New("ServiceNotFoundException", "Service not found.", nil)), nil)
+	mockecs.EXPECT().ListServicesRequest(&ecs.ListServicesInput{Cluster: pcluster}).Return(sent(nil), &ecs.ListServicesOutput{})
+
+	_, err := client.Tasks(nil, strptr("web"))
+	var notFound *ecsclient.ServiceNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("Expected a service not found error, got %v", err)
+	}
+}
+
+func TestContainerInstanceChunksAreDescribedConcurrently(t *testing.T) {
+	ctrl, client, mockecs, mockec2 := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).DescribeConcurrency = 3
+
+	// enough container instances for five describe calls
+	var taskArns []*string
+	var tasks []*ecs.Task
+	for i := 0; i < 500; i++ {
+		taskArn := strptr(fmt.Sprintf("task%d", i))
+		taskArns = append(taskArns, taskArn)
+		tasks = append(tasks, &ecs.Task{TaskArn: taskArn, LastStatus: strptr("RUNNING"), ContainerInstanceArn: strptr(fmt.Sprintf("ci%d", i))})
+	}
+	for i := 0; i < 500; i += 100 {
+		mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns[i : i+100]}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks[i : i+100]})
+	}
+
+	var inFlight, maxInFlight int32
+	describe := func(input interface{}) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}
+	// a request each, since they are sent at once
+	for i := 0; i < 5; i++ {
+		mockecs.EXPECT().DescribeContainerInstancesRequest(gomock.Any()).Do(describe).Return(sent(nil), &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []*ecs.ContainerInstance{{ContainerInstanceArn: strptr("ci0"), Ec2InstanceId: strptr("i-1")}},
+		})
+	}
+	mockec2.EXPECT().DescribeInstancesRequest(gomock.Any()).Return(sent(nil), &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: strptr("i-1")}}}},
+	})
+
+	if _, err := client.TasksByArns(taskArns); err != nil {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max != 3 {
+		t.Errorf("Expected 3 describe calls in flight at once, got at most %v", max)
+	}
+}
+
+func TestTaskDefinitionsAreDescribedOnce(t *testing.T) {
+	ctrl, client, mockecs, _ := setup(t)
+	defer ctrl.Finish()
+	client.(*ecsclient.ECSClient).DescribeTaskDefinitions = true
+
+	taskArns := []*string{strptr("task1"), strptr("task2")}
+	definitionArn := strptr("arn:aws:ecs:us-east-1:123456789012:task-definition/web:1")
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: pcluster, Tasks: taskArns}).Return(sent(nil), &ecs.DescribeTasksOutput{
+		Tasks: []*ecs.Task{
+			{TaskArn: taskArns[0], LastStatus: strptr("RUNNING"), TaskDefinitionArn: definitionArn, Containers: []*ecs.Container{{Name: strptr("web")}}},
+			{TaskArn: taskArns[1], LastStatus: strptr("RUNNING"), TaskDefinitionArn: definitionArn, Containers: []*ecs.Container{{Name: strptr("web")}}},
+		},
+	}).Times(2)
+	mockecs.EXPECT().DescribeTaskDefinitionRequest(&ecs.DescribeTaskDefinitionInput{TaskDefinition: definitionArn}).Return(sent(nil), &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{ContainerDefinitions: []*ecs.ContainerDefinition{{
+			Name:        strptr("web"),
+			Environment: []*ecs.KeyValuePair{{Name: strptr("ROLE"), Value: strptr("frontend")}},
+		}}},
+	}).Times(1)
+
+	for i := 0; i < 2; i++ {
+		tasks, err := client.TasksByArns(taskArns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, task := range tasks {
+			if env := task.Container(ecsclient.ExactName("web")).Environment(); env["ROLE"] != "frontend" {
+				t.Errorf("Expected the task definition's environment, got %v", env)
+			}
+		}
+	}
+}
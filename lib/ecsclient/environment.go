@@ -0,0 +1,112 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Environment returns the container's environment variables: those its task
+// definition gives it, if the task definition was described, overridden by
+// those of the task's overrides. If there are none, it returns an empty map.
+func (c *container) Environment() map[string]string {
+	env := make(map[string]string)
+	if c == nil || c.Container == nil || c.Name == nil || c.task == nil || c.task.Task == nil {
+		return env
+	}
+	if definition := c.definition(); definition != nil {
+		addEnvironment(env, definition.Environment)
+	}
+	if c.task.Overrides != nil {
+		for _, override := range c.task.Overrides.ContainerOverrides {
+			if override != nil && aws.StringValue(override.Name) == *c.Name {
+				addEnvironment(env, override.Environment)
+			}
+		}
+	}
+	return env
+}
+
+// Reservation returns the cpu units and MiB of memory the container's task
+// definition reserves for it, or 0 for either if it does not, or if the task
+// definition was not described
+func (c *container) Reservation() (cpu, memory int64) {
+	definition := c.definition()
+	if definition == nil {
+		return 0, 0
+	}
+	return aws.Int64Value(definition.Cpu), aws.Int64Value(definition.Memory)
+}
+
+// definition returns the container's definition in its task's definition, or
+// nil if the task definition was not described
+func (c *container) definition() *ecs.ContainerDefinition {
+	if c == nil || c.Container == nil || c.Name == nil || c.task == nil || c.task.definition == nil {
+		return nil
+	}
+	for _, definition := range c.task.definition.ContainerDefinitions {
+		if definition != nil && aws.StringValue(definition.Name) == *c.Name {
+			return definition
+		}
+	}
+	return nil
+}
+
+func addEnvironment(env map[string]string, pairs []*ecs.KeyValuePair) {
+	for _, pair := range pairs {
+		if pair != nil && pair.Name != nil {
+			env[*pair.Name] = aws.StringValue(pair.Value)
+		}
+	}
+}
+
+// taskDefinitions returns the task definitions of the given tasks by ARN.
+// Task definitions never change once registered, so each is only described
+// once per client.
+func (c *ECSClient) taskDefinitions(ctx context.Context, tasks []*ecs.Task) (map[string]*ecs.TaskDefinition, error) {
+	definitions := make(map[string]*ecs.TaskDefinition)
+	for _, task := range tasks {
+		arn := aws.StringValue(task.TaskDefinitionArn)
+		if arn == "" || definitions[arn] != nil {
+			continue
+		}
+		c.definitionLock.Lock()
+		definition, ok := c.definitions[arn]
+		c.definitionLock.Unlock()
+		if !ok {
+			var output *ecs.DescribeTaskDefinitionOutput
+			err := c.retryable(ctx, func() error {
+				var req *request.Request
+				req, output = c.ecs.DescribeTaskDefinitionRequest(&ecs.DescribeTaskDefinitionInput{TaskDefinition: &arn})
+				return send(ctx, req)
+			})
+			if err != nil {
+				return nil, err
+			}
+			definition = output.TaskDefinition
+			c.definitionLock.Lock()
+			if c.definitions == nil {
+				c.definitions = make(map[string]*ecs.TaskDefinition)
+			}
+			c.definitions[arn] = definition
+			c.definitionLock.Unlock()
+		}
+		definitions[arn] = definition
+	}
+	return definitions, nil
+}
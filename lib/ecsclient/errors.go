@@ -0,0 +1,64 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNoContainerInstances is returned when tasks were placed on
+	// container instances but describing them found none, e.g. because they
+	// have all been deregistered since
+	ErrNoContainerInstances = errors.New("No container instances for found tasks")
+	// ErrNoReservations is returned when describing the EC2 instances of the
+	// found container instances returns none, e.g. because they have all been
+	// terminated since
+	ErrNoReservations = errors.New("No ec2 reservations")
+)
+
+// TaskDescribeError is returned when ECS reports a failure describing a task,
+// most often because it stopped between being listed and described
+type TaskDescribeError struct {
+	Arn    string
+	Reason string
+}
+
+func (e *TaskDescribeError) Error() string {
+	return fmt.Sprintf("Failure describing task: %v - %v", e.Arn, e.Reason)
+}
+
+// ServiceNotFoundError is returned when there is no service with a name, or
+// whose name starts with it
+type ServiceNotFoundError struct {
+	Name    string
+	Cluster string
+}
+
+func (e *ServiceNotFoundError) Error() string {
+	return fmt.Sprintf("No service named %v, or whose name starts with it, in cluster %v", e.Name, e.Cluster)
+}
+
+// AmbiguousServiceError is returned when a service name which is not the
+// name of a service is the start of the names of several
+type AmbiguousServiceError struct {
+	Name    string
+	Matches []string
+}
+
+func (e *AmbiguousServiceError) Error() string {
+	return fmt.Sprintf("Service %v is ambiguous; it could be any of %v", e.Name, strings.Join(e.Matches, ", "))
+}
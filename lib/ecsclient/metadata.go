@@ -0,0 +1,129 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// metadataEndpoint is the EC2 instance metadata service; it is a variable so
+// that it may be replaced in tests
+var metadataEndpoint = "http://169.254.169.254"
+
+const (
+	// metadataTokenResource and identityDocumentResource are relative to the
+	// metadata client's endpoint, as is availabilityZoneResource to its
+	// meta-data path
+	metadataTokenResource    = "/api/token"
+	identityDocumentResource = "/dynamic/instance-identity/document"
+	availabilityZoneResource = "placement/availability-zone"
+
+	// metadataTokenTTL is how long an IMDSv2 token is requested for; it is
+	// only used for the requests of a single lookup
+	metadataTokenTTL = "60"
+)
+
+var metadataHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+// metadataRegion reads the current region from the instance identity document.
+// Unlike trimming the availability zone, as ec2metadata's Region does, this is
+// also right in Local Zones and Wavelength Zones, e.g. us-west-2-lax-1a.
+func metadataRegion() (string, error) {
+	var document struct {
+		Region string `json:"region"`
+	}
+	req := metadataClient().NewRequest(&request.Operation{
+		Name:       "GetInstanceIdentityDocument",
+		HTTPMethod: "GET",
+		HTTPPath:   identityDocumentResource,
+	}, nil, nil)
+	req.Handlers.Unmarshal.Clear()
+	req.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		defer r.HTTPResponse.Body.Close()
+		r.Error = json.NewDecoder(r.HTTPResponse.Body).Decode(&document)
+	})
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	if document.Region == "" {
+		return "", errors.New("No region in the instance identity document")
+	}
+	return document.Region, nil
+}
+
+// LocalAvailabilityZone returns the availability zone of the EC2 instance the
+// Task Kite is running on, as read from the instance metadata service
+func LocalAvailabilityZone() (string, error) {
+	zone, err := metadataClient().GetMetadata(availabilityZoneResource)
+	if err != nil {
+		return "", err
+	}
+	if len(zone) < 2 {
+		return "", fmt.Errorf("Invalid availability zone %q in instance metadata", zone)
+	}
+	return zone, nil
+}
+
+// metadataClient returns an SDK client for the instance metadata service. Its
+// requests are not retried, so that running outside of EC2 fails fast. It
+// first asks for an IMDSv2 session token, which instances may require, to
+// send with each request, and falls back to IMDSv1 requests without one if
+// that fails.
+func metadataClient() *ec2metadata.Client {
+	client := ec2metadata.New(&ec2metadata.Config{
+		Endpoint:   aws.String(metadataEndpoint + "/latest"),
+		HTTPClient: metadataHTTPClient,
+		MaxRetries: aws.Int(0),
+	})
+	token, err := metadataToken(client)
+	if err != nil {
+		log.Debug("Could not get an IMDSv2 token; trying IMDSv1: ", err)
+		return client
+	}
+	client.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-aws-ec2-metadata-token", token)
+	})
+	return client
+}
+
+// metadataToken requests an IMDSv2 session token. The SDK's client predates
+// IMDSv2, so the request reads the token with a handler of its own.
+func metadataToken(client *ec2metadata.Client) (string, error) {
+	var token []byte
+	req := client.NewRequest(&request.Operation{
+		Name:       "GetToken",
+		HTTPMethod: "PUT",
+		HTTPPath:   metadataTokenResource,
+	}, nil, nil)
+	req.HTTPRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+	req.Handlers.Unmarshal.Clear()
+	req.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		defer r.HTTPResponse.Body.Close()
+		token, r.Error = ioutil.ReadAll(r.HTTPResponse.Body)
+	})
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// fakeMetadata serves the availability zone and identity document of an
+// instance in a Local Zone, whose region is not simply its zone trimmed. It
+// requires an IMDSv2 token if 'requireToken' is set, and refuses to hand them
+// out otherwise. It fails the test if a request is not made by the SDK's
+// client.
+func fakeMetadata(t *testing.T, requireToken bool) func() {
+	mux := http.NewServeMux()
+	sdkRequest := func(r *http.Request) {
+		if agent := r.Header.Get("User-Agent"); !strings.HasPrefix(agent, aws.SDKName+"/") {
+			t.Errorf("Expected metadata requests to be made by the SDK, got User-Agent %q", agent)
+		}
+	}
+	mux.HandleFunc("/latest"+metadataTokenResource, func(w http.ResponseWriter, r *http.Request) {
+		sdkRequest(r)
+		if !requireToken {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/meta-data/"+availabilityZoneResource, func(w http.ResponseWriter, r *http.Request) {
+		sdkRequest(r)
+		if requireToken && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("us-west-2-lax-1a"))
+	})
+	mux.HandleFunc("/latest"+identityDocumentResource, func(w http.ResponseWriter, r *http.Request) {
+		sdkRequest(r)
+		if requireToken && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"availabilityZone": "us-west-2-lax-1a", "region": "us-west-2"}`))
+	})
+	server := httptest.NewServer(mux)
+	oldEndpoint := metadataEndpoint
+	metadataEndpoint = server.URL
+	return func() {
+		metadataEndpoint = oldEndpoint
+		server.Close()
+	}
+}
+
+func TestMetadataRegionWithIMDSv2(t *testing.T) {
+	defer fakeMetadata(t, true)()
+	os.Clearenv()
+	client := New("", "", nil, nil)
+	if *client.(*ECSClient).ecs.(*ecs.ECS).Config.Region != "us-west-2" {
+		t.Error("Expected the region from the instance metadata")
+	}
+}
+
+func TestMetadataRegionFallsBackToIMDSv1(t *testing.T) {
+	defer fakeMetadata(t, false)()
+	region, err := metadataRegion()
+	if err != nil || region != "us-west-2" {
+		t.Errorf("Expected the region without a token, got %q, %v", region, err)
+	}
+}
+
+func TestLocalAvailabilityZone(t *testing.T) {
+	defer fakeMetadata(t, true)()
+	zone, err := LocalAvailabilityZone()
+	if err != nil || zone != "us-west-2-lax-1a" {
+		t.Errorf("Expected the availability zone from the instance metadata, got %q, %v", zone, err)
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	oldEndpoint := metadataEndpoint
+	metadataEndpoint = server.URL
+	defer func() { metadataEndpoint = oldEndpoint }()
+	if region, err := metadataRegion(); err == nil {
+		t.Errorf("Expected an error without instance metadata, got region %q", region)
+	}
+}
@@ -31,7 +31,7 @@ func (_m *MockAugmentedTask) EXPECT() *_MockAugmentedTaskRecorder {
 	return _m.recorder
 }
 
-func (_m *MockAugmentedTask) Container(_param0 string) ecsclient.AugmentedContainer {
+func (_m *MockAugmentedTask) Container(_param0 ecsclient.NameMatcher) ecsclient.AugmentedContainer {
 	ret := _m.ctrl.Call(_m, "Container", _param0)
 	ret0, _ := ret[0].(ecsclient.AugmentedContainer)
 	return ret0
@@ -41,6 +41,16 @@ func (_mr *_MockAugmentedTaskRecorder) Container(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Container", arg0)
 }
 
+func (_m *MockAugmentedTask) ContainerAt(_param0 int) ecsclient.AugmentedContainer {
+	ret := _m.ctrl.Call(_m, "ContainerAt", _param0)
+	ret0, _ := ret[0].(ecsclient.AugmentedContainer)
+	return ret0
+}
+
+func (_mr *_MockAugmentedTaskRecorder) ContainerAt(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ContainerAt", arg0)
+}
+
 func (_m *MockAugmentedTask) EC2Instance() *ec2.Instance {
 	ret := _m.ctrl.Call(_m, "EC2Instance")
 	ret0, _ := ret[0].(*ec2.Instance)
@@ -81,6 +91,26 @@ func (_mr *_MockAugmentedTaskRecorder) PublicIP() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PublicIP")
 }
 
+func (_m *MockAugmentedTask) TaskDefinitionARN() string {
+	ret := _m.ctrl.Call(_m, "TaskDefinitionARN")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockAugmentedTaskRecorder) TaskDefinitionARN() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TaskDefinitionARN")
+}
+
+func (_m *MockAugmentedTask) AvailabilityZone() string {
+	ret := _m.ctrl.Call(_m, "AvailabilityZone")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockAugmentedTaskRecorder) AvailabilityZone() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AvailabilityZone")
+}
+
 // Mock of AugmentedContainer interface
 type MockAugmentedContainer struct {
 	ctrl     *gomock.Controller
@@ -122,6 +152,27 @@ func (_mr *_MockAugmentedContainerRecorder) ECSContainer() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ECSContainer")
 }
 
+func (_m *MockAugmentedContainer) Environment() map[string]string {
+	ret := _m.ctrl.Call(_m, "Environment")
+	ret0, _ := ret[0].(map[string]string)
+	return ret0
+}
+
+func (_mr *_MockAugmentedContainerRecorder) Environment() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Environment")
+}
+
+func (_m *MockAugmentedContainer) Reservation() (int64, int64) {
+	ret := _m.ctrl.Call(_m, "Reservation")
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(int64)
+	return ret0, ret1
+}
+
+func (_mr *_MockAugmentedContainerRecorder) Reservation() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Reservation")
+}
+
 func (_m *MockAugmentedContainer) ResolvePort(_param0 uint16) uint16 {
 	ret := _m.ctrl.Call(_m, "ResolvePort", _param0)
 	ret0, _ := ret[0].(uint16)
@@ -0,0 +1,174 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// MultiClient lists tasks through several clients, typically one per cluster
+// running the same service, and merges them
+type MultiClient struct {
+	clients []ECSSimpleClient
+
+	// PartialResults, if set, returns the tasks of the clients which
+	// succeeded, logging the errors of the others, as long as at least one
+	// succeeded. Otherwise any client's error fails the whole call.
+	PartialResults bool
+}
+
+// NewMulti returns a client which lists the tasks of every one of the given
+// clients, deduplicated by task ARN, e.g. from ECSClients for several
+// clusters. It is safe for concurrent use if they are.
+func NewMulti(clients ...ECSSimpleClient) *MultiClient {
+	return &MultiClient{clients: clients}
+}
+
+// Tasks implements ECSSimpleClient
+func (c *MultiClient) Tasks(family, service *string) ([]AugmentedTask, error) {
+	return c.TasksWithContext(context.Background(), family, service)
+}
+
+// TasksWithContext implements ECSSimpleClient. The clients are listed from
+// concurrently.
+func (c *MultiClient) TasksWithContext(ctx context.Context, family, service *string) ([]AugmentedTask, error) {
+	results := make([][]AugmentedTask, len(c.clients))
+	errs := make([]error, len(c.clients))
+	done := make(chan struct{})
+	for i, client := range c.clients {
+		go func(i int, client ECSSimpleClient) {
+			results[i], errs[i] = client.TasksWithContext(ctx, family, service)
+			done <- struct{}{}
+		}(i, client)
+	}
+	for range c.clients {
+		<-done
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.merge(results, errs)
+}
+
+// StreamTasks implements ECSSimpleClient. Each client's tasks are streamed in
+// turn.
+func (c *MultiClient) StreamTasks(ctx context.Context, family, service *string, fn func([]AugmentedTask) bool) error {
+	seen := make(map[string]bool)
+	var firstErr error
+	succeeded := 0
+	for _, client := range c.clients {
+		stopped := false
+		err := client.StreamTasks(ctx, family, service, func(tasks []AugmentedTask) bool {
+			tasks = dedupeTasks(tasks, seen)
+			if len(tasks) == 0 {
+				return true
+			}
+			stopped = !fn(tasks)
+			return !stopped
+		})
+		if err != nil {
+			if !c.PartialResults {
+				return err
+			}
+			log.Warn("Error listing tasks of one cluster; using the others: ", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		succeeded++
+		if stopped {
+			return nil
+		}
+	}
+	if succeeded == 0 {
+		return firstErr
+	}
+	return nil
+}
+
+// Close implements ECSSimpleClient by closing every client
+func (c *MultiClient) Close() {
+	for _, client := range c.clients {
+		client.Close()
+	}
+}
+
+// TasksByArns implements ECSSimpleClient. Since task ARNs need not name their
+// cluster, every client is asked for every ARN, and a client failing to
+// describe them is only an error if none succeed.
+func (c *MultiClient) TasksByArns(taskArns []*string) ([]AugmentedTask, error) {
+	results := make([][]AugmentedTask, len(c.clients))
+	errs := make([]error, len(c.clients))
+	for i, client := range c.clients {
+		results[i], errs[i] = client.TasksByArns(taskArns)
+	}
+	for _, err := range errs {
+		if err == nil {
+			return c.mergeSucceeded(results, errs), nil
+		}
+	}
+	return nil, errs[0]
+}
+
+// merge returns the deduplicated tasks of the clients, or the first error if
+// any failed and partial results are not allowed or none succeeded
+func (c *MultiClient) merge(results [][]AugmentedTask, errs []error) ([]AugmentedTask, error) {
+	var firstErr error
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if c.PartialResults {
+			log.Warn("Error listing tasks of one cluster; using the others: ", err)
+		}
+	}
+	if firstErr != nil && (!c.PartialResults || succeeded == 0) {
+		return nil, firstErr
+	}
+	return c.mergeSucceeded(results, errs), nil
+}
+
+func (c *MultiClient) mergeSucceeded(results [][]AugmentedTask, errs []error) []AugmentedTask {
+	seen := make(map[string]bool)
+	merged := []AugmentedTask{}
+	for i, tasks := range results {
+		if errs[i] == nil {
+			merged = append(merged, dedupeTasks(tasks, seen)...)
+		}
+	}
+	return merged
+}
+
+// dedupeTasks returns the tasks whose ARNs are not yet in 'seen', adding them
+func dedupeTasks(tasks []AugmentedTask, seen map[string]bool) []AugmentedTask {
+	var out []AugmentedTask
+	for _, task := range tasks {
+		arn := aws.StringValue(task.ECSTask().TaskArn)
+		if arn != "" && seen[arn] {
+			continue
+		}
+		seen[arn] = true
+		out = append(out, task)
+	}
+	return out
+}
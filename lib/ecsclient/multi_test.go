@@ -0,0 +1,125 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient/mocks/ec2"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient/mocks/ecs"
+	"github.com/golang/mock/gomock"
+)
+
+// clusterClient returns a client for a cluster whose only tasks, which have
+// no container instances, have the given ARNs, or whose listing fails with
+// the given error
+func clusterClient(ctrl *gomock.Controller, cluster string, listErr error, taskArns ...string) ecsclient.ECSSimpleClient {
+	mockecs := mock_ecsiface.NewMockECSAPI(ctrl)
+	arns := aws.StringSlice(taskArns)
+	if listErr != nil {
+		mockecs.EXPECT().ListTasksRequest(&ecs.ListTasksInput{Cluster: &cluster}).Return(sent(listErr), nil)
+		return ecsclient.New(cluster, "us-east-1", mockecs, mock_ec2iface.NewMockEC2API(ctrl))
+	}
+	expectTaskPages(mockecs, &ecs.ListTasksInput{Cluster: &cluster}, arns)
+	var tasks []*ecs.Task
+	for _, arn := range arns {
+		tasks = append(tasks, &ecs.Task{TaskArn: arn, LastStatus: strptr("RUNNING")})
+	}
+	mockecs.EXPECT().DescribeTasksRequest(&ecs.DescribeTasksInput{Cluster: &cluster, Tasks: arns}).Return(sent(nil), &ecs.DescribeTasksOutput{Tasks: tasks})
+	return ecsclient.New(cluster, "us-east-1", mockecs, mock_ec2iface.NewMockEC2API(ctrl))
+}
+
+func taskArnsOf(tasks []ecsclient.AugmentedTask) []string {
+	var arns []string
+	for _, task := range tasks {
+		arns = append(arns, aws.StringValue(task.ECSTask().TaskArn))
+	}
+	sort.Strings(arns)
+	return arns
+}
+
+func TestMultiClientMergesClusters(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	multi := ecsclient.NewMulti(
+		clusterClient(ctrl, "us-east-1a", nil, "task1", "task2"),
+		clusterClient(ctrl, "us-east-1b", nil, "task2", "task3"),
+	)
+
+	tasks, err := multi.Tasks(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arns, expected := taskArnsOf(tasks), []string{"task1", "task2", "task3"}; !reflect.DeepEqual(arns, expected) {
+		t.Errorf("Expected the deduplicated tasks of both clusters %v, got %v", expected, arns)
+	}
+}
+
+func TestMultiClientClusterErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	listErr := errors.New("AccessDenied")
+
+	multi := ecsclient.NewMulti(
+		clusterClient(ctrl, "a", nil, "task1"),
+		clusterClient(ctrl, "b", listErr),
+	)
+	if _, err := multi.Tasks(nil, nil); err != listErr {
+		t.Errorf("Expected one cluster's error to fail the call, got %v", err)
+	}
+
+	partial := ecsclient.NewMulti(
+		clusterClient(ctrl, "a", nil, "task1"),
+		clusterClient(ctrl, "b", listErr),
+	)
+	partial.PartialResults = true
+	tasks, err := partial.Tasks(nil, nil)
+	if err != nil || !reflect.DeepEqual(taskArnsOf(tasks), []string{"task1"}) {
+		t.Errorf("Expected the other cluster's tasks, got %v, %v", tasks, err)
+	}
+
+	failing := ecsclient.NewMulti(clusterClient(ctrl, "a", listErr), clusterClient(ctrl, "b", listErr))
+	failing.PartialResults = true
+	if _, err := failing.Tasks(nil, nil); err != listErr {
+		t.Errorf("Expected an error when every cluster fails, got %v", err)
+	}
+}
+
+func TestMultiClientStreamsEachCluster(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	multi := ecsclient.NewMulti(
+		clusterClient(ctrl, "a", nil, "task1"),
+		clusterClient(ctrl, "b", nil, "task1", "task2"),
+	)
+
+	var streamed [][]string
+	err := multi.StreamTasks(context.Background(), nil, nil, func(tasks []ecsclient.AugmentedTask) bool {
+		streamed = append(streamed, taskArnsOf(tasks))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]string{{"task1"}, {"task2"}}; !reflect.DeepEqual(streamed, expected) {
+		t.Errorf("Expected %v, got %v", expected, streamed)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// NameMatcher decides which container names within a task are the container
+// being looked for
+type NameMatcher interface {
+	MatchName(name string) bool
+	String() string
+}
+
+// ExactName matches only the container with exactly this name
+type ExactName string
+
+// MatchName implements NameMatcher
+func (n ExactName) MatchName(name string) bool {
+	return string(n) == name
+}
+
+func (n ExactName) String() string {
+	return string(n)
+}
+
+// PrefixName matches containers whose names begin with this prefix
+type PrefixName string
+
+// MatchName implements NameMatcher
+func (n PrefixName) MatchName(name string) bool {
+	return strings.HasPrefix(name, string(n))
+}
+
+func (n PrefixName) String() string {
+	return string(n) + "*"
+}
+
+// RegexpName matches containers whose names match a regular expression. The
+// expression is not anchored; use ^ and $ to match whole names.
+type RegexpName struct {
+	*regexp.Regexp
+}
+
+// MatchName implements NameMatcher
+func (n RegexpName) MatchName(name string) bool {
+	return n.MatchString(name)
+}
+
+// ParseNameMatcher returns a NameMatcher for the given name, interpreted
+// according to mode, which is one of "exact", "prefix", or "regex"
+func ParseNameMatcher(mode, name string) (NameMatcher, error) {
+	switch mode {
+	case "exact":
+		return ExactName(name), nil
+	case "prefix":
+		return PrefixName(name), nil
+	case "regex":
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid container name pattern %q: %v", name, err)
+		}
+		return RegexpName{re}, nil
+	}
+	return nil, fmt.Errorf("Unknown name matching mode %q; must be exact, prefix, or regex", mode)
+}
@@ -0,0 +1,81 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ecsclient
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// send sends an SDK request, cancelling it, even while in flight, once the
+// context is done, in which case the context's error is returned
+func send(ctx context.Context, req *request.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	err := req.Send()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// eachTasksPage lists tasks with the given input, calling fn with each page
+// and whether it is the last, until fn returns false
+func (c *ECSClient) eachTasksPage(ctx context.Context, input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	for {
+		var page *ecs.ListTasksOutput
+		err := c.retryable(ctx, func() error {
+			var req *request.Request
+			req, page = c.ecs.ListTasksRequest(input)
+			return send(ctx, req)
+		})
+		if err != nil {
+			return err
+		}
+		last := aws.StringValue(page.NextToken) == ""
+		if !fn(page, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = page.NextToken
+		input = &next
+	}
+}
+
+// eachServicesPage is like eachTasksPage, for services
+func (c *ECSClient) eachServicesPage(ctx context.Context, input *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool) error {
+	for {
+		var page *ecs.ListServicesOutput
+		err := c.retryable(ctx, func() error {
+			var req *request.Request
+			req, page = c.ecs.ListServicesRequest(input)
+			return send(ctx, req)
+		})
+		if err != nil {
+			return err
+		}
+		last := aws.StringValue(page.NextToken) == ""
+		if !fn(page, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = page.NextToken
+		input = &next
+	}
+}
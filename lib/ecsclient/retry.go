@@ -0,0 +1,78 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// defaultRetryAttempts is how many times an API call is made before
+	// giving up on a transient error
+	defaultRetryAttempts = 3
+	// defaultRetryBaseDelay is the delay before the first retry, which doubles
+	// for each retry after it
+	defaultRetryBaseDelay = 200 * time.Millisecond
+)
+
+// retryable calls fn up to 'attempts' times for as long as it fails with a
+// transient error, backing off exponentially from baseDelay with jitter
+// between attempts. It returns the last error, or the context's error if it
+// is done while waiting to retry.
+func retryable(ctx context.Context, fn func() error, attempts int, baseDelay time.Duration) error {
+	delay := baseDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= attempts || !transient(err) {
+			return err
+		}
+		// sleep for between half and all of the delay, so that many
+		// Task Kites throttled at once don't all retry together
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Debugf("Retrying in %v after transient error: %v", sleep, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryable retries fn as configured on the client
+func (c *ECSClient) retryable(ctx context.Context, fn func() error) error {
+	return retryable(ctx, fn, c.RetryAttempts, c.RetryBaseDelay)
+}
+
+// transient returns whether an AWS error is worth retrying: throttling, a
+// server side failure, or a failure to send the request at all. Other errors,
+// such as validation errors, would only fail again.
+func transient(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestLimitExceeded", "ThrottlingException", "Throttling", "RequestError":
+			return true
+		}
+	}
+	return false
+}
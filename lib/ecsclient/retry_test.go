@@ -0,0 +1,63 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryableOnlyRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		err   error
+		calls int
+	}{
+		{awserr.New("RequestLimitExceeded", "", nil), 3},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 503, ""), 3},
+		{awserr.New("ValidationException", "", nil), 1},
+		{awserr.NewRequestFailure(awserr.New("InvalidParameterException", "", nil), 400, ""), 1},
+		{errors.New("not an aws error"), 1},
+	}
+	for _, test := range tests {
+		calls := 0
+		err := retryable(context.Background(), func() error {
+			calls++
+			return test.err
+		}, 3, time.Millisecond)
+		if err != test.err || calls != test.calls {
+			t.Errorf("Expected %v to be tried %v times, was tried %v times and returned %v", test.err, test.calls, calls, err)
+		}
+	}
+}
+
+func TestRetryableStopsWaitingOnceContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := retryable(ctx, func() error {
+		calls++
+		cancel()
+		return awserr.New("Throttling", "", nil)
+	}, 3, time.Hour)
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("Expected the context's error after 1 call, got %v after %v calls", err, calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected not to wait out the retry delay")
+	}
+}
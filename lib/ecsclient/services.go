@@ -0,0 +1,96 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// listTasksPages lists the tasks of a family or service. If the service is
+// not found by its name, it is taken to be the start of the name of a single
+// service, which is listed instead. That service is remembered until it is
+// not found either, e.g. once it has been replaced, when the name is resolved
+// again.
+func (c *ECSClient) listTasksPages(ctx context.Context, family, service *string, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	name := aws.StringValue(service)
+	if name != "" {
+		c.serviceLock.Lock()
+		if resolved, ok := c.services[name]; ok {
+			service = &resolved
+		}
+		c.serviceLock.Unlock()
+	}
+	err := c.eachTasksPage(ctx, c.listTasksInput(family, service), fn)
+	if !isServiceNotFound(err) || name == "" {
+		return err
+	}
+
+	c.serviceLock.Lock()
+	delete(c.services, name)
+	c.serviceLock.Unlock()
+	resolved, resolveErr := c.resolveService(ctx, name)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	log.Infof("No service named %v; using %v, the only service whose name starts with it", name, resolved)
+	c.serviceLock.Lock()
+	if c.services == nil {
+		c.services = make(map[string]string)
+	}
+	c.services[name] = resolved
+	c.serviceLock.Unlock()
+	return c.eachTasksPage(ctx, c.listTasksInput(family, &resolved), fn)
+}
+
+func isServiceNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "ServiceNotFoundException"
+}
+
+// resolveService returns the name of the only service in the cluster whose
+// name starts with the given one. It returns an AmbiguousServiceError if there
+// are several.
+func (c *ECSClient) resolveService(ctx context.Context, prefix string) (string, error) {
+	var matches []string
+	err := c.eachServicesPage(ctx, &ecs.ListServicesInput{Cluster: &c.cluster}, func(page *ecs.ListServicesOutput, _ bool) bool {
+		for _, arn := range page.ServiceArns {
+			// service ARNs end in either 'service/name' or
+			// 'service/cluster/name'
+			name := aws.StringValue(arn)
+			name = name[strings.LastIndex(name, "/")+1:]
+			if strings.HasPrefix(name, prefix) {
+				matches = append(matches, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", &ServiceNotFoundError{Name: prefix, Cluster: c.cluster}
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", &AmbiguousServiceError{Name: prefix, Matches: matches}
+}
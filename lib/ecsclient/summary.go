@@ -0,0 +1,50 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+// Summary counts tasks by how far they could be resolved, to help explain
+// why there are fewer backends than tasks
+type Summary struct {
+	Total   int
+	Running int
+	// WithInstance counts the tasks associated with an EC2 instance, and
+	// WithoutInstance those which are not, e.g. because their container
+	// instance or EC2 instance could not be described, was filtered out, or
+	// they have no container instance at all
+	WithInstance    int
+	WithoutInstance int
+	// Unresolved counts the tasks without an instance which do have a
+	// container instance, so ought to have had one
+	Unresolved int
+}
+
+// Summarize counts the given tasks
+func Summarize(tasks []AugmentedTask) Summary {
+	var summary Summary
+	for _, task := range tasks {
+		summary.Total++
+		if ecsTask := task.ECSTask(); ecsTask != nil && ecsTask.LastStatus != nil && *ecsTask.LastStatus == "RUNNING" {
+			summary.Running++
+		}
+		if task.EC2Instance() != nil {
+			summary.WithInstance++
+		} else {
+			summary.WithoutInstance++
+			if ecsTask := task.ECSTask(); ecsTask != nil && ecsTask.ContainerInstanceArn != nil {
+				summary.Unresolved++
+			}
+		}
+	}
+	return summary
+}
@@ -0,0 +1,33 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package ecsclient
+
+// Version is the version of the Task Kite, sent to AWS in the User-Agent of
+// every API call. Release builds set it with
+// -ldflags "-X github.com/awslabs/ecs-task-kite/lib/ecsclient.Version=<version>".
+var Version = "v0.0.1"
+
+// UserAgentComment, if not empty, is appended to the User-Agent in
+// parentheses, e.g. to tell apart the fleets a request came from. It should
+// be set before any client is created.
+var UserAgentComment string
+
+// userAgent returns the User-Agent to send with every API call
+func userAgent() string {
+	agent := "ECS Task Kite " + Version
+	if UserAgentComment != "" {
+		agent += " (" + UserAgentComment + ")"
+	}
+	return agent
+}
@@ -0,0 +1,297 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+// Package metrics provides a minimal registry of counters and gauges which
+// can be scraped in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// collector is anything which can write one or more metric families to a
+// scrape
+type collector interface {
+	collect(w io.Writer)
+}
+
+// Registry holds a set of metrics to expose together
+type Registry struct {
+	l          sync.Mutex
+	collectors []collector
+}
+
+// DefaultRegistry is the registry that the package-level constructors register
+// with and that Handler serves. It includes the Go runtime metrics.
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.register(&runtimeCollector{})
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every registered metric to the given writer in the
+// Prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	r.l.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.l.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.collect(buf)
+	}
+	buf.Flush()
+}
+
+// ServeHTTP implements http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// Handler returns an http.Handler which serves the default registry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// metricVec is a named collection of values partitioned by label values
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	l      sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labelValues []string
+
+	l sync.Mutex
+	v float64
+}
+
+func newMetricVec(name, help, metricType string, labels []string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		values:     make(map[string]*value),
+	}
+}
+
+func (m *metricVec) with(labelValues []string) *value {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %v expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	m.l.Lock()
+	defer m.l.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		lvCopy := make([]string, len(labelValues))
+		copy(lvCopy, labelValues)
+		v = &value{labelValues: lvCopy}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metricVec) delete(labelValues []string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delete(m.values, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metricVec) collect(w io.Writer) {
+	m.l.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*value, len(keys))
+	for i, key := range keys {
+		values[i] = m.values[key]
+	}
+	m.l.Unlock()
+
+	writeHeader(w, m.name, m.help, m.metricType)
+	for _, v := range values {
+		v.l.Lock()
+		val := v.v
+		v.l.Unlock()
+		writeSample(w, m.name, m.labels, v.labelValues, val)
+	}
+}
+
+func (v *value) add(delta float64) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.v += delta
+}
+
+func (v *value) set(val float64) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.v = val
+}
+
+func (v *value) get() float64 {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.v
+}
+
+// CounterVec is a counter partitioned by a set of labels
+type CounterVec struct {
+	vec *metricVec
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v *value
+}
+
+// NewCounterVec creates a counter with the given labels and registers it with
+// the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newMetricVec(name, help, "counter", labels)}
+	DefaultRegistry.register(c.vec)
+	return c
+}
+
+// WithLabelValues returns the counter for the given label values, creating it
+// if needed. The values must be given in the order the labels were declared.
+func (c *CounterVec) WithLabelValues(labelValues ...string) Counter {
+	return Counter{c.vec.with(labelValues)}
+}
+
+// Delete removes the counter for the given label values
+func (c *CounterVec) Delete(labelValues ...string) {
+	c.vec.delete(labelValues)
+}
+
+// Inc increments the counter by one
+func (c Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increments the counter by the given non-negative amount
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.add(delta)
+}
+
+// Value returns the current value of the counter
+func (c Counter) Value() float64 {
+	return c.v.get()
+}
+
+// GaugeVec is a gauge partitioned by a set of labels
+type GaugeVec struct {
+	vec *metricVec
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v *value
+}
+
+// NewGaugeVec creates a gauge with the given labels and registers it with
+// the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newMetricVec(name, help, "gauge", labels)}
+	DefaultRegistry.register(g.vec)
+	return g
+}
+
+// WithLabelValues returns the gauge for the given label values, creating it
+// if needed. The values must be given in the order the labels were declared.
+func (g *GaugeVec) WithLabelValues(labelValues ...string) Gauge {
+	return Gauge{g.vec.with(labelValues)}
+}
+
+// Delete removes the gauge for the given label values
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.vec.delete(labelValues)
+}
+
+// Set sets the gauge to the given value
+func (g Gauge) Set(val float64) {
+	g.v.set(val)
+}
+
+// Inc increments the gauge by one
+func (g Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec decrements the gauge by one
+func (g Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Add adds the given delta, which may be negative, to the gauge
+func (g Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value returns the current value of the gauge
+func (g Gauge) Value() float64 {
+	return g.v.get()
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeSample(w io.Writer, name string, labels, labelValues []string, val float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelValueEscaper.Replace(labelValues[i]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %v\n", val)
+}
@@ -0,0 +1,63 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	registry := NewRegistry()
+	counter := &CounterVec{vec: newMetricVec("test_total", "A test counter.", "counter", []string{"port"})}
+	registry.register(counter.vec)
+
+	counter.WithLabelValues("80").Inc()
+	counter.WithLabelValues("80").Add(2)
+	counter.WithLabelValues("443").Inc()
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{port="443"} 1
+test_total{port="80"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%v\nGot:\n%v", expected, buf.String())
+	}
+}
+
+func TestGaugeCanDecrease(t *testing.T) {
+	gauge := &GaugeVec{vec: newMetricVec("test_gauge", "A test gauge.", "gauge", nil)}
+	g := gauge.WithLabelValues()
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	if g.Value() != 1 {
+		t.Errorf("Expected gauge to be 1, was %v", g.Value())
+	}
+}
+
+func TestDefaultRegistryIncludesRuntime(t *testing.T) {
+	var buf bytes.Buffer
+	DefaultRegistry.WriteText(&buf)
+	for _, name := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes", "go_gc_cycles_total"} {
+		if !strings.Contains(buf.String(), "\n"+name+" ") {
+			t.Errorf("Expected default registry to expose %v", name)
+		}
+	}
+}
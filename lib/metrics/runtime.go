@@ -0,0 +1,50 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package metrics
+
+import (
+	"io"
+	"runtime"
+	"time"
+)
+
+// runtimeCollector exposes goroutine, heap, and GC statistics of this
+// process. Since every proxied connection holds a few goroutines, the
+// goroutine count is a good stand-in for load and a good early warning of
+// leaks.
+type runtimeCollector struct{}
+
+func (*runtimeCollector) collect(w io.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	gauge := func(name, help string, val float64) {
+		writeHeader(w, name, help, "gauge")
+		writeSample(w, name, nil, nil, val)
+	}
+	counter := func(name, help string, val float64) {
+		writeHeader(w, name, help, "counter")
+		writeSample(w, name, nil, nil, val)
+	}
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(stats.HeapAlloc))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(stats.HeapInuse))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(stats.HeapObjects))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(stats.Sys))
+	gauge("go_memstats_next_gc_bytes", "Number of heap bytes when the next garbage collection will take place.", float64(stats.NextGC))
+	gauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of the last garbage collection.", float64(stats.LastGC)/float64(time.Second))
+	counter("go_gc_cycles_total", "Number of completed garbage collection cycles.", float64(stats.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time spent in garbage collection pauses.", float64(stats.PauseTotalNs)/float64(time.Second))
+}
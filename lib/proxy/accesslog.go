@@ -0,0 +1,49 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// SetAccessLog logs a line at info level, with the client's address, the
+// backend, the duration and the bytes transferred each way, as each proxied
+// connection closes. Disabled by default.
+func (p *Proxy) SetAccessLog(enabled bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.accessLog = enabled
+}
+
+// logAccess logs the access log line of a completed connection, if enabled
+func (p *Proxy) logAccess(connFields log.Fields, record ConnectionRecord) {
+	p.l.RLock()
+	enabled, logger := p.accessLog, p.accessLogger
+	p.l.RUnlock()
+	if !enabled {
+		return
+	}
+	fields := log.Fields{
+		"port":      p.port,
+		"client":    record.Client,
+		"backend":   record.Backend,
+		"duration":  record.DurationSeconds,
+		"bytes_in":  record.BytesIn,
+		"bytes_out": record.BytesOut,
+	}
+	for k, v := range connFields {
+		fields[k] = v
+	}
+	logger.WithFields(fields).Info("Connection closed")
+}
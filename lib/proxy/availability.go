@@ -0,0 +1,122 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/awslabs/ecs-task-kite/lib/metrics"
+)
+
+// outageLogInterval is the least time between two outage log lines for one
+// proxy, so that a proxy flapping in and out of an outage doesn't flood the
+// logs. Every outage is still counted, and the recovery from one which was not
+// logged is only logged if it lasted at least this long.
+const outageLogInterval = time.Minute
+
+var (
+	outages = metrics.NewCounterVec(
+		"taskkite_outages_total",
+		"Times a port's proxy was left with no usable backends.",
+		"port",
+	)
+	available = metrics.NewGaugeVec(
+		"taskkite_available",
+		"Whether a port's proxy has a usable backend (1) or not (0).",
+		"port",
+	)
+)
+
+// availability tracks whether a proxy has any usable backend, so that the
+// start and end of an outage can be reported
+type availability struct {
+	l           sync.Mutex
+	known       bool
+	down        bool
+	lastOutage  time.Time
+	unreported  int
+	outageStart time.Time
+	// reported is whether the current or last outage was logged
+	reported bool
+}
+
+// markUnavailable records that a connection could not be given a backend, or
+// that the proxy was left without any backends
+func (p *Proxy) markUnavailable() {
+	p.availability.l.Lock()
+	defer p.availability.l.Unlock()
+	a := &p.availability
+	if a.down {
+		return
+	}
+	a.known = true
+	a.down = true
+	a.outageStart = time.Now()
+	port := strconv.Itoa(p.port)
+	outages.WithLabelValues(port).Inc()
+	available.WithLabelValues(port).Set(0)
+
+	if time.Since(a.lastOutage) < outageLogInterval {
+		a.unreported++
+		a.reported = false
+		return
+	}
+	a.lastOutage = a.outageStart
+	a.reported = true
+	log.WithFields(log.Fields{"event": "no_backends", "port": p.port, "unreported_outages": a.unreported}).
+		Error("Proxy has no usable backends; connections are being closed")
+	a.unreported = 0
+}
+
+// markAvailable records that a connection was given a backend, or that the
+// proxy was given backends after having none
+func (p *Proxy) markAvailable() {
+	p.availability.l.Lock()
+	defer p.availability.l.Unlock()
+	a := &p.availability
+	if !a.known {
+		// so that the gauge is exported before the first outage
+		a.known = true
+		available.WithLabelValues(strconv.Itoa(p.port)).Set(1)
+	}
+	if !a.down {
+		return
+	}
+	a.down = false
+	available.WithLabelValues(strconv.Itoa(p.port)).Set(1)
+	duration := time.Since(a.outageStart)
+	if a.reported || duration >= outageLogInterval {
+		log.WithFields(log.Fields{"event": "backends_recovered", "port": p.port}).
+			Infof("Proxy has usable backends again after %v", duration)
+	}
+}
+
+// inheritAvailability carries over the outage, if any, of a proxy which used
+// to serve the same port, so that a port which was removed once it had no
+// backends reports its recovery when it is proxied again
+func (p *Proxy) inheritAvailability(old *Proxy) {
+	o := &old.availability
+	o.l.Lock()
+	known, down, reported := o.known, o.down, o.reported
+	lastOutage, unreported, outageStart := o.lastOutage, o.unreported, o.outageStart
+	o.l.Unlock()
+	p.availability.l.Lock()
+	defer p.availability.l.Unlock()
+	a := &p.availability
+	a.known, a.down, a.reported = known, down, reported
+	a.lastOutage, a.unreported, a.outageStart = lastOutage, unreported, outageStart
+}
@@ -0,0 +1,43 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import "sort"
+
+// UpdateBackendHostsWeighted is like UpdateBackendHosts, but the backends are
+// the keys of the given map, and each is chosen for new connections in
+// proportion to its weight, e.g. so that tasks reserving twice the cpu get
+// twice the connections. Weights below 1 are treated as 1. With the
+// ConsistentHash strategy, weights only apply to clients whose backend on the
+// hash ring cannot be used.
+func (p *Proxy) UpdateBackendHostsWeighted(weights map[string]int) {
+	backends := make([]string, 0, len(weights))
+	capacity := make(map[string]int, len(weights))
+	for backend, weight := range weights {
+		backend = normalizeBackend(backend)
+		backends = append(backends, backend)
+		capacity[backend] = weight
+	}
+	sort.Strings(backends)
+	p.updateBackends(backends, capacity)
+}
+
+// capacityWeight returns the weight of a backend set by
+// UpdateBackendHostsWeighted, or 1. It must be called with l held.
+func (p *Proxy) capacityWeight(backend string) float64 {
+	if weight := p.capacity[backend]; weight > 1 {
+		return float64(weight)
+	}
+	return 1
+}
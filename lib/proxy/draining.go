@@ -0,0 +1,46 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+// SetDrainingBackends marks the given backends, which should also be passed to
+// UpdateBackendHosts, as draining, e.g. because their task is stopping. A
+// draining backend is only chosen for new connections when no other backend
+// can be. Each call replaces the previous set.
+func (p *Proxy) SetDrainingBackends(backends []string) {
+	draining := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		draining[normalizeBackend(backend)] = true
+	}
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	p.draining = draining
+}
+
+// withoutDraining returns the given backends less any draining ones, unless
+// they are all draining. It must be called with connsLock held.
+func (p *Proxy) withoutDraining(backends []string) []string {
+	if len(p.draining) == 0 {
+		return backends
+	}
+	var active []string
+	for _, backend := range backends {
+		if !p.draining[backend] {
+			active = append(active, backend)
+		}
+	}
+	if len(active) == 0 {
+		return backends
+	}
+	return active
+}
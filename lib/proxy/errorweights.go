@@ -0,0 +1,99 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// defaultErrorDecay is how long it takes, by default, for half of a backend's
+// recent dial errors to be forgiven
+const defaultErrorDecay = 10 * time.Second
+
+// backendErrors is a count of a backend's recent dial errors which halves
+// every error decay period
+type backendErrors struct {
+	count   float64
+	updated time.Time
+}
+
+// SetErrorDecay sets how quickly backends recover from dial errors when
+// choosing between them at random. Each failed dial to a backend makes it
+// less likely to be chosen, and half of its recent errors are forgiven every
+// 'decay'. A decay of 0 stops errors from being taken into account.
+func (p *Proxy) SetErrorDecay(decay time.Duration) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	p.errorDecay = decay
+	p.backendErrors = make(map[string]*backendErrors)
+}
+
+// recentErrors returns the decayed error count of a backend as of now. It
+// must be called with connsLock held.
+func (p *Proxy) recentErrors(backend string, now time.Time) float64 {
+	errs, ok := p.backendErrors[backend]
+	if !ok || p.errorDecay <= 0 {
+		return 0
+	}
+	halvings := float64(now.Sub(errs.updated)) / float64(p.errorDecay)
+	count := errs.count * math.Pow(0.5, halvings)
+	if count < 0.01 {
+		delete(p.backendErrors, backend)
+		return 0
+	}
+	errs.count, errs.updated = count, now
+	return count
+}
+
+// recordBackendError counts a failed dial to a backend. It must be called
+// with connsLock held.
+func (p *Proxy) recordBackendError(backend string) {
+	if p.errorDecay <= 0 {
+		return
+	}
+	now := time.Now()
+	count := p.recentErrors(backend, now) + 1
+	p.backendErrors[backend] = &backendErrors{count: count, updated: now}
+}
+
+// choiceWeights returns the relative weight of each of the given backends: its
+// capacity for a backend without recent errors, falling towards 0 as they
+// build up. It must be called with l and connsLock held.
+func (p *Proxy) choiceWeights(backends []string) []float64 {
+	now := time.Now()
+	weights := make([]float64, len(backends))
+	for i, backend := range backends {
+		weights[i] = p.capacityWeight(backend) / (1 + p.recentErrors(backend, now))
+	}
+	return weights
+}
+
+// weightedChoice picks one of the given backends at random in proportion to
+// its weight
+func weightedChoice(backends []string, weights []float64) string {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return backends[i]
+		}
+	}
+	return backends[len(backends)-1]
+}
@@ -0,0 +1,108 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points each backend occupies on the ring;
+// more points spread keys more evenly between backends
+const ringReplicas = 100
+
+type ringPoint struct {
+	hash    uint32
+	backend string
+}
+
+// hashRing is a consistent hash ring of backends. Updating its members only
+// moves the keys which hashed to a removed backend, or which now hash to an
+// added one; every other key keeps mapping to the same backend.
+type hashRing struct {
+	members map[string]bool
+	points  []ringPoint
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// update changes the ring's members to the given backends, only adding and
+// removing the points of backends which changed
+func (r *hashRing) update(backends []string) {
+	newMembers := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		newMembers[backend] = true
+	}
+
+	points := r.points[:0:0]
+	for _, point := range r.points {
+		if newMembers[point.backend] {
+			points = append(points, point)
+		}
+	}
+	for backend := range newMembers {
+		if r.members[backend] {
+			continue
+		}
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, ringPoint{hash: hashKey(backend + "#" + strconv.Itoa(i)), backend: backend})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].backend < points[j].backend
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	r.members = newMembers
+	r.points = points
+}
+
+// get returns the backend the given key maps to
+func (r *hashRing) get(key string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].backend, true
+}
+
+// shares returns the fraction of all keys which map to each backend
+func (r *hashRing) shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.members))
+	if len(r.points) == 0 {
+		return shares
+	}
+	const ringSize = float64(1 << 32)
+	// keys after the last point wrap around to the first
+	last := r.points[len(r.points)-1].hash
+	shares[r.points[0].backend] += float64(r.points[0].hash) + ringSize - float64(last)
+	for i := 1; i < len(r.points); i++ {
+		shares[r.points[i].backend] += float64(r.points[i].hash - r.points[i-1].hash)
+	}
+	for backend := range shares {
+		shares[backend] /= ringSize
+	}
+	return shares
+}
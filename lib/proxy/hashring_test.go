@@ -0,0 +1,129 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestHashRingOnlyMovesKeysOfChangedBackends(t *testing.T) {
+	backends := []string{}
+	for i := 0; i < 10; i++ {
+		backends = append(backends, fmt.Sprintf("10.0.0.%d:80", i))
+	}
+	ring := hashRing{}
+	ring.update(backends)
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("192.168.%d.%d", i/256, i%256)
+		before[key], _ = ring.get(key)
+	}
+
+	removed := backends[3]
+	ring.update(append(append([]string{}, backends[:3]...), backends[4:]...))
+
+	for key, backend := range before {
+		after, _ := ring.get(key)
+		if backend != removed && after != backend {
+			t.Fatalf("Key %v moved from %v to %v though its backend was not removed", key, backend, after)
+		}
+		if after == removed {
+			t.Fatalf("Key %v still maps to removed backend %v", key, removed)
+		}
+	}
+}
+
+func TestConsistentHashStrategyIsStickyPerClient(t *testing.T) {
+	p := New(80)
+	p.SetStrategy(ConsistentHash)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"})
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}
+	first, _ := p.getBackend(client)
+	for i := 0; i < 10; i++ {
+		client.Port++
+		if backend, _ := p.getBackend(client); backend != first {
+			t.Fatalf("Expected client to stick to %v, got %v", first, backend)
+		}
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, strategy := range []Strategy{Random, ConsistentHash, LeastConnections} {
+		parsed, err := ParseStrategy(strategy.String())
+		if err != nil || parsed != strategy {
+			t.Errorf("Expected %v to round trip, got %v, %v", strategy, parsed, err)
+		}
+	}
+	if _, err := ParseStrategy("bogus"); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
+
+func TestWeightsReflectStrategyAndLimits(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"})
+	for _, w := range p.Weights() {
+		if w.Weight != 0.25 {
+			t.Errorf("Expected random weights to be equal, got %+v", w)
+		}
+	}
+
+	p.SetStrategy(ConsistentHash)
+	p.SetConnectionBudget(4)
+	p.backendConns["10.0.0.1:80"] = 1
+	total := 0.0
+	for _, w := range p.Weights() {
+		if w.AtLimit != (w.Backend == "10.0.0.1:80") {
+			t.Errorf("Unexpected limit for %+v", w)
+		}
+		if w.AtLimit && w.Weight != 0 {
+			t.Errorf("Expected a backend at its limit to have no weight, got %+v", w)
+		}
+		total += w.Weight
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("Expected weights to sum to 1, got %v", total)
+	}
+}
+
+func TestLeastConnectionsStrategySpreadsConnections(t *testing.T) {
+	p := New(80)
+	p.SetStrategy(LeastConnections)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"})
+
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234}
+	for i := 0; i < 3; i++ {
+		backend, ok := p.getBackend(clientAddr)
+		if !ok {
+			t.Fatal("Expected a backend")
+		}
+		p.backendConns[backend]++
+	}
+	for _, backend := range p.currentBackends {
+		if p.backendConns[backend] != 1 {
+			t.Errorf("Expected one connection per backend before doubling up, got %v", p.backendConns)
+		}
+	}
+
+	p.backendConns["10.0.0.1:80"]--
+	backend, _ := p.getBackend(clientAddr)
+	if backend != "10.0.0.1:80" {
+		t.Errorf("Expected the backend with the fewest connections, got %v", backend)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// EnableHealthChecks starts dialing every backend each 'interval'. A backend
+// which fails 'failThreshold' checks in a row is taken out of rotation until a
+// check succeeds again. If every backend is unhealthy, they are all used
+// anyway, unless SetHealthFailClosed was called. Calling it again replaces the previous settings; an
+// interval of 0 disables health checks. Health checks stop when the proxy is
+// closed.
+func (p *Proxy) EnableHealthChecks(interval time.Duration, failThreshold int) {
+	if failThreshold < 1 {
+		failThreshold = 1
+	}
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	if p.stopHealthChecks != nil {
+		close(p.stopHealthChecks)
+		p.stopHealthChecks = nil
+	}
+	p.healthInterval = interval
+	p.healthFailThreshold = failThreshold
+	p.unhealthy = make(map[string]bool)
+	p.healthFailures = make(map[string]int)
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	p.stopHealthChecks = stop
+	go p.runHealthChecks(interval, stop)
+}
+
+// SetHealthFailClosed sets what happens when every backend has failed its
+// health checks: if failClosed is true, new connections are closed until one
+// passes a check again, rather than sent to the unhealthy backends, which is
+// the default.
+func (p *Proxy) SetHealthFailClosed(failClosed bool) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	p.healthFailClosed = failClosed
+}
+
+func (p *Proxy) runHealthChecks(interval time.Duration, stop <-chan struct{}) {
+	p.l.RLock()
+	timeout := p.dialTimeout
+	p.l.RUnlock()
+	if interval < timeout {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		p.l.RLock()
+		backends := make([]string, len(p.currentBackends))
+		copy(backends, p.currentBackends)
+		p.l.RUnlock()
+
+		results := make([]bool, len(backends))
+		var wg sync.WaitGroup
+		for i, backend := range backends {
+			wg.Add(1)
+			go func(i int, backend string) {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", backend, timeout)
+				if err == nil {
+					conn.Close()
+				}
+				results[i] = err == nil
+			}(i, backend)
+		}
+		wg.Wait()
+		p.recordHealth(backends, results)
+	}
+}
+
+// recordHealth updates the health of the given backends from one round of
+// checks, forgetting any backends which were not checked
+func (p *Proxy) recordHealth(backends []string, healthy []bool) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	checked := make(map[string]bool, len(backends))
+	for i, backend := range backends {
+		checked[backend] = true
+		if healthy[i] {
+			if p.unhealthy[backend] {
+				log.Infof("Backend %v on port %v is healthy again", backend, p.port)
+			}
+			delete(p.unhealthy, backend)
+			delete(p.healthFailures, backend)
+			continue
+		}
+		p.healthFailures[backend]++
+		if p.healthFailures[backend] >= p.healthFailThreshold && !p.unhealthy[backend] {
+			log.Warnf("Backend %v on port %v failed %v health checks; taking it out of rotation", backend, p.port, p.healthFailures[backend])
+			p.unhealthy[backend] = true
+		}
+	}
+	for backend := range p.healthFailures {
+		if !checked[backend] {
+			delete(p.healthFailures, backend)
+			delete(p.unhealthy, backend)
+		}
+	}
+}
+
+func contains(backends []string, backend string) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the backends which may be chosen for a new connection:
+// those eligible for it which are under their share of the connection
+// budget, so a healthy backend at its limit does not make way for unhealthy
+// ones. Draining backends are only returned if there are no others. It must
+// be called with l and connsLock held.
+func (p *Proxy) candidates(excluded map[string]bool) []string {
+	var underLimit []string
+	for _, backend := range p.eligible(excluded) {
+		if !p.atLimit(backend) {
+			underLimit = append(underLimit, backend)
+		}
+	}
+	return p.withoutDraining(underLimit)
+}
+
+// eligible returns the backends which are not excluded and are healthy, or
+// all of them if every one is unhealthy, since an unhealthy backend is better
+// than none, unless the proxy fails closed, in which case none are. It must be
+// called with l and connsLock held.
+func (p *Proxy) eligible(excluded map[string]bool) []string {
+	var all, healthy []string
+	for _, backend := range p.currentBackends {
+		if excluded[backend] {
+			continue
+		}
+		all = append(all, backend)
+		if !p.unhealthy[backend] {
+			healthy = append(healthy, backend)
+		}
+	}
+	if len(healthy) == 0 {
+		if p.healthFailClosed {
+			return nil
+		}
+		return all
+	}
+	return healthy
+}
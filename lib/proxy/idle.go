@@ -0,0 +1,95 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetIdleTimeout closes proxied connections once no bytes have flowed in
+// either direction for the given duration, so that silent clients do not
+// hold backend connections forever. A timeout of 0 (the default) means
+// connections are never closed for being idle.
+func (p *Proxy) SetIdleTimeout(timeout time.Duration) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.idleTimeout = timeout
+}
+
+// idleWatch calls a function once no reads through any of its readers have
+// returned data for its timeout
+type idleWatch struct {
+	timeout time.Duration
+	// lastActive is the time of the last read, in unix nanoseconds
+	lastActive int64
+
+	// l guards the timer, which its own callback resets, and whether the
+	// watch has been stopped
+	l       sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func watchIdle(timeout time.Duration, onIdle func()) *idleWatch {
+	w := &idleWatch{timeout: timeout, lastActive: time.Now().UnixNano()}
+	// held until the timer is assigned, in case it fires first
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.timer = time.AfterFunc(timeout, func() {
+		w.l.Lock()
+		if w.stopped {
+			w.l.Unlock()
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActive)))
+		if idle < timeout {
+			// there was activity since the timer was set; check again once
+			// the connection could next have been idle for long enough
+			w.timer.Reset(timeout - idle)
+			w.l.Unlock()
+			return
+		}
+		w.l.Unlock()
+		onIdle()
+	})
+	return w
+}
+
+// reader returns a reader which counts reads from r as activity
+func (w *idleWatch) reader(r io.Reader) io.Reader {
+	return &activityReader{r: r, w: w}
+}
+
+func (w *idleWatch) stop() {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.stopped = true
+	w.timer.Stop()
+}
+
+type activityReader struct {
+	r io.Reader
+	w *idleWatch
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&a.w.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,160 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Manager owns the proxies of a set of ports. It creates and serves a proxy for
+// each port as it is needed, keeps its backends up to date, and closes it once
+// the port is no longer needed, without disturbing the other ports.
+type Manager struct {
+	l       sync.Mutex
+	proxies map[uint16]*Proxy
+	// removed holds the last proxy of each port which has been removed, so
+	// that a new one can take over its outage
+	removed     map[uint16]*Proxy
+	newProxy    func(port uint16) *Proxy
+	transparent *Transparent
+}
+
+// NewManager returns a Manager which creates each proxy with newProxy, e.g. to
+// apply the same settings to all of them, or with New if it is nil. If
+// transparent is not nil, proxies are registered with it rather than served
+// on their own ports.
+func NewManager(newProxy func(port uint16) *Proxy, transparent *Transparent) *Manager {
+	if newProxy == nil {
+		newProxy = New
+	}
+	return &Manager{
+		proxies:     make(map[uint16]*Proxy),
+		removed:     make(map[uint16]*Proxy),
+		newProxy:    newProxy,
+		transparent: transparent,
+	}
+}
+
+// EnsurePort makes sure the given port is proxied over the protocol, which
+// must be "tcp", to the given backends, weighted as by
+// UpdateBackendHostsWeighted. Those of them which are draining are given too,
+// as to SetDrainingBackends. The first time, the port's proxy is created, and
+// only starts serving once its backends are set.
+func (m *Manager) EnsurePort(port uint16, protocol string, backends map[string]int, draining []string) (*Proxy, error) {
+	if protocol != "tcp" {
+		return nil, fmt.Errorf("Cannot proxy port %v over %q; only tcp is supported", port, protocol)
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	p, exists := m.proxies[port]
+	if !exists {
+		p = m.newProxy(port)
+		if old, ok := m.removed[port]; ok {
+			p.inheritAvailability(old)
+			delete(m.removed, port)
+		}
+	}
+	p.SetDrainingBackends(draining)
+	p.UpdateBackendHostsWeighted(backends)
+	if exists {
+		return p, nil
+	}
+
+	m.proxies[port] = p
+	if m.transparent != nil {
+		log.Info("Now transparently proxying port", port)
+		m.transparent.Register(port, p)
+		return p, nil
+	}
+	log.Info("Now proxying on port", port)
+	go func() {
+		err := p.Serve()
+		if err != nil {
+			log.Warn("Error listening on port ", port, ": ", err)
+		}
+	}()
+	return p, nil
+}
+
+// RemovePort stops proxying the given port, closing its proxy and its
+// connections, and reports the port as having no backends until it is
+// proxied again. It returns whether the port was being proxied.
+func (m *Manager) RemovePort(port uint16) bool {
+	m.l.Lock()
+	p, ok := m.proxies[port]
+	delete(m.proxies, port)
+	if ok {
+		m.removed[port] = p
+	}
+	m.l.Unlock()
+	if !ok {
+		return false
+	}
+	log.Warnf("No longer listening on 'stale' port: %v", port)
+	// the port is removed once none of its tasks has the port any more
+	p.markUnavailable()
+	if m.transparent != nil {
+		m.transparent.Unregister(port)
+	}
+	p.Close()
+	return true
+}
+
+// Ports returns the ports being proxied, in increasing order
+func (m *Manager) Ports() []uint16 {
+	m.l.Lock()
+	defer m.l.Unlock()
+	ports := make([]uint16, 0, len(m.proxies))
+	for port := range m.proxies {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// Proxies returns a copy of the port -> proxy map
+func (m *Manager) Proxies() map[uint16]*Proxy {
+	m.l.Lock()
+	defer m.l.Unlock()
+	proxies := make(map[uint16]*Proxy, len(m.proxies))
+	for port, p := range m.proxies {
+		proxies[port] = p
+	}
+	return proxies
+}
+
+// Drain stops every proxy accepting connections, waits up to timeout for
+// their open connections to finish, as with CloseGraceful, and then forgets
+// them
+func (m *Manager) Drain(timeout time.Duration) {
+	m.l.Lock()
+	proxies := m.proxies
+	m.proxies = make(map[uint16]*Proxy)
+	m.l.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range proxies {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.CloseGraceful(timeout)
+		}(p)
+	}
+	wg.Wait()
+}
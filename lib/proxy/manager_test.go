@@ -0,0 +1,118 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort returns a port nothing is listening on
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// echoThrough dials the port, retrying while it starts listening, and returns
+// whether a message is echoed back through it
+func echoThrough(port uint16) bool {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return false
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	return err == nil && string(buf) == "ping"
+}
+
+func TestManagerPortLifecycle(t *testing.T) {
+	first, stopFirst := echoBackend(t)
+	defer stopFirst()
+	second, stopSecond := echoBackend(t)
+	defer stopSecond()
+	m := NewManager(func(port uint16) *Proxy {
+		p := New(port)
+		p.SetBindAddress("127.0.0.1")
+		return p
+	}, nil)
+	defer m.Drain(0)
+
+	removed, kept := freePort(t), freePort(t)
+	p, err := m.EnsurePort(removed, "tcp", map[string]int{first: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.EnsurePort(kept, "tcp", map[string]int{first: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !echoThrough(removed) || !echoThrough(kept) {
+		t.Fatal("Expected both ports to be proxied")
+	}
+
+	// updating a port keeps its proxy and replaces its backends
+	updated, err := m.EnsurePort(removed, "tcp", map[string]int{second: 1}, nil)
+	if err != nil || updated != p {
+		t.Fatalf("Expected the same proxy, got %v, %v", updated, err)
+	}
+	if weights := p.Weights(); len(weights) != 1 || weights[0].Backend != second {
+		t.Errorf("Expected only the second backend, got %+v", weights)
+	}
+
+	if !m.RemovePort(removed) {
+		t.Error("Expected the port to be removed")
+	}
+	if m.RemovePort(removed) {
+		t.Error("Expected the port to be removed only once")
+	}
+	if ports := m.Ports(); !reflect.DeepEqual(ports, []uint16{kept}) {
+		t.Errorf("Expected only %v to be left, got %v", kept, ports)
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(removed))); err == nil {
+		t.Error("Expected the removed port to stop listening")
+	}
+	if !echoThrough(kept) {
+		t.Error("Expected the other port to keep serving")
+	}
+}
+
+func TestManagerOnlyProxiesTCP(t *testing.T) {
+	m := NewManager(nil, nil)
+	if _, err := m.EnsurePort(80, "udp", map[string]int{"10.0.0.1:80": 1}, nil); err == nil {
+		t.Error("Expected udp to be rejected")
+	}
+	if ports := m.Ports(); len(ports) != 0 {
+		t.Errorf("Expected no ports, got %v", ports)
+	}
+}
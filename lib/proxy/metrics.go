@@ -0,0 +1,158 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/awslabs/ecs-task-kite/lib/metrics"
+)
+
+// Outcomes a proxied connection can have
+const (
+	outcomeSuccess   = "success"
+	outcomeNoBackend = "no_backend"
+	outcomeDialError = "dial_error"
+)
+
+// otherSubnet is the subnet label for clients outside every configured subnet
+const otherSubnet = "other"
+
+var connectionsBySubnet = metrics.NewCounterVec(
+	"taskkite_connections_by_subnet_total",
+	"Connections accepted, by port, configured client subnet, and outcome.",
+	"port", "subnet", "outcome",
+)
+
+var (
+	backendAdditions = metrics.NewCounterVec(
+		"taskkite_backend_additions_total",
+		"Backends added to a port's proxy.",
+		"port",
+	)
+	backendRemovals = metrics.NewCounterVec(
+		"taskkite_backend_removals_total",
+		"Backends removed from a port's proxy.",
+		"port",
+	)
+	backendCount = metrics.NewGaugeVec(
+		"taskkite_backends",
+		"Current number of backends of a port's proxy.",
+		"port",
+	)
+)
+
+var (
+	connectionsAccepted = metrics.NewCounterVec(
+		"taskkite_connections_accepted_total",
+		"Client connections accepted on a port.",
+		"port",
+	)
+	activeConnectionsGauge = metrics.NewGaugeVec(
+		"taskkite_active_connections",
+		"Connections currently being proxied on a port.",
+		"port",
+	)
+	bytesInTotal = metrics.NewCounterVec(
+		"taskkite_bytes_in_total",
+		"Bytes proxied from backends to clients on a port.",
+		"port",
+	)
+	bytesOutTotal = metrics.NewCounterVec(
+		"taskkite_bytes_out_total",
+		"Bytes proxied from clients to backends on a port.",
+		"port",
+	)
+	dialFailures = metrics.NewCounterVec(
+		"taskkite_dial_failures_total",
+		"Failed dials to a backend of a port.",
+		"port", "backend",
+	)
+)
+
+// recordActiveConnections updates the active connections gauge, removing it
+// once a closed proxy has none left. It must be called with connsLock held.
+func (p *Proxy) recordActiveConnections() {
+	port := strconv.Itoa(p.port)
+	if !p.active && len(p.activeConnections) == 0 {
+		activeConnectionsGauge.Delete(port)
+		return
+	}
+	activeConnectionsGauge.WithLabelValues(port).Set(float64(len(p.activeConnections)))
+}
+
+// recordBackendChanges counts the backends added and removed between the old
+// and new backend lists
+func (p *Proxy) recordBackendChanges(oldBackends, newBackends []string) {
+	old := make(map[string]bool, len(oldBackends))
+	for _, backend := range oldBackends {
+		old[backend] = true
+	}
+	current := make(map[string]bool, len(newBackends))
+	added := 0
+	for _, backend := range newBackends {
+		current[backend] = true
+		if !old[backend] {
+			added++
+		}
+	}
+	port := strconv.Itoa(p.port)
+	removed := 0
+	for backend := range old {
+		if !current[backend] {
+			removed++
+			// so that the series of short-lived tasks don't accumulate
+			dialFailures.Delete(port, backend)
+		}
+	}
+
+	backendAdditions.WithLabelValues(port).Add(float64(added))
+	backendRemovals.WithLabelValues(port).Add(float64(removed))
+	backendCount.WithLabelValues(port).Set(float64(len(current)))
+}
+
+// SetClientSubnets sets the client subnets to break connection outcome
+// metrics down by. Clients outside all of them are counted as "other". If no
+// subnets are set (the default), the breakdown is not recorded.
+func (p *Proxy) SetClientSubnets(subnets []*net.IPNet) {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	p.clientSubnets = subnets
+}
+
+// clientSubnet returns the first configured subnet containing the given
+// client, and false if no subnets are configured
+func (p *Proxy) clientSubnet(clientAddr net.Addr) (string, bool) {
+	p.failureLock.Lock()
+	subnets := p.clientSubnets
+	p.failureLock.Unlock()
+	if len(subnets) == 0 {
+		return "", false
+	}
+	ip := net.ParseIP(clientIP(clientAddr))
+	for _, subnet := range subnets {
+		if ip != nil && subnet.Contains(ip) {
+			return subnet.String(), true
+		}
+	}
+	return otherSubnet, true
+}
+
+// recordOutcome counts how a connection from the given client turned out
+func (p *Proxy) recordOutcome(clientAddr net.Addr, outcome string) {
+	if subnet, ok := p.clientSubnet(clientAddr); ok {
+		connectionsBySubnet.WithLabelValues(strconv.Itoa(p.port), subnet, outcome).Inc()
+	}
+}
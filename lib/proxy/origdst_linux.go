@@ -0,0 +1,76 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	soOriginalDst = 80
+	// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from
+	// linux/netfilter_ipv6/ip6_tables.h
+	ip6tSoOriginalDst = 80
+)
+
+// originalDstPort returns the port a connection redirected by netfilter was
+// originally destined for, over either IPv4 or IPv6.
+func originalDstPort(conn net.Conn) (uint16, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, errors.New("Not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	ipv6 := local != nil && local.IP.To4() == nil
+
+	var port uint16
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			// The kernel fills in a sockaddr_in6, which is where the
+			// IPv6MTUInfo struct starts; its port is in network byte order.
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port = binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+			return
+		}
+		// The kernel fills in a sockaddr_in, which conveniently fits in the
+		// IPv6Mreq struct; bytes 2 and 3 are the port in network byte order.
+		addr, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port = uint16(addr.Multiaddr[2])<<8 | uint16(addr.Multiaddr[3])
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, sockErr
+	}
+	return port, nil
+}
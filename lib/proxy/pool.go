@@ -0,0 +1,245 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// poolIdleTimeout is how long a pooled connection is kept unused before it is
+// closed and replaced, since backends and NATs drop idle connections
+const poolIdleTimeout = 30 * time.Second
+
+// EnableConnectionPool keeps up to perBackend connections to each backend
+// dialed ahead of time, so that a new client connection is handed one rather
+// than waiting for a dial, which helps most with short-lived connections and
+// TLS backends. Each pooled connection is used once: as the proxy cannot tell
+// where one request ends, a connection is never returned to the pool after a
+// client has used it. A pooled connection unused for poolIdleTimeout is
+// replaced. The pool should only be used with backends which do not close
+// idle connections sooner. A perBackend of 0 (the default) disables it.
+func (p *Proxy) EnableConnectionPool(perBackend int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.pool != nil {
+		p.pool.close()
+		p.pool = nil
+	}
+	if perBackend <= 0 {
+		return
+	}
+	p.pool = newConnPool(perBackend, poolIdleTimeout, p.dialBackend)
+	p.pool.update(p.currentBackends)
+}
+
+// SetPreferPooledBackends makes the backends with a pooled connection ready
+// the only candidates for a new connection, while any have one, so that it is
+// handed a connection rather than waiting for a dial. This applies after the
+// strategy has narrowed the candidates down, except that ConsistentHash still
+// sends a client to its own backend when it can. It has no effect without
+// EnableConnectionPool. Disabled by default.
+func (p *Proxy) SetPreferPooledBackends(enabled bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.preferPooled = enabled
+}
+
+// dialBackend dials the given backend with the proxy's current settings
+func (p *Proxy) dialBackend(backend string) (net.Conn, error) {
+	p.l.RLock()
+	backendTLS, timeout := p.backendTLSConfig, p.dialTimeout
+	p.l.RUnlock()
+	return dial(backend, backendTLS, timeout)
+}
+
+// connPool holds connections to each backend which have been dialed but not
+// yet used
+type connPool struct {
+	perBackend  int
+	idleTimeout time.Duration
+	dial        func(backend string) (net.Conn, error)
+	stop        chan struct{}
+
+	l        sync.Mutex
+	backends map[string]bool
+	idle     map[string][]pooledConn
+	dialing  map[string]int
+	closed   bool
+}
+
+type pooledConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+func newConnPool(perBackend int, idleTimeout time.Duration, dial func(string) (net.Conn, error)) *connPool {
+	c := &connPool{
+		perBackend:  perBackend,
+		idleTimeout: idleTimeout,
+		dial:        dial,
+		stop:        make(chan struct{}),
+		backends:    make(map[string]bool),
+		idle:        make(map[string][]pooledConn),
+		dialing:     make(map[string]int),
+	}
+	go c.replaceExpired()
+	return c
+}
+
+// get takes a pooled connection to the backend, if there is one, and starts
+// dialing another in its place. A nil pool has no connections.
+func (c *connPool) get(backend string) (net.Conn, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.expire(backend, time.Now())
+	idle := c.idle[backend]
+	if len(idle) == 0 {
+		c.fill(backend)
+		return nil, false
+	}
+	conn := idle[0].conn
+	c.idle[backend] = idle[1:]
+	c.fill(backend)
+	return conn, true
+}
+
+// withIdle returns those of the backends which have a pooled connection, or
+// all of them if none do. A nil pool has no connections.
+func (c *connPool) withIdle(backends []string) []string {
+	if c == nil {
+		return backends
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	pooled := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		if len(c.idle[backend]) > 0 {
+			pooled = append(pooled, backend)
+		}
+	}
+	if len(pooled) == 0 {
+		return backends
+	}
+	return pooled
+}
+
+// update pools connections to the given backends, closing those pooled for
+// any others
+func (c *connPool) update(backends []string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.backends = make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		c.backends[backend] = true
+		c.fill(backend)
+	}
+	for backend, idle := range c.idle {
+		if !c.backends[backend] {
+			for _, pooled := range idle {
+				pooled.conn.Close()
+			}
+			delete(c.idle, backend)
+		}
+	}
+}
+
+// fill starts dialing as many connections to the backend as it is short of.
+// Failed dials are not retried until the pool is next used or refreshed. It
+// must be called with l held.
+func (c *connPool) fill(backend string) {
+	if c.closed || !c.backends[backend] {
+		return
+	}
+	for n := len(c.idle[backend]) + c.dialing[backend]; n < c.perBackend; n++ {
+		c.dialing[backend]++
+		go func() {
+			conn, err := c.dial(backend)
+			c.l.Lock()
+			defer c.l.Unlock()
+			c.dialing[backend]--
+			if err != nil {
+				return
+			}
+			if c.closed || !c.backends[backend] {
+				conn.Close()
+				return
+			}
+			c.idle[backend] = append(c.idle[backend], pooledConn{conn: conn, dialed: time.Now()})
+		}()
+	}
+}
+
+// expire closes the backend's connections which have been pooled for longer
+// than the idle timeout. It must be called with l held.
+func (c *connPool) expire(backend string, now time.Time) {
+	idle := c.idle[backend]
+	fresh := idle[:0]
+	for _, pooled := range idle {
+		if now.Sub(pooled.dialed) >= c.idleTimeout {
+			pooled.conn.Close()
+			continue
+		}
+		fresh = append(fresh, pooled)
+	}
+	c.idle[backend] = fresh
+}
+
+// replaceExpired periodically replaces connections which have been pooled for
+// too long, until the pool is closed
+func (c *connPool) replaceExpired() {
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.l.Lock()
+			for backend := range c.backends {
+				c.expire(backend, now)
+				c.fill(backend)
+			}
+			c.l.Unlock()
+		}
+	}
+}
+
+// idleCount returns how many connections to the backend are pooled
+func (c *connPool) idleCount(backend string) int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return len(c.idle[backend])
+}
+
+// close closes every pooled connection and stops pooling more
+func (c *connPool) close() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	for _, idle := range c.idle {
+		for _, pooled := range idle {
+			pooled.conn.Close()
+		}
+	}
+	c.idle = make(map[string][]pooledConn)
+}
@@ -14,18 +14,37 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-const proxyDialTimeout = 10 * time.Second
+// defaultDialTimeout is how long a backend dial may take unless SetDialTimeout
+// is called
+const defaultDialTimeout = 10 * time.Second
+
+const (
+	initialBindBackoff = 100 * time.Millisecond
+	maxBindBackoff     = 5 * time.Second
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+var (
+	errProxyClosed     = errors.New("Proxy is closed")
+	errConnectionLimit = errors.New("Proxy has reached its maximum number of connections")
+	errBackendLimit    = errors.New("Backend has reached its share of the connection budget")
+)
 
 // Proxy implements a tcp proxy for a given port to a collection of backend
 // ip+port locations.
@@ -36,15 +55,71 @@ const proxyDialTimeout = 10 * time.Second
 // These backends will be randomly proxied to when a connection is made on the
 // port passed in at construction.
 type Proxy struct {
-	port     int
-	listener net.Listener
-	active   bool
+	// counters is first to keep its int64s aligned for atomic access
+	counters proxyCounters
+
+	port       int
+	listener   net.Listener
+	acceptDone chan struct{}
+	active     bool
+
+	l                 sync.RWMutex
+	currentBackends   []string
+	strategy          Strategy
+	ring              hashRing
+	bindRetry         time.Duration
+	acceptParallelism int
+	bindAddress       string
+	proxyProtocol     bool
+	idleTimeout       time.Duration
+	dialTimeout       time.Duration
+	dialRetries       int
+	tlsConfig         *tls.Config
+	backendTLSConfig  *tls.Config
+	onBackendsChanged func(old, new []string)
+	closeOnRemoval    bool
+	accessLog         bool
+	// accessLogger is the logger access log lines are written to
+	accessLogger *log.Logger
+	maxBackends  int
+	// capacity holds the weight of each backend set by
+	// UpdateBackendHostsWeighted; backends without one have weight 1
+	capacity map[string]int
+	// pool is nil unless EnableConnectionPool was called
+	pool         *connPool
+	preferPooled bool
+
+	connsLock sync.Mutex
+	// activeConnections maps each backend connection to its backend
+	activeConnections map[net.Conn]string
+	backendConns      map[string]int
+	connectionBudget  int
+	perBackendLimit   int
+	maxConnections    int
+	recent            recentConnections
+	// reservedConns is the number of connections being dialed or proxied
+	reservedConns int
 
-	l               sync.RWMutex
-	currentBackends []string
+	healthInterval      time.Duration
+	healthFailThreshold int
+	unhealthy           map[string]bool
+	healthFailures      map[string]int
+	healthFailClosed    bool
+	stopHealthChecks    chan struct{}
 
-	connsLock         sync.Mutex
-	activeConnections []net.Conn
+	errorDecay    time.Duration
+	backendErrors map[string]*backendErrors
+	draining      map[string]bool
+
+	failureLock      sync.Mutex
+	failureThreshold int
+	failureWindow    time.Time
+	failureCount     int
+	onFailureSpike   func()
+	clientSubnets    []*net.IPNet
+
+	availability availability
+	acceptRate   acceptLimiter
 }
 
 // New returns a new proxy that listens on the passed in port. The proxy will
@@ -52,48 +127,367 @@ type Proxy struct {
 // 'Serve' before it will begin listening and proxying (preferably after
 // setting appropriate backends).
 func New(port uint16) *Proxy {
-	return &Proxy{active: false, port: int(port)}
+	return &Proxy{
+		active:            true,
+		port:              int(port),
+		accessLogger:      log.StandardLogger(),
+		activeConnections: make(map[net.Conn]string),
+		backendConns:      make(map[string]int),
+		errorDecay:        defaultErrorDecay,
+		dialTimeout:       defaultDialTimeout,
+		backendErrors:     make(map[string]*backendErrors),
+	}
+}
+
+// SetFailureSpikeHandler registers a function to call when at least
+// 'threshold' backend dials fail within a single second. A spike like that
+// suggests the whole backend list is stale (e.g. after every task was
+// replaced), so the handler will typically trigger an immediate refresh. The
+// handler is called at most once per second and must not block. A threshold of
+// 0 disables it.
+func (p *Proxy) SetFailureSpikeHandler(threshold int, handler func()) {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	p.failureThreshold = threshold
+	p.onFailureSpike = handler
+}
+
+func (p *Proxy) recordDialFailure() {
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	if p.failureThreshold <= 0 || p.onFailureSpike == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.failureWindow) >= time.Second {
+		p.failureWindow = now
+		p.failureCount = 0
+	}
+	p.failureCount++
+	if p.failureCount == p.failureThreshold {
+		log.Warnf("%v backend dials failed on port %v within a second", p.failureCount, p.port)
+		p.onFailureSpike()
+	}
+}
+
+// Settings describes how a proxy is configured to select and connect to
+// backends. Durations are rendered as strings (e.g. "10s") for readability.
+type Settings struct {
+	Port                  int    `json:"port"`
+	BindAddress           string `json:"bindAddress"`
+	ProxyProtocol         bool   `json:"proxyProtocol"`
+	Policy                string `json:"policy"`
+	DialTimeout           string `json:"dialTimeout"`
+	DialRetries           int    `json:"dialRetries"`
+	FailureSpikeThreshold int    `json:"failureSpikeThreshold"`
+	ConnectionBudget      int    `json:"connectionBudget"`
+	PerBackendLimit       int    `json:"perBackendLimit"`
+	MaxConnections        int    `json:"maxConnections"`
+	BindRetryTimeout      string `json:"bindRetryTimeout"`
+	HealthCheckInterval   string `json:"healthCheckInterval"`
+	HealthCheckThreshold  int    `json:"healthCheckThreshold"`
+	HealthFailClosed      bool   `json:"healthFailClosed"`
+	ErrorDecay            string `json:"errorDecay"`
+	IdleTimeout           string `json:"idleTimeout"`
+	TLS                   bool   `json:"tls"`
+	BackendTLS            bool   `json:"backendTls"`
+	CloseOnBackendRemoval bool   `json:"closeOnBackendRemoval"`
+	MaxBackends           int    `json:"maxBackends"`
+	AccessLog             bool   `json:"accessLog"`
+	ConnectionPool        int    `json:"connectionPool"`
+	PreferPooledBackends  bool   `json:"preferPooledBackends"`
+	AcceptRate            int    `json:"acceptRate"`
+	AcceptBurst           int    `json:"acceptBurst"`
+}
+
+// SetStrategy sets how backends are chosen for new connections. The default
+// is Random.
+func (p *Proxy) SetStrategy(strategy Strategy) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.strategy = strategy
+	p.ring = hashRing{}
+	if strategy == ConsistentHash {
+		p.ring.update(p.currentBackends)
+	}
+}
+
+// Settings returns the proxy's currently active configuration
+func (p *Proxy) Settings() Settings {
+	p.l.RLock()
+	proxyProtocol := p.proxyProtocol
+	strategy, bindRetry, bindAddress, idleTimeout := p.strategy, p.bindRetry, p.bindAddress, p.idleTimeout
+	tlsEnabled, backendTLSEnabled := p.tlsConfig != nil, p.backendTLSConfig != nil
+	dialTimeoutSetting, dialRetries := p.dialTimeout, p.dialRetries
+	closeOnRemoval, maxBackends, accessLog := p.closeOnRemoval, p.maxBackends, p.accessLog
+	poolSize, preferPooled := 0, p.preferPooled
+	if p.pool != nil {
+		poolSize = p.pool.perBackend
+	}
+	p.l.RUnlock()
+	p.connsLock.Lock()
+	budget, perBackendLimit, maxConnections := p.connectionBudget, p.perBackendLimit, p.maxConnections
+	healthInterval, healthFailThreshold, healthFailClosed := p.healthInterval, p.healthFailThreshold, p.healthFailClosed
+	errorDecay := p.errorDecay
+	p.connsLock.Unlock()
+	acceptRate, acceptBurst := p.acceptRate.settings()
+	p.failureLock.Lock()
+	defer p.failureLock.Unlock()
+	return Settings{
+		Port:                  p.port,
+		BindAddress:           bindAddress,
+		ProxyProtocol:         proxyProtocol,
+		Policy:                strategy.String(),
+		DialTimeout:           dialTimeoutSetting.String(),
+		DialRetries:           dialRetries,
+		FailureSpikeThreshold: p.failureThreshold,
+		ConnectionBudget:      budget,
+		PerBackendLimit:       perBackendLimit,
+		MaxConnections:        maxConnections,
+		BindRetryTimeout:      bindRetry.String(),
+		HealthCheckInterval:   healthInterval.String(),
+		HealthCheckThreshold:  healthFailThreshold,
+		HealthFailClosed:      healthFailClosed,
+		ErrorDecay:            errorDecay.String(),
+		IdleTimeout:           idleTimeout.String(),
+		TLS:                   tlsEnabled,
+		BackendTLS:            backendTLSEnabled,
+		MaxBackends:           maxBackends,
+		CloseOnBackendRemoval: closeOnRemoval,
+		AccessLog:             accessLog,
+		ConnectionPool:        poolSize,
+		PreferPooledBackends:  preferPooled,
+		AcceptRate:            acceptRate,
+		AcceptBurst:           acceptBurst,
+	}
+}
+
+// SetBindRetryTimeout sets how long Serve keeps retrying, with exponential
+// backoff, when its port is already in use. This covers a fast restart where
+// the previous process has not released the port yet. A timeout of 0 (the
+// default) means Serve fails on the first attempt.
+func (p *Proxy) SetBindRetryTimeout(timeout time.Duration) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.bindRetry = timeout
+}
+
+// SetConnectionBudget sets the total number of concurrent connections the
+// proxy should make across all of its backends. The budget is split evenly
+// between the current backends, and re-split whenever they are updated, so
+// that each backend's share shrinks as the service scales out. Once a backend
+// has its share of connections, it is not chosen for new ones. A budget of 0
+// (the default) means unlimited.
+func (p *Proxy) SetConnectionBudget(total int) {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	p.connectionBudget = total
+	p.recomputePerBackendLimit(len(p.currentBackends))
+}
+
+// SetMaxConnections limits how many connections the proxy handles at once.
+// Once the limit is reached, further connections are closed as soon as they
+// are accepted, protecting the backends from overload during traffic spikes.
+// A limit of 0 (the default) means unlimited.
+func (p *Proxy) SetMaxConnections(n int) {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	p.maxConnections = n
 }
 
-func (p *Proxy) getBackend() (string, bool) {
+// recomputePerBackendLimit must be called with connsLock held
+func (p *Proxy) recomputePerBackendLimit(numBackends int) {
+	if p.connectionBudget <= 0 || numBackends == 0 {
+		p.perBackendLimit = 0
+		return
+	}
+	// round up so that the whole budget is usable
+	p.perBackendLimit = (p.connectionBudget + numBackends - 1) / numBackends
+}
+
+// atLimit returns whether the given backend already has its share of the
+// connection budget. It must be called with connsLock held.
+func (p *Proxy) atLimit(backend string) bool {
+	return p.perBackendLimit > 0 && p.backendConns[backend] >= p.perBackendLimit
+}
+
+// saturated returns whether there are backends a new connection could be
+// given, but every one of them is at its share of the connection budget
+func (p *Proxy) saturated() bool {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	return len(p.eligible(nil)) > 0 && len(p.candidates(nil)) == 0
+}
+
+// getBackend chooses a backend for a connection from the given client address
+func (p *Proxy) getBackend(clientAddr net.Addr) (string, bool) {
+	return p.getBackendExcluding(clientAddr, nil)
+}
+
+// getBackendExcluding is like getBackend, but never chooses any of the
+// excluded backends, e.g. because they just failed to dial
+func (p *Proxy) getBackendExcluding(clientAddr net.Addr, excluded map[string]bool) (string, bool) {
 	p.l.RLock()
 	defer p.l.RUnlock()
 	if len(p.currentBackends) == 0 {
 		return "", false
 	}
-	// TODO, weighted random based on past errors
-	chosenBackend := p.currentBackends[rand.Intn(len(p.currentBackends))]
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	candidates := p.candidates(excluded)
+	if len(candidates) == 0 {
+		return "", false
+	}
+	if p.strategy == ConsistentHash {
+		backend, ok := p.ring.get(clientIP(clientAddr))
+		if ok && contains(candidates, backend) {
+			return backend, true
+		}
+	}
+	if p.strategy == LeastConnections {
+		candidates = p.leastConnected(candidates)
+	}
+	if p.preferPooled {
+		candidates = p.pool.withIdle(candidates)
+	}
+	// weighted random by capacity, away from backends which recently failed
+	// to dial
+	chosenBackend := weightedChoice(candidates, p.choiceWeights(candidates))
 	return chosenBackend, true
 }
 
+// leastConnected returns the backends, out of the given ones, with the fewest
+// active connections. The caller must hold connsLock.
+func (p *Proxy) leastConnected(backends []string) []string {
+	least := make([]string, 0, len(backends))
+	fewest := -1
+	for _, backend := range backends {
+		conns := p.backendConns[backend]
+		if fewest == -1 || conns < fewest {
+			fewest = conns
+			least = least[:0]
+		}
+		if conns == fewest {
+			least = append(least, backend)
+		}
+	}
+	return least
+}
+
+// dialSlots limits how many backend dials may be in flight at once across
+// every proxy. It is nil when there is no limit.
+var dialSlots struct {
+	l     sync.RWMutex
+	slots chan struct{}
+}
+
+// SetMaxConcurrentDials limits the number of backend dials that may be in
+// flight at once across all proxies, so that a burst of new client
+// connections is throttled rather than becoming a storm of dials against the
+// backends. Connections which cannot get a dial slot within the dial timeout
+// fail. A limit of 0 (the default) means unlimited. It should be called before
+// any proxy is served.
+func SetMaxConcurrentDials(limit int) {
+	dialSlots.l.Lock()
+	defer dialSlots.l.Unlock()
+	if limit <= 0 {
+		dialSlots.slots = nil
+		return
+	}
+	dialSlots.slots = make(chan struct{}, limit)
+}
+
+// dial connects to the given backend once a dial slot is free, over TLS if
+// tlsConfig is not nil. Waiting for a slot counts toward the timeout.
+func dial(target string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialSlots.l.RLock()
+	slots := dialSlots.slots
+	dialSlots.l.RUnlock()
+	if slots == nil {
+		return dialTimeout(target, tlsConfig, timeout)
+	}
+
+	started := time.Now()
+	select {
+	case slots <- struct{}{}:
+	case <-time.After(timeout):
+		return nil, errors.New("Timed out waiting for a free dial slot")
+	}
+	defer func() { <-slots }()
+	return dialTimeout(target, tlsConfig, timeout-time.Since(started))
+}
+
 func (p *Proxy) createConnection(target string) (net.Conn, error) {
 	p.connsLock.Lock()
-	defer p.connsLock.Unlock()
 	if !p.active {
-		return nil, errors.New("Cannot proxy with inactive proxy")
+		p.connsLock.Unlock()
+		return nil, errProxyClosed
+	}
+	if p.maxConnections > 0 && p.reservedConns >= p.maxConnections {
+		p.connsLock.Unlock()
+		return nil, errConnectionLimit
 	}
-	backendConn, err := net.DialTimeout("tcp", target, proxyDialTimeout)
+	if p.atLimit(target) {
+		p.connsLock.Unlock()
+		return nil, errBackendLimit
+	}
+	// Reserve this connection's share of the budget, so that the lock need
+	// not be held while dialing
+	p.backendConns[target]++
+	p.reservedConns++
+	p.connsLock.Unlock()
+
+	p.l.RLock()
+	backendTLS, timeout, pool := p.backendTLSConfig, p.dialTimeout, p.pool
+	p.l.RUnlock()
+	var backendConn net.Conn
+	var err error
+	if pooled, ok := pool.get(target); ok {
+		backendConn = pooled
+	} else {
+		backendConn, err = dial(target, backendTLS, timeout)
+	}
+
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
 	if err != nil {
 		if backendConn != nil {
 			// probably not needed, but no harm
 			backendConn.Close()
 		}
+		p.releaseBackend(target)
+		p.recordBackendError(target)
+		dialFailures.WithLabelValues(strconv.Itoa(p.port), target).Inc()
 		return nil, err
 	}
-	p.activeConnections = append(p.activeConnections, backendConn)
+	p.activeConnections[backendConn] = target
+	p.recordActiveConnections()
 	return backendConn, err
 }
 
-func (p *Proxy) deleteConnection(targetConn net.Conn) {
+// releaseBackend gives back a connection's share of a backend's budget. It
+// must be called with connsLock held.
+func (p *Proxy) releaseBackend(target string) {
+	p.reservedConns--
+	p.backendConns[target]--
+	if p.backendConns[target] <= 0 {
+		delete(p.backendConns, target)
+	}
+}
+
+func (p *Proxy) deleteConnection(target string, targetConn net.Conn) {
 	p.connsLock.Lock()
 	defer p.connsLock.Unlock()
-	for i, conn := range p.activeConnections {
-		if conn == targetConn {
-			// per https://code.google.com/p/go-wiki/wiki/SliceTricks, remove element from the slice
-			p.activeConnections[i], p.activeConnections[len(p.activeConnections)-1], p.activeConnections = p.activeConnections[len(p.activeConnections)-1], nil, p.activeConnections[:len(p.activeConnections)-1]
-			return
-		}
+	if _, ok := p.activeConnections[targetConn]; targetConn == nil || !ok {
+		return
 	}
+	p.releaseBackend(target)
+	delete(p.activeConnections, targetConn)
+	p.recordActiveConnections()
 }
 
 // Serve begins listening for traffic and serving it. It will block
@@ -101,79 +495,484 @@ func (p *Proxy) deleteConnection(targetConn net.Conn) {
 // goroutine.
 // If it's unable to listen it will return an error.
 func (p *Proxy) Serve() error {
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(int(p.port)))
+	l, err := p.listen()
 	if err != nil {
 		return err
 	}
 
-	p.active = true
+	p.l.Lock()
+	if !p.active {
+		// closed while binding
+		p.l.Unlock()
+		l.Close()
+		return nil
+	}
+	if p.tlsConfig != nil {
+		l = tls.NewListener(l, p.tlsConfig)
+	}
 	p.listener = l
+	acceptDone := make(chan struct{})
+	p.acceptDone = acceptDone
+	parallelism := p.acceptParallelism
+	p.l.Unlock()
+	defer close(acceptDone)
 
-	for p.active {
-		conn, err := p.listener.Accept()
+	var accepters sync.WaitGroup
+	for i := 1; i < parallelism; i++ {
+		accepters.Add(1)
+		go func() {
+			defer accepters.Done()
+			p.acceptLoop(l)
+		}()
+	}
+	p.acceptLoop(l)
+	accepters.Wait()
+	return nil
+}
+
+// acceptLoop accepts and handles connections until the listener is closed
+func (p *Proxy) acceptLoop(l net.Listener) {
+	for {
+		p.acceptRate.wait()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Error("Error accpting connection", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error("Error accepting connection", err)
 			continue
 		}
-		log.Debug("Now listening for", p.listener.Addr().String())
-		go func(conn net.Conn) {
-			defer conn.Close()
+		log.Debug("Now listening for", l.Addr().String())
+		go p.handle(conn)
+	}
+}
 
-			chosenBackend, ok := p.getBackend()
-			if !ok {
-				log.Debug("Could not proxy connection; no viable backends; closing connection")
-				return
-			}
+// SetDialTimeout sets how long a backend dial may take, including any wait
+// for a free dial slot and TLS handshake, before the client's connection is
+// closed. The default is 10 seconds.
+func (p *Proxy) SetDialTimeout(timeout time.Duration) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.dialTimeout = timeout
+}
 
-			log.Info("Proxying request to ", chosenBackend)
-			backendConn, err := p.createConnection(chosenBackend)
-			defer p.deleteConnection(backendConn)
-			if err != nil {
-				log.Error("Could not proxy to " + chosenBackend + ": " + err.Error())
-				return
-			}
-			defer backendConn.Close()
-
-			waitBothDone := &sync.WaitGroup{}
-			waitBothDone.Add(1)
-			go func() {
-				_, err := io.Copy(conn, backendConn)
-				if err != nil {
-					log.Warn("Error proxying to " + chosenBackend + " while reading from it: " + err.Error())
-				}
-				// If we get here, that means
-				waitBothDone.Done()
-			}()
-			waitBothDone.Add(1)
-			go func() {
-				_, err := io.Copy(backendConn, conn)
-				if err != nil {
-					log.Warn("Error proxying to " + chosenBackend + " while writing to it: " + err.Error())
-				}
-				waitBothDone.Done()
-			}()
-			waitBothDone.Wait()
-		}(conn)
+// SetDialRetries sets how many other backends a connection is tried with, in
+// turn, when dialing its backend fails, so that one dead task does not fail
+// connections while others are up. The default is 0, i.e. no retries.
+func (p *Proxy) SetDialRetries(retries int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.dialRetries = retries
+}
+
+// SetBindAddress restricts the proxy to listening on the given local IP, e.g.
+// a private interface of a multi-homed host, rather than on all interfaces
+// (the default, or if it is empty). It must be called before Serve, which
+// fails if the address is not an IP.
+func (p *Proxy) SetBindAddress(addr string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.bindAddress = addr
+}
+
+// SetAcceptParallelism sets how many goroutines accept connections on the
+// proxy's listener. More than one (the default) can improve accept throughput
+// for connection heavy workloads on machines with many cores. It must be
+// called before Serve.
+func (p *Proxy) SetAcceptParallelism(n int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.acceptParallelism = n
+}
+
+// stopAccepting closes the listener and waits for the accept loop to exit, so
+// that no connection is accepted once it returns. It must be called with l
+// held.
+func (p *Proxy) stopAccepting() {
+	if p.listener == nil {
+		return
 	}
-	return nil
+	p.listener.Close()
+	if p.acceptDone != nil {
+		<-p.acceptDone
+	}
+}
+
+// listen binds the proxy's port, retrying while the address is in use until
+// the bind retry timeout has passed
+func (p *Proxy) listen() (net.Listener, error) {
+	p.l.RLock()
+	deadline := time.Now().Add(p.bindRetry)
+	bindAddress := p.bindAddress
+	p.l.RUnlock()
+	if bindAddress != "" && net.ParseIP(bindAddress) == nil {
+		return nil, fmt.Errorf("Invalid bind address %q", bindAddress)
+	}
+	addr := net.JoinHostPort(bindAddress, strconv.Itoa(int(p.port)))
+
+	backoff := initialBindBackoff
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || time.Now().Add(backoff).After(deadline) {
+			return l, err
+		}
+		log.Warnf("Port %v is in use; retrying bind in %v", p.port, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBindBackoff {
+			backoff = maxBindBackoff
+		}
+	}
+}
+
+// clientIP returns the host portion of a client address, or the whole address
+// if it has no port
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// newConnectionID returns a short random identifier used to correlate the log
+// lines of a single connection
+func newConnectionID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// handle proxies the given client connection to a backend, closing it once
+// either side is done.
+func (p *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+	// a logrus entry must not be logged to from several goroutines at once,
+	// so those started below make their own from these fields
+	connFields := log.Fields{"conn_id": newConnectionID()}
+	logger := log.WithFields(connFields)
+	started := time.Now()
+	port := strconv.Itoa(p.port)
+	connectionsAccepted.WithLabelValues(port).Inc()
+
+	chosenBackend, ok := p.getBackend(conn.RemoteAddr())
+	if !ok && p.saturated() {
+		// not an outage; the backends are just busy
+		logger.Warn("Rejecting connection from ", conn.RemoteAddr(), "; every backend of the proxy for port ", p.port, " is at its share of the connection budget")
+		return
+	}
+	if !ok {
+		logger.Debug("Could not proxy connection; no viable backends; closing connection")
+		p.markUnavailable()
+		p.recordOutcome(conn.RemoteAddr(), outcomeNoBackend)
+		return
+	}
+	p.markAvailable()
+
+	p.l.RLock()
+	retries := p.dialRetries
+	p.l.RUnlock()
+	var failed map[string]bool
+	var backendConn net.Conn
+	var err error
+	for {
+		logger.Info("Proxying request to ", chosenBackend)
+		backendConn, err = p.createConnection(chosenBackend)
+		if err == nil || err == errProxyClosed || err == errConnectionLimit || err == errBackendLimit {
+			break
+		}
+		logger.Error("Could not proxy to " + chosenBackend + ": " + err.Error())
+		p.recordDialFailure()
+		if len(failed) >= retries {
+			break
+		}
+		if failed == nil {
+			failed = make(map[string]bool)
+		}
+		failed[chosenBackend] = true
+		next, ok := p.getBackendExcluding(conn.RemoteAddr(), failed)
+		if !ok {
+			break
+		}
+		chosenBackend = next
+	}
+	defer p.deleteConnection(chosenBackend, backendConn)
+	if err != nil {
+		if err == errProxyClosed {
+			logger.Info("Not proxying to " + chosenBackend + "; the proxy for this port was closed")
+			return
+		}
+		if err == errConnectionLimit {
+			logger.Warn("Rejecting connection from ", conn.RemoteAddr(), "; the proxy for port ", p.port, " is at its maximum number of connections")
+			return
+		}
+		if err == errBackendLimit {
+			logger.Warn("Rejecting connection from ", conn.RemoteAddr(), "; ", chosenBackend, " is at its share of the connection budget")
+			return
+		}
+		p.recordOutcome(conn.RemoteAddr(), outcomeDialError)
+		return
+	}
+	defer backendConn.Close()
+	if err := p.writeProxyHeader(backendConn, conn); err != nil {
+		logger.Error("Could not write the PROXY protocol header to " + chosenBackend + ": " + err.Error())
+		p.recordOutcome(conn.RemoteAddr(), outcomeDialError)
+		return
+	}
+	p.recordOutcome(conn.RemoteAddr(), outcomeSuccess)
+	atomic.AddInt64(&p.counters.connections, 1)
+
+	var fromBackend, fromClient io.Reader = backendConn, conn
+	p.l.RLock()
+	idleTimeout := p.idleTimeout
+	p.l.RUnlock()
+	if idleTimeout > 0 {
+		watch := watchIdle(idleTimeout, func() {
+			log.WithFields(connFields).Info("Closing connection to " + chosenBackend + " after it was idle for " + idleTimeout.String())
+			conn.Close()
+			backendConn.Close()
+		})
+		defer watch.stop()
+		fromBackend, fromClient = watch.reader(backendConn), watch.reader(conn)
+	}
+
+	var bytesIn, bytesOut int64
+	waitBothDone := &sync.WaitGroup{}
+	waitBothDone.Add(1)
+	go func() {
+		var err error
+		bytesIn, err = io.Copy(conn, fromBackend)
+		if err != nil {
+			log.WithFields(connFields).Warn("Error proxying to " + chosenBackend + " while reading from it: " + err.Error())
+			// The backend connection is unusable (e.g. it was closed by
+			// Close), so stop waiting on the client as well
+			conn.Close()
+		}
+		// If we get here, that means
+		waitBothDone.Done()
+	}()
+	waitBothDone.Add(1)
+	go func() {
+		var err error
+		bytesOut, err = io.Copy(backendConn, fromClient)
+		if err != nil {
+			log.WithFields(connFields).Warn("Error proxying to " + chosenBackend + " while writing to it: " + err.Error())
+		}
+		waitBothDone.Done()
+	}()
+	waitBothDone.Wait()
+	logger.Debug("Done proxying to ", chosenBackend)
+	bytesInTotal.WithLabelValues(port).Add(float64(bytesIn))
+	bytesOutTotal.WithLabelValues(port).Add(float64(bytesOut))
+	atomic.AddInt64(&p.counters.bytesFromBackends, bytesIn)
+	atomic.AddInt64(&p.counters.bytesToBackends, bytesOut)
+	record := ConnectionRecord{
+		Client:          conn.RemoteAddr().String(),
+		Backend:         chosenBackend,
+		Started:         started,
+		DurationSeconds: time.Since(started).Seconds(),
+		BytesIn:         bytesIn,
+		BytesOut:        bytesOut,
+	}
+	p.recent.add(record)
+	p.logAccess(connFields, record)
 }
 
 // UpdateBackendHosts sets the list of available backends to the given argument.
-// The argument should be an array of strings formatted as 'ip:port'
+// The argument should be an array of strings formatted as 'ip:port'.
+// IPv4-mapped IPv6 addresses are rewritten as plain IPv4.
+// Repeated backends, e.g. from a task found twice, are only kept once so that
+// they are not chosen more often than the others.
+// If the backends are the same as the current ones, in any order, nothing is
+// changed.
 func (p *Proxy) UpdateBackendHosts(ipPortPairs []string) {
+	normalized := make([]string, 0, len(ipPortPairs))
+	seen := make(map[string]bool, len(ipPortPairs))
+	for _, backend := range ipPortPairs {
+		backend = normalizeBackend(backend)
+		if seen[backend] {
+			continue
+		}
+		seen[backend] = true
+		normalized = append(normalized, backend)
+	}
+	p.updateBackends(normalized, nil)
+}
+
+// updateBackends sets the given normalized backends, and their capacity
+// weights, which may be nil to weigh them equally
+func (p *Proxy) updateBackends(ipPortPairs []string, capacity map[string]int) {
 	p.l.Lock()
-	defer p.l.Unlock()
+	p.capacity = capacity
+	ipPortPairs = p.selectBackends(ipPortPairs)
+	if sameBackends(p.currentBackends, ipPortPairs) {
+		p.l.Unlock()
+		return
+	}
+	old := p.currentBackends
+	p.recordBackendChanges(old, ipPortPairs)
 	p.currentBackends = ipPortPairs
+	if p.strategy == ConsistentHash {
+		p.ring.update(ipPortPairs)
+	}
+	if p.pool != nil {
+		p.pool.update(ipPortPairs)
+	}
+	p.connsLock.Lock()
+	p.recomputePerBackendLimit(len(ipPortPairs))
+	if p.closeOnRemoval {
+		p.closeRemovedBackendConnections(ipPortPairs)
+	}
+	p.connsLock.Unlock()
+	onChange := p.onBackendsChanged
+	p.l.Unlock()
+
+	if len(ipPortPairs) == 0 {
+		p.markUnavailable()
+	} else if len(old) == 0 {
+		p.markAvailable()
+	}
+	// called without the lock held, so that it may use the proxy
+	if onChange != nil {
+		onChange(append([]string(nil), old...), append([]string(nil), ipPortPairs...))
+	}
+}
+
+// Backends returns a copy of the backends the proxy currently routes to, as
+// set by the last UpdateBackendHosts that changed them
+func (p *Proxy) Backends() []string {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return append([]string(nil), p.currentBackends...)
+}
+
+// OnBackendsChanged registers a function to call with the previous and new
+// backends whenever UpdateBackendHosts changes the set of backends. Updates
+// which only reorder the same backends do not call it. It is called
+// synchronously from UpdateBackendHosts, so it should not block for long.
+func (p *Proxy) OnBackendsChanged(fn func(old, new []string)) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.onBackendsChanged = fn
+}
+
+// SetCloseOnBackendRemoval closes connections to a backend as soon as it is
+// removed by UpdateBackendHosts, so that clients fail over to a remaining
+// backend rather than waiting for the removed one to reset them. By default,
+// connections are left to finish, or fail, on their own.
+func (p *Proxy) SetCloseOnBackendRemoval(close bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.closeOnRemoval = close
+}
+
+// closeRemovedBackendConnections closes the connections to any backend not in
+// the given list. It must be called with connsLock held.
+func (p *Proxy) closeRemovedBackendConnections(backends []string) {
+	current := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		current[backend] = true
+	}
+	for conn, backend := range p.activeConnections {
+		if !current[backend] {
+			log.Infof("Closing connection to %v on port %v; the backend was removed", backend, p.port)
+			conn.Close()
+		}
+	}
+}
+
+// sameBackends returns whether the two lists hold the same backends,
+// regardless of order
+func sameBackends(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, backend := range a {
+		counts[backend]++
+	}
+	for _, backend := range b {
+		if counts[backend] == 0 {
+			return false
+		}
+		counts[backend]--
+	}
+	return true
+}
+
+// normalizeBackend rewrites an 'ip:port' backend whose ip is an IPv4-mapped
+// IPv6 address (e.g. '[::ffff:1.2.3.4]:80') as plain IPv4 ('1.2.3.4:80'), since
+// platforms disagree on how to dial the former
+func normalizeBackend(backend string) string {
+	host, port, err := net.SplitHostPort(backend)
+	if err != nil {
+		return backend
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return backend
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return net.JoinHostPort(v4.String(), port)
+	}
+	return backend
 }
 
 // Close closes all current proxying connections and stops listening.
 func (p *Proxy) Close() {
-	log.Info("Cleaning up proxy on address", p.listener.Addr().String())
 	p.l.Lock()
 	defer p.l.Unlock()
+	if p.listener != nil {
+		log.Info("Cleaning up proxy on address", p.listener.Addr().String())
+	} else {
+		log.Info("Cleaning up proxy for port", p.port)
+	}
+	// Stop accepting before anything else, so that no connection is accepted
+	// into a proxy which is already shutting down
+	p.stopAccepting()
+
+	port := strconv.Itoa(p.port)
+	backendCount.Delete(port)
+	for _, backend := range p.currentBackends {
+		dialFailures.Delete(port, backend)
+	}
+	if p.pool != nil {
+		p.pool.close()
+	}
+
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	if p.stopHealthChecks != nil {
+		close(p.stopHealthChecks)
+		p.stopHealthChecks = nil
+	}
 	p.active = false
-	for _, conn := range p.activeConnections {
+	for conn := range p.activeConnections {
 		conn.Close()
 	}
-	p.listener.Close()
+	p.recordActiveConnections()
+}
+
+// CloseGraceful stops listening and waits up to 'timeout' for current proxying
+// connections to finish on their own before closing any that remain.
+func (p *Proxy) CloseGraceful(timeout time.Duration) {
+	p.l.Lock()
+	p.stopAccepting()
+	p.l.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for p.activeConnectionCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	if remaining := p.activeConnectionCount(); remaining > 0 {
+		log.Warnf("Drain timed out on port %v; closing %v remaining connections", p.port, remaining)
+	}
+	p.Close()
+}
+
+func (p *Proxy) activeConnectionCount() int {
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	return len(p.activeConnections)
 }
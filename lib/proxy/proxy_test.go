@@ -0,0 +1,1578 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// echoBackend starts a tcp server which echoes everything it reads and returns
+// its address along with a function to stop it
+func echoBackend(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestTransparentRoutesByOriginalPort(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+
+	realOriginalDestinationPort := originalDestinationPort
+	defer func() { originalDestinationPort = realOriginalDestinationPort }()
+	originalDestinationPort = func(net.Conn) (uint16, error) { return 80, nil }
+
+	p := New(80)
+	p.UpdateBackendHosts([]string{backend})
+	transparent := NewTransparent(0)
+	transparent.Register(80, p)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go transparent.handle(server)
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("Expected echoed 'ping', got %q", buf)
+	}
+}
+
+func TestTransparentClosesUnknownPort(t *testing.T) {
+	realOriginalDestinationPort := originalDestinationPort
+	defer func() { originalDestinationPort = realOriginalDestinationPort }()
+	originalDestinationPort = func(net.Conn) (uint16, error) { return 8080, nil }
+
+	transparent := NewTransparent(0)
+	transparent.Register(80, New(80))
+
+	client, server := net.Pipe()
+	go transparent.handle(server)
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection for an unregistered port to be closed, got %v", err)
+	}
+}
+
+func TestTransparentAppliesAcceptRate(t *testing.T) {
+	realOriginalDestinationPort := originalDestinationPort
+	defer func() { originalDestinationPort = realOriginalDestinationPort }()
+	originalDestinationPort = func(net.Conn) (uint16, error) { return 80, nil }
+
+	// without backends, each connection is closed as soon as it is handled
+	p := New(80)
+	p.SetAcceptRate(10, 1)
+	transparent := NewTransparent(0)
+	transparent.Register(80, p)
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		transparent.handle(server)
+		client.Close()
+	}
+	// the first is handled at once, and each of the others 100ms apart
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the accept rate to delay connections, took %v", elapsed)
+	}
+}
+
+func TestTransparentClosedBeforeListeningStopsServing(t *testing.T) {
+	transparent := NewTransparent(0)
+	transparent.Close()
+	served := make(chan error)
+	go func() { served <- transparent.Serve() }()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Expected Serve to return without an error, got ", err)
+		}
+	case <-time.After(time.Second):
+		transparent.Close()
+		t.Error("Expected Serve to return once closed, even before listening")
+	}
+}
+
+func TestFailureSpikeHandler(t *testing.T) {
+	p := New(0)
+	calls := 0
+	p.SetFailureSpikeHandler(3, func() { calls++ })
+
+	for i := 0; i < 5; i++ {
+		p.recordDialFailure()
+	}
+	if calls != 1 {
+		t.Errorf("Expected the spike handler to be called once per window, was called %v times", calls)
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- header
+	}()
+	p := New(80)
+	p.EnableProxyProtocol()
+	p.UpdateBackendHosts([]string{backend.Addr().String()})
+	defer p.Close()
+
+	// a real TCP connection, so that the header has addresses to describe
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.handle(server)
+
+	clientPort := client.LocalAddr().(*net.TCPAddr).Port
+	listenPort := l.Addr().(*net.TCPAddr).Port
+	expected := "PROXY TCP4 127.0.0.1 127.0.0.1 " + strconv.Itoa(clientPort) + " " + strconv.Itoa(listenPort) + "\r\n"
+	select {
+	case header := <-headers:
+		if header != expected {
+			t.Errorf("Expected the header %q, got %q", expected, header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the backend to be sent a PROXY protocol header")
+	}
+	if !p.Settings().ProxyProtocol {
+		t.Error("Expected the PROXY protocol to be enabled in the settings")
+	}
+}
+
+func TestProxyHeaderFamilies(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	cases := []struct {
+		client, local net.Addr
+		expected      string
+	}{
+		{tcp("10.0.0.1", 50000), tcp("10.0.0.2", 80), "PROXY TCP4 10.0.0.1 10.0.0.2 50000 80\r\n"},
+		{tcp("::ffff:10.0.0.1", 50000), tcp("10.0.0.2", 80), "PROXY TCP4 10.0.0.1 10.0.0.2 50000 80\r\n"},
+		{tcp("2001:db8::1", 50000), tcp("2001:db8::2", 80), "PROXY TCP6 2001:db8::1 2001:db8::2 50000 80\r\n"},
+		{tcp("2001:db8::1", 50000), tcp("10.0.0.2", 80), "PROXY UNKNOWN\r\n"},
+		{&net.UnixAddr{Name: "client"}, tcp("10.0.0.2", 80), "PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		if header := proxyHeader(c.client, c.local); header != c.expected {
+			t.Errorf("Expected %q for %v to %v, got %q", c.expected, c.client, c.local, header)
+		}
+	}
+}
+
+func TestSettingsReflectConfiguration(t *testing.T) {
+	p := New(80)
+	p.SetFailureSpikeHandler(5, func() {})
+
+	settings := p.Settings()
+	if settings.Port != 80 || settings.Policy != "random" || settings.FailureSpikeThreshold != 5 {
+		t.Errorf("Unexpected settings: %+v", settings)
+	}
+}
+
+func TestSlowestConnections(t *testing.T) {
+	p := New(0)
+	for i := 1; i <= recentConnectionsSize+5; i++ {
+		p.recent.add(ConnectionRecord{Backend: "b", DurationSeconds: float64(i % 50), BytesIn: int64(i)})
+	}
+
+	slowest := p.SlowestConnections(3)
+	if len(slowest) != 3 || slowest[0].DurationSeconds != 49 || slowest[2].DurationSeconds != 49 {
+		t.Errorf("Unexpected slowest connections: %+v", slowest)
+	}
+	largest := p.LargestConnections(1)
+	if len(largest) != 1 || largest[0].BytesIn != recentConnectionsSize+5 {
+		t.Errorf("Unexpected largest connections: %+v", largest)
+	}
+}
+
+func TestConnectionBudgetIsSplitBetweenBackends(t *testing.T) {
+	p := New(0)
+	p.SetConnectionBudget(10)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	if limit := p.Settings().PerBackendLimit; limit != 5 {
+		t.Errorf("Expected a per backend limit of 5, got %v", limit)
+	}
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"})
+	if limit := p.Settings().PerBackendLimit; limit != 4 {
+		t.Errorf("Expected a per backend limit of 4, got %v", limit)
+	}
+}
+
+func TestBackendAtLimitIsNotChosen(t *testing.T) {
+	p := New(0)
+	p.SetConnectionBudget(2)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.backendConns["10.0.0.1:80"] = 1
+
+	for i := 0; i < 20; i++ {
+		if backend, _ := p.getBackend(nil); backend != "10.0.0.2:80" {
+			t.Fatalf("Expected only the backend under its limit to be chosen, got %v", backend)
+		}
+	}
+	p.backendConns["10.0.0.2:80"] = 1
+	if _, ok := p.getBackend(nil); ok {
+		t.Error("Expected no backend when all are at their limit")
+	}
+}
+
+func TestSaturatedHealthyBackendDoesNotMakeWayForUnhealthyOnes(t *testing.T) {
+	p := New(0)
+	p.SetConnectionBudget(2)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.connsLock.Lock()
+	p.unhealthy = map[string]bool{"10.0.0.2:80": true}
+	p.backendConns["10.0.0.1:80"] = 1
+	p.connsLock.Unlock()
+
+	if backend, ok := p.getBackend(nil); ok {
+		t.Errorf("Expected no backend while the healthy one is at its limit, got %v", backend)
+	}
+	p.connsLock.Lock()
+	p.backendConns["10.0.0.1:80"] = 0
+	p.connsLock.Unlock()
+	if backend, ok := p.getBackend(nil); !ok || backend != "10.0.0.1:80" {
+		t.Errorf("Expected the healthy backend once under its limit, got %v %v", backend, ok)
+	}
+}
+
+func TestOutcomesAreCountedByClientSubnet(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	p := New(9999)
+	p.SetClientSubnets([]*net.IPNet{subnet})
+
+	p.recordOutcome(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, outcomeSuccess)
+	p.recordOutcome(&net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 1}, outcomeSuccess)
+	p.recordOutcome(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}, outcomeDialError)
+
+	if count := connectionsBySubnet.WithLabelValues("9999", "10.1.0.0/16", outcomeSuccess).Value(); count != 2 {
+		t.Errorf("Expected 2 successes from the subnet, got %v", count)
+	}
+	if count := connectionsBySubnet.WithLabelValues("9999", otherSubnet, outcomeDialError).Value(); count != 1 {
+		t.Errorf("Expected 1 failure from another subnet, got %v", count)
+	}
+}
+
+func TestBindIsRetriedWhilePortIsInUse(t *testing.T) {
+	holder, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := holder.Addr().(*net.TCPAddr).Port
+
+	p := New(uint16(port))
+	if _, err := p.listen(); err == nil {
+		t.Fatal("Expected bind to fail without retries while the port is in use")
+	}
+
+	p.SetBindRetryTimeout(5 * time.Second)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		holder.Close()
+	}()
+	l, err := p.listen()
+	if err != nil {
+		t.Fatal("Expected bind to succeed once the port was released: ", err)
+	}
+	l.Close()
+}
+
+func TestUpdateBackendHostsNormalizesIPv4MappedAddresses(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"[::ffff:10.0.0.1]:8080", "10.0.0.2:8080", "[2001:db8::1]:8080"})
+
+	expected := []string{"10.0.0.1:8080", "10.0.0.2:8080", "[2001:db8::1]:8080"}
+	for i, backend := range p.currentBackends {
+		if backend != expected[i] {
+			t.Errorf("Expected backend %v to be %v, was %v", i, expected[i], backend)
+		}
+	}
+}
+
+func TestUpdateBackendHostsRemovesDuplicates(t *testing.T) {
+	p := New(80)
+	// the mapped address is the same backend as the plain one once normalized
+	p.UpdateBackendHosts([]string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "[::ffff:10.0.0.2]:8080"})
+
+	expected := []string{"10.0.0.1:8080", "10.0.0.2:8080"}
+	if !reflect.DeepEqual(p.currentBackends, expected) {
+		t.Errorf("Expected each backend once, %v, got %v", expected, p.currentBackends)
+	}
+	for _, w := range p.Weights() {
+		if w.Weight != 0.5 {
+			t.Errorf("Expected both backends to be chosen equally, got %+v", w)
+		}
+	}
+}
+
+func TestBackendsReturnsACopy(t *testing.T) {
+	p := New(80)
+	if backends := p.Backends(); len(backends) != 0 {
+		t.Errorf("Expected no backends, got %v", backends)
+	}
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.UpdateBackendHosts([]string{"10.0.0.3:80"})
+
+	backends := p.Backends()
+	if !reflect.DeepEqual(backends, []string{"10.0.0.3:80"}) {
+		t.Errorf("Expected the last backends, got %v", backends)
+	}
+	backends[0] = "10.0.0.4:80"
+	if current := p.Backends(); !reflect.DeepEqual(current, []string{"10.0.0.3:80"}) {
+		t.Errorf("Expected changes to the copy not to affect the proxy, got %v", current)
+	}
+}
+
+// openConnection proxies a client connection through p and waits for it to be
+// established to a backend
+func openConnection(t *testing.T, p *Proxy) net.Conn {
+	client, server := net.Pipe()
+	go p.handle(server)
+	client.Write([]byte("x"))
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCloseGracefulWaitsForConnections(t *testing.T) {
+	// a backend which echoes one byte and then hangs up after a short while,
+	// like the client does below
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.CopyN(conn, conn, 1)
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+	p := New(80)
+	p.UpdateBackendHosts([]string{l.Addr().String()})
+	client := openConnection(t, p)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		client.Close()
+	}()
+
+	started := time.Now()
+	p.CloseGraceful(5 * time.Second)
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected drain to end when the connection closed, took %v", elapsed)
+	}
+}
+
+func TestCloseGracefulClosesConnectionsAfterTimeout(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(80)
+	p.UpdateBackendHosts([]string{backend})
+	client := openConnection(t, p)
+	defer client.Close()
+
+	p.CloseGraceful(100 * time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection to be closed after the drain timeout, got %v", err)
+	}
+}
+
+func TestUpdateBackendHostsWithSameBackendsIsNoop(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	before := p.currentBackends
+
+	p.UpdateBackendHosts([]string{"10.0.0.2:80", "10.0.0.1:80"})
+	if &p.currentBackends[0] != &before[0] {
+		t.Error("Expected backends not to be replaced when unchanged")
+	}
+
+	p.UpdateBackendHosts([]string{"10.0.0.2:80", "10.0.0.3:80"})
+	if p.currentBackends[1] != "10.0.0.3:80" {
+		t.Errorf("Expected backends to be replaced when changed, got %v", p.currentBackends)
+	}
+}
+
+func TestDialsWaitForAFreeSlot(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	SetMaxConcurrentDials(1)
+	defer SetMaxConcurrentDials(0)
+
+	// take the only slot, as an in-flight dial would
+	dialSlots.slots <- struct{}{}
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := dial(backend, nil, defaultDialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	select {
+	case <-dialed:
+		t.Fatal("Expected dial to wait while no slot is free")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-dialSlots.slots
+	select {
+	case err := <-dialed:
+		if err != nil {
+			t.Error("Expected dial to succeed once a slot was free: ", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected dial to proceed once a slot was free")
+	}
+}
+
+func TestCloseStopsAcceptLoop(t *testing.T) {
+	testCloseStopsAcceptLoop(t, 1)
+}
+
+func TestCloseStopsParallelAcceptLoops(t *testing.T) {
+	testCloseStopsAcceptLoop(t, 4)
+}
+
+func testCloseStopsAcceptLoop(t *testing.T, parallelism int) {
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	p := New(uint16(port))
+	p.SetAcceptParallelism(parallelism)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve() }()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal("Proxy never started listening: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	p.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Expected Serve to return cleanly once closed: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return once closed")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+		t.Error("Expected connections to be refused once closed")
+	}
+}
+
+func TestBackendChangesAreCounted(t *testing.T) {
+	p := New(9998)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.UpdateBackendHosts([]string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"})
+
+	if added := backendAdditions.WithLabelValues("9998").Value(); added != 4 {
+		t.Errorf("Expected 4 additions, got %v", added)
+	}
+	if removed := backendRemovals.WithLabelValues("9998").Value(); removed != 1 {
+		t.Errorf("Expected 1 removal, got %v", removed)
+	}
+	if count := backendCount.WithLabelValues("9998").Value(); count != 3 {
+		t.Errorf("Expected 3 backends, got %v", count)
+	}
+}
+
+func TestOutagesAreReported(t *testing.T) {
+	p := New(9997)
+	client, server := net.Pipe()
+	defer client.Close()
+	p.handle(server)
+
+	if count := outages.WithLabelValues("9997").Value(); count != 1 {
+		t.Errorf("Expected an outage to be counted, got %v", count)
+	}
+	if up := available.WithLabelValues("9997").Value(); up != 0 {
+		t.Errorf("Expected proxy to be unavailable, got %v", up)
+	}
+
+	p.markAvailable()
+	p.markUnavailable()
+	if count := outages.WithLabelValues("9997").Value(); count != 2 {
+		t.Errorf("Expected a second outage to be counted, got %v", count)
+	}
+	if p.availability.unreported != 1 {
+		t.Errorf("Expected the second outage within a minute not to be logged, got %v unreported", p.availability.unreported)
+	}
+}
+
+func TestSaturatedBackendsAreNotAnOutage(t *testing.T) {
+	p := New(9993)
+	p.SetConnectionBudget(1)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80"})
+	spikes := 0
+	p.SetFailureSpikeHandler(1, func() { spikes++ })
+	p.connsLock.Lock()
+	p.backendConns["10.0.0.1:80"] = 1
+	p.connsLock.Unlock()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	p.handle(server)
+	if count := outages.WithLabelValues("9993").Value(); count != 0 {
+		t.Errorf("Expected no outage while the backends are at their limit, got %v", count)
+	}
+	if up := available.WithLabelValues("9993").Value(); up != 1 {
+		t.Errorf("Expected proxy to stay available, got %v", up)
+	}
+
+	// as when another connection takes the last of the budget between
+	// choosing the backend and dialing it
+	if _, err := p.createConnection("10.0.0.1:80"); err != errBackendLimit {
+		t.Errorf("Expected the backend limit error, got %v", err)
+	}
+	if spikes != 0 {
+		t.Errorf("Expected no dial failures to be recorded, got %v spikes", spikes)
+	}
+}
+
+func TestOutageIsReportedWhenBackendsRunOut(t *testing.T) {
+	p := New(9996)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80"})
+	if up := available.WithLabelValues("9996").Value(); up != 1 {
+		t.Errorf("Expected proxy to be available, got %v", up)
+	}
+
+	p.UpdateBackendHosts(nil)
+	if count := outages.WithLabelValues("9996").Value(); count != 1 {
+		t.Errorf("Expected the outage to be counted without any connection, got %v", count)
+	}
+	if up := available.WithLabelValues("9996").Value(); up != 0 {
+		t.Errorf("Expected proxy to be unavailable, got %v", up)
+	}
+
+	p.UpdateBackendHosts([]string{"10.0.0.2:80"})
+	if up := available.WithLabelValues("9996").Value(); up != 1 {
+		t.Errorf("Expected proxy to be available again, got %v", up)
+	}
+}
+
+func TestOutageIsCarriedOverWhenPortIsRemoved(t *testing.T) {
+	m := NewManager(func(port uint16) *Proxy {
+		p := New(port)
+		p.SetBindAddress("127.0.0.1")
+		return p
+	}, nil)
+	defer m.Drain(0)
+	port := freePort(t)
+	label := strconv.Itoa(int(port))
+	if _, err := m.EnsurePort(port, "tcp", map[string]int{"10.0.0.1:80": 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m.RemovePort(port)
+	if count := outages.WithLabelValues(label).Value(); count != 1 {
+		t.Errorf("Expected removing the port to count an outage, got %v", count)
+	}
+	p, err := m.EnsurePort(port, "tcp", map[string]int{"10.0.0.2:80": 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.availability.down || !p.availability.reported {
+		t.Errorf("Expected the new proxy to have recovered from a reported outage, down %v, reported %v", p.availability.down, p.availability.reported)
+	}
+	if up := available.WithLabelValues(label).Value(); up != 1 {
+		t.Errorf("Expected the port to be available again, got %v", up)
+	}
+}
+
+func TestLongUnreportedOutageRecoveryIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	p := New(9995)
+	p.markUnavailable()
+	p.markAvailable()
+	if !strings.Contains(buf.String(), "backends_recovered") {
+		t.Error("Expected the recovery from a logged outage to be logged")
+	}
+
+	// the second outage within a minute is not logged, nor is its recovery
+	buf.Reset()
+	p.markUnavailable()
+	p.markAvailable()
+	if strings.Contains(buf.String(), "backends_recovered") {
+		t.Errorf("Expected the recovery from a short unlogged outage not to be logged, got %q", buf.String())
+	}
+
+	p.markUnavailable()
+	p.availability.outageStart = time.Now().Add(-outageLogInterval)
+	p.markAvailable()
+	if !strings.Contains(buf.String(), "backends_recovered") {
+		t.Errorf("Expected the recovery from a long unlogged outage to be logged, got %q", buf.String())
+	}
+}
+
+// refusingBackend returns an address which refuses connections
+func refusingBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestDialRetriesAnotherBackend(t *testing.T) {
+	live, stop := echoBackend(t)
+	defer stop()
+	dead := refusingBackend(t)
+	p := New(80)
+	p.SetErrorDecay(0)
+	p.SetDialRetries(1)
+	p.UpdateBackendHosts([]string{dead, live})
+	defer p.Close()
+
+	// each connection is as likely to try the dead backend first as not, but
+	// should always end up on the live one
+	for i := 0; i < 20; i++ {
+		openConnection(t, p).Close()
+	}
+}
+
+func TestRetryFallsBackToUnhealthyBackendOnceHealthyOnesAreExcluded(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.connsLock.Lock()
+	p.unhealthy = map[string]bool{"10.0.0.2:80": true}
+	p.connsLock.Unlock()
+
+	// the healthy backend failed to dial, so the unhealthy one is better
+	// than none
+	backend, ok := p.getBackendExcluding(nil, map[string]bool{"10.0.0.1:80": true})
+	if !ok || backend != "10.0.0.2:80" {
+		t.Errorf("Expected the unhealthy backend to be retried, got %v %v", backend, ok)
+	}
+
+	p.SetHealthFailClosed(true)
+	if backend, ok := p.getBackendExcluding(nil, map[string]bool{"10.0.0.1:80": true}); ok {
+		t.Errorf("Expected no backend when failing closed, got %v", backend)
+	}
+}
+
+func TestUnhealthyBackendsAreSkipped(t *testing.T) {
+	healthy, stop := echoBackend(t)
+	defer stop()
+	refusing := refusingBackend(t)
+
+	p := New(80)
+	p.UpdateBackendHosts([]string{healthy, refusing})
+	p.EnableHealthChecks(10*time.Millisecond, 2)
+	defer p.Close()
+
+	for i := 0; ; i++ {
+		p.connsLock.Lock()
+		evicted := p.unhealthy[refusing]
+		p.connsLock.Unlock()
+		if evicted {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected the refusing backend to be marked unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		if backend, _ := p.getBackend(nil); backend != healthy {
+			t.Fatalf("Expected only the healthy backend to be chosen, got %v", backend)
+		}
+	}
+}
+
+func TestUnhealthyBackendsAreUsedWhenAllAreDown(t *testing.T) {
+	refusing := refusingBackend(t)
+	p := New(80)
+	p.UpdateBackendHosts([]string{refusing})
+	p.EnableHealthChecks(time.Hour, 1)
+	defer p.Close()
+	p.recordHealth([]string{refusing}, []bool{false})
+
+	if backend, ok := p.getBackend(nil); !ok || backend != refusing {
+		t.Errorf("Expected to fall back to the unhealthy backend, got %v", backend)
+	}
+}
+
+func TestNoBackendIsUsedWhenAllAreDownAndFailingClosed(t *testing.T) {
+	healthy, stop := echoBackend(t)
+	defer stop()
+	refusing := refusingBackend(t)
+	p := New(80)
+	p.UpdateBackendHosts([]string{healthy, refusing})
+	p.EnableHealthChecks(time.Hour, 1)
+	p.SetHealthFailClosed(true)
+	defer p.Close()
+	if !p.Settings().HealthFailClosed {
+		t.Error("Expected failing closed in the settings")
+	}
+
+	// with one backend healthy, failing closed makes no difference
+	p.recordHealth([]string{healthy, refusing}, []bool{true, false})
+	for i := 0; i < 20; i++ {
+		if backend, ok := p.getBackend(nil); !ok || backend != healthy {
+			t.Fatalf("Expected the healthy backend to be chosen, got %v", backend)
+		}
+	}
+
+	p.recordHealth([]string{healthy, refusing}, []bool{false, false})
+	if backend, ok := p.getBackend(nil); ok {
+		t.Errorf("Expected no backend while all are unhealthy, got %v", backend)
+	}
+
+	p.recordHealth([]string{healthy, refusing}, []bool{true, false})
+	if backend, ok := p.getBackend(nil); !ok || backend != healthy {
+		t.Errorf("Expected the recovered backend to be chosen, got %v", backend)
+	}
+}
+
+func TestBackendsWithRecentErrorsAreChosenLess(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.connsLock.Lock()
+	for i := 0; i < 9; i++ {
+		p.recordBackendError("10.0.0.2:80")
+	}
+	p.connsLock.Unlock()
+
+	chosen := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		backend, _ := p.getBackend(nil)
+		chosen[backend]++
+	}
+	// with 9 recent errors, the flaky backend has a tenth of the weight
+	if chosen["10.0.0.1:80"] < 800 {
+		t.Errorf("Expected the healthy backend to get most connections, got %v", chosen)
+	}
+
+	p.SetErrorDecay(0)
+	p.connsLock.Lock()
+	p.recordBackendError("10.0.0.2:80")
+	p.connsLock.Unlock()
+	for _, w := range p.Weights() {
+		if w.Weight != 0.5 {
+			t.Errorf("Expected errors to be ignored without decay, got %+v", w)
+		}
+	}
+}
+
+func TestBackendsAreChosenByCapacity(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHostsWeighted(map[string]int{"10.0.0.1:80": 256, "10.0.0.2:80": 512})
+
+	chosen := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		backend, _ := p.getBackend(nil)
+		chosen[backend]++
+	}
+	// the larger backend should get about 2000 connections, and the other 1000
+	if ratio := float64(chosen["10.0.0.2:80"]) / float64(chosen["10.0.0.1:80"]); ratio < 1.6 || ratio > 2.5 {
+		t.Errorf("Expected the backend with double the weight to be chosen about twice as often, got %v", chosen)
+	}
+	for _, w := range p.Weights() {
+		if w.Backend == "10.0.0.2:80" && math.Abs(w.Weight-2.0/3) > 1e-9 {
+			t.Errorf("Expected a weight of 2/3, got %+v", w)
+		}
+	}
+
+	// unweighted updates weigh every backend equally again
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	for _, w := range p.Weights() {
+		if w.Weight != 0.5 {
+			t.Errorf("Expected equal weights, got %+v", w)
+		}
+	}
+}
+
+func TestRecentErrorsDecay(t *testing.T) {
+	p := New(80)
+	p.SetErrorDecay(time.Second)
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+	now := time.Now()
+	p.backendErrors["10.0.0.1:80"] = &backendErrors{count: 4, updated: now.Add(-2 * time.Second)}
+	if errs := p.recentErrors("10.0.0.1:80", now); math.Abs(errs-1) > 1e-9 {
+		t.Errorf("Expected 4 errors to decay to 1 after two halvings, got %v", errs)
+	}
+}
+
+func TestDrainingBackendsAreUsedLast(t *testing.T) {
+	p := New(80)
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.SetDrainingBackends([]string{"10.0.0.2:80"})
+	for i := 0; i < 20; i++ {
+		if backend, _ := p.getBackend(nil); backend != "10.0.0.1:80" {
+			t.Fatalf("Expected the draining backend not to be chosen, got %v", backend)
+		}
+	}
+
+	p.SetDrainingBackends([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	if _, ok := p.getBackend(nil); !ok {
+		t.Error("Expected to fall back to draining backends when there are no others")
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	p := New(uint16(port))
+	p.SetBindAddress("127.0.0.1")
+	defer p.Close()
+	go p.Serve()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal("Proxy never started listening: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.l.RLock()
+	addr := p.listener.Addr().(*net.TCPAddr)
+	p.l.RUnlock()
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected to listen on the bind address, got %v", addr)
+	}
+}
+
+func TestIPv6ListenerAndBackend(t *testing.T) {
+	backend, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	free, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	p := New(uint16(port))
+	p.SetBindAddress("::1")
+	p.UpdateBackendHosts([]string{backend.Addr().String()})
+	defer p.Close()
+	go p.Serve()
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal("Proxy never started listening: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Error("Expected to be proxied to the IPv6 backend: ", err)
+	}
+}
+
+// selfSignedTLS returns a server config with a certificate for 127.0.0.1 and a
+// client config which trusts it
+func selfSignedTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots}
+}
+
+func TestTLSTermination(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	serverConfig, clientConfig := selfSignedTLS(t)
+	p := New(uint16(port))
+	p.SetBindAddress("127.0.0.1")
+	p.EnableTLS(serverConfig)
+	p.UpdateBackendHosts([]string{backend})
+	defer p.Close()
+	go p.Serve()
+	var conn *tls.Conn
+	for i := 0; ; i++ {
+		conn, err = tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), clientConfig)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal("Could not connect over TLS: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello" {
+		t.Errorf("Expected the plaintext backend to echo through TLS, got %q: %v", echoed, err)
+	}
+	if !p.Settings().TLS {
+		t.Error("Expected settings to report TLS")
+	}
+}
+
+func TestTransparentTerminatesTLS(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+
+	realOriginalDestinationPort := originalDestinationPort
+	defer func() { originalDestinationPort = realOriginalDestinationPort }()
+	originalDestinationPort = func(net.Conn) (uint16, error) { return 443, nil }
+
+	serverConfig, clientConfig := selfSignedTLS(t)
+	p := New(443)
+	p.EnableTLS(serverConfig)
+	p.UpdateBackendHosts([]string{backend})
+	transparent := NewTransparent(0)
+	transparent.Register(443, p)
+
+	client, server := net.Pipe()
+	go transparent.handle(server)
+	clientConfig.ServerName = "127.0.0.1"
+	conn := tls.Client(client, clientConfig)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	go conn.Write([]byte("hello"))
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello" {
+		t.Errorf("Expected the plaintext backend to echo through TLS, got %q: %v", echoed, err)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	serverConfig, clientConfig := selfSignedTLS(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	p := New(80)
+	p.EnableBackendTLS(clientConfig)
+	p.UpdateBackendHosts([]string{l.Addr().String()})
+	client := openConnection(t, p)
+	client.Close()
+	p.Close()
+	if !p.Settings().BackendTLS {
+		t.Error("Expected settings to report backend TLS")
+	}
+}
+
+func TestOnBackendsChangedOnlyFiresOnChanges(t *testing.T) {
+	p := New(80)
+	var calls [][]string
+	p.OnBackendsChanged(func(old, new []string) {
+		calls = append(calls, new)
+	})
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.UpdateBackendHosts([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	p.UpdateBackendHosts([]string{"10.0.0.2:80", "10.0.0.1:80"})
+	if len(calls) != 1 {
+		t.Fatalf("Expected one call for one change, got %v", calls)
+	}
+	p.UpdateBackendHosts([]string{"10.0.0.2:80"})
+	if len(calls) != 2 || !reflect.DeepEqual(calls[1], []string{"10.0.0.2:80"}) {
+		t.Errorf("Expected a call for the removed backend, got %v", calls)
+	}
+}
+
+func TestCloseOnBackendRemoval(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	other, stopOther := echoBackend(t)
+	defer stopOther()
+	p := New(80)
+	p.SetCloseOnBackendRemoval(true)
+	p.UpdateBackendHosts([]string{backend})
+	client := openConnection(t, p)
+	defer client.Close()
+
+	p.UpdateBackendHosts([]string{other})
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to the removed backend to be closed, got %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	// take the only dial slot, so that the dial hangs until it times out
+	// whatever the network does
+	SetMaxConcurrentDials(1)
+	defer SetMaxConcurrentDials(0)
+	dialSlots.slots <- struct{}{}
+	defer func() { <-dialSlots.slots }()
+
+	p := New(80)
+	p.SetDialTimeout(200 * time.Millisecond)
+	started := time.Now()
+	conn, err := p.createConnection(backend)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected the dial to time out")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the dial to time out after about 200ms, took %v", elapsed)
+	}
+}
+
+func TestInvalidBindAddress(t *testing.T) {
+	p := New(0)
+	p.SetBindAddress("not-an-ip")
+	if err := p.Serve(); err == nil {
+		t.Error("Expected an error for an invalid bind address")
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(9995)
+	p.UpdateBackendHosts([]string{backend})
+
+	client := openConnection(t, p)
+	if active := activeConnectionsGauge.WithLabelValues("9995").Value(); active != 1 {
+		t.Errorf("Expected 1 active connection, got %v", active)
+	}
+	client.Close()
+	p.Close()
+	for i := 0; p.activeConnectionCount() > 0; i++ {
+		if i == 50 {
+			t.Fatal("Connection was never cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if accepted := connectionsAccepted.WithLabelValues("9995").Value(); accepted != 1 {
+		t.Errorf("Expected 1 accepted connection, got %v", accepted)
+	}
+	if in := bytesInTotal.WithLabelValues("9995").Value(); in != 1 {
+		t.Errorf("Expected 1 byte in, got %v", in)
+	}
+
+	refusing := refusingBackend(t)
+	p = New(9994)
+	p.UpdateBackendHosts([]string{refusing})
+	p.handle(&net.TCPConn{})
+	if failures := dialFailures.WithLabelValues("9994", refusing).Value(); failures != 1 {
+		t.Errorf("Expected 1 dial failure, got %v", failures)
+	}
+	// a removed backend's failures are no longer reported
+	p.UpdateBackendHosts(nil)
+	if failures := dialFailures.WithLabelValues("9994", refusing).Value(); failures != 0 {
+		t.Errorf("Expected a removed backend's dial failures to be deleted, got %v", failures)
+	}
+}
+
+func TestStatsCountBytes(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(80)
+	p.UpdateBackendHosts([]string{backend})
+
+	client, server := net.Pipe()
+	go p.handle(server)
+	payload := bytes.Repeat([]byte("x"), 1000)
+	go client.Write(payload)
+	if _, err := io.ReadFull(client, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.ActiveConnections != 1 || stats.TotalConnections != 1 {
+		t.Errorf("Expected 1 active connection of 1 in total, got %+v", stats)
+	}
+	client.Close()
+	p.Close()
+	for i := 0; p.activeConnectionCount() > 0; i++ {
+		if i == 50 {
+			t.Fatal("Connection was never cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := p.Stats()
+	if stats.BytesToBackends != 1000 || stats.BytesFromBackends != 1000 {
+		t.Errorf("Expected 1000 bytes each way, got %+v", stats)
+	}
+	if stats.TotalConnections != 1 || stats.ActiveConnections != 0 {
+		t.Errorf("Expected 1 finished connection, got %+v", stats)
+	}
+}
+
+func TestIdleConnectionsAreClosed(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(80)
+	p.UpdateBackendHosts([]string{backend})
+	p.SetIdleTimeout(50 * time.Millisecond)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.handle(server)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	started := time.Now()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the connection to stay open until it was idle for the timeout, closed after %v", elapsed)
+	}
+}
+
+func TestIdleWatchFiringImmediately(t *testing.T) {
+	// a timeout short enough for the timer to fire before watchIdle returns
+	idle := make(chan struct{})
+	w := watchIdle(time.Nanosecond, func() { close(idle) })
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Error("Expected the watch to find the connection idle")
+	}
+	w.stop()
+}
+
+func TestStoppedIdleWatchDoesNotFire(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	w := watchIdle(10*time.Millisecond, func() { fired <- struct{}{} })
+	w.stop()
+	select {
+	case <-fired:
+		t.Error("Expected a stopped watch not to fire")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxConnectionsRejectsExtraConnections(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(80)
+	p.UpdateBackendHosts([]string{backend})
+	p.SetMaxConnections(2)
+	defer p.Close()
+
+	first := openConnection(t, p)
+	defer first.Close()
+	second := openConnection(t, p)
+	defer second.Close()
+
+	third, server := net.Pipe()
+	go p.handle(server)
+	third.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := third.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the third connection to be closed, got %v", err)
+	}
+
+	for _, conn := range []net.Conn{first, second} {
+		conn.Write([]byte("y"))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Errorf("Expected the first connections to stay open, got %v", err)
+		}
+	}
+}
+
+func TestMaxBackends(t *testing.T) {
+	p := New(80)
+	p.SetMaxBackends(2)
+	p.UpdateBackendHosts([]string{"10.0.0.5:80", "10.0.0.3:80", "10.0.0.1:80", "10.0.0.4:80", "10.0.0.2:80"})
+	chosen := map[string]bool{"10.0.0.1:80": true, "10.0.0.2:80": true}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		backend, _ := p.getBackend(nil)
+		if !chosen[backend] {
+			t.Fatalf("Expected only the 2 chosen backends, got %v", backend)
+		}
+		seen[backend] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both chosen backends to be used, got %v", seen)
+	}
+
+	// chosen backends are kept while present, even when others sort first
+	p.UpdateBackendHosts([]string{"10.0.0.0:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"})
+	var backends []string
+	for _, weight := range p.Weights() {
+		backends = append(backends, weight.Backend)
+	}
+	if expected := []string{"10.0.0.2:80", "10.0.0.0:80"}; !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Expected 10.0.0.2:80 to be kept and 10.0.0.0:80 to replace 10.0.0.1:80, got %v", backends)
+	}
+	if max := p.Settings().MaxBackends; max != 2 {
+		t.Errorf("Expected max backends of 2 in the settings, got %v", max)
+	}
+}
+
+// accessLogHook collects the fields of every access log line
+type accessLogHook struct {
+	l       sync.Mutex
+	entries []log.Fields
+}
+
+func (h *accessLogHook) Levels() []log.Level {
+	return []log.Level{log.InfoLevel}
+}
+
+func (h *accessLogHook) Fire(entry *log.Entry) error {
+	if entry.Message != "Connection closed" {
+		return nil
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.entries = append(h.entries, entry.Data)
+	return nil
+}
+
+func (h *accessLogHook) logged() []log.Fields {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return append([]log.Fields(nil), h.entries...)
+}
+
+func TestAccessLog(t *testing.T) {
+	// the hook is added to a logger of the proxy's own, rather than the
+	// standard logger every other test logs to
+	hook := &accessLogHook{}
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	logger.Hooks.Add(hook)
+	backend, stop := echoBackend(t)
+	defer stop()
+	p := New(80)
+	p.accessLogger = logger
+	p.UpdateBackendHosts([]string{backend})
+	p.SetAccessLog(true)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.handle(server)
+		close(done)
+	}()
+	payload := bytes.Repeat([]byte("x"), 100)
+	go client.Write(payload)
+	if _, err := io.ReadFull(client, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	p.Close()
+	<-done
+
+	entries := hook.logged()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one access log line, got %v", entries)
+	}
+	entry := entries[0]
+	if entry["backend"] != backend || entry["bytes_in"] != int64(100) || entry["bytes_out"] != int64(100) {
+		t.Errorf("Expected the backend and 100 bytes each way, got %v", entry)
+	}
+	if _, ok := entry["client"]; !ok {
+		t.Errorf("Expected the client's address, got %v", entry)
+	}
+	if _, ok := entry["conn_id"]; !ok {
+		t.Errorf("Expected the connection's id, got %v", entry)
+	}
+
+	// disabled, nothing more is logged
+	p.SetAccessLog(false)
+	p.logAccess(nil, ConnectionRecord{Backend: backend})
+	if entries := hook.logged(); len(entries) != 1 {
+		t.Errorf("Expected no access log lines once disabled, got %v", entries)
+	}
+}
+
+func TestConnectionPoolIsUsedBeforeDialing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var acceptedLock sync.Mutex
+	var accepted []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			acceptedLock.Lock()
+			accepted = append(accepted, conn.RemoteAddr().String())
+			acceptedLock.Unlock()
+		}
+	}()
+	acceptedAddrs := func() []string {
+		acceptedLock.Lock()
+		defer acceptedLock.Unlock()
+		return append([]string(nil), accepted...)
+	}
+	waitForPooled := func(p *Proxy, backend string) {
+		for i := 0; p.pool.idleCount(backend) == 0; i++ {
+			if i == 50 {
+				t.Fatal("No connection was ever pooled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	backend := l.Addr().String()
+	p := New(80)
+	defer p.Close()
+	p.EnableConnectionPool(1)
+	p.UpdateBackendHosts([]string{backend})
+	if settings := p.Settings(); settings.ConnectionPool != 1 {
+		t.Errorf("Expected a pool of 1 in the settings, got %+v", settings)
+	}
+
+	for i := 0; i < 2; i++ {
+		waitForPooled(p, backend)
+		// the pooled connection was dialed, and accepted, ahead of time
+		dialedAhead := acceptedAddrs()
+		conn, err := p.createConnection(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !contains(dialedAhead, conn.LocalAddr().String()) {
+			t.Errorf("Expected connection %v to be one dialed ahead of time, %v", i, dialedAhead)
+		}
+		p.deleteConnection(backend, conn)
+		conn.Close()
+	}
+
+	// removing the backend closes its pooled connections
+	p.UpdateBackendHosts([]string{"127.0.0.1:1"})
+	if n := p.pool.idleCount(backend); n != 0 {
+		t.Errorf("Expected no pooled connections to a removed backend, got %v", n)
+	}
+}
+
+func TestPreferPooledBackends(t *testing.T) {
+	p := New(80)
+	defer p.Close()
+	backends := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	p.UpdateBackendHosts(backends)
+	p.SetPreferPooledBackends(true)
+
+	// with no pool, or nothing pooled yet, every backend is still chosen
+	chosen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		backend, _ := p.getBackend(nil)
+		chosen[backend] = true
+	}
+	if len(chosen) != len(backends) {
+		t.Errorf("Expected all backends to be chosen without a pool, got %v", chosen)
+	}
+
+	// only 10.0.0.2:80 can be dialed, so only it has a connection pooled
+	pool := newConnPool(1, time.Minute, func(backend string) (net.Conn, error) {
+		if backend != "10.0.0.2:80" {
+			return nil, errors.New("refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	defer pool.close()
+	pool.update(backends)
+	for i := 0; pool.idleCount("10.0.0.2:80") == 0; i++ {
+		if i == 50 {
+			t.Fatal("No connection was ever pooled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.l.Lock()
+	p.pool = pool
+	p.l.Unlock()
+
+	for i := 0; i < 20; i++ {
+		if backend, _ := p.getBackend(nil); backend != "10.0.0.2:80" {
+			t.Fatalf("Expected the backend with a pooled connection, got %v", backend)
+		}
+	}
+	if !p.Settings().PreferPooledBackends {
+		t.Error("Expected the preference in the settings")
+	}
+
+	p.SetPreferPooledBackends(false)
+	chosen = make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		backend, _ := p.getBackend(nil)
+		chosen[backend] = true
+	}
+	if len(chosen) != len(backends) {
+		t.Errorf("Expected all backends to be chosen without the preference, got %v", chosen)
+	}
+}
+
+func TestAcceptRateSmoothsNewConnections(t *testing.T) {
+	backend, stop := echoBackend(t)
+	defer stop()
+	port := freePort(t)
+	p := New(port)
+	p.UpdateBackendHosts([]string{backend})
+	defer p.Close()
+	go p.Serve()
+	if !echoThrough(port) {
+		t.Fatal("Expected the proxy to be serving")
+	}
+
+	p.SetAcceptRate(20, 2)
+	if settings := p.Settings(); settings.AcceptRate != 20 || settings.AcceptBurst != 2 {
+		t.Errorf("Expected an accept rate of 20 with a burst of 2 in the settings, got %+v", settings)
+	}
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !echoThrough(port) {
+				t.Error("Expected every connection to be proxied")
+			}
+		}()
+	}
+	wg.Wait()
+	// the burst is accepted at once, then the rest at 20 per second
+	if elapsed := time.Since(started); elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected 10 connections to take about 400ms to accept, took %v", elapsed)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// EnableProxyProtocol writes a PROXY protocol v1 header, as used by HAProxy,
+// to each backend connection before any of the client's data, so that
+// backends which understand it see the real client address rather than the
+// proxy's. Backends which do not understand it will see the header as the
+// start of the client's data, so it must only be enabled for those which do.
+func (p *Proxy) EnableProxyProtocol() {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.proxyProtocol = true
+}
+
+// writeProxyHeader writes the PROXY protocol header of the client connection
+// conn to w, if it is enabled
+func (p *Proxy) writeProxyHeader(w io.Writer, conn net.Conn) error {
+	p.l.RLock()
+	enabled := p.proxyProtocol
+	p.l.RUnlock()
+	if !enabled {
+		return nil
+	}
+	_, err := io.WriteString(w, proxyHeader(conn.RemoteAddr(), conn.LocalAddr()))
+	return err
+}
+
+// proxyHeader returns the PROXY protocol v1 header line for a TCP connection
+// from client to local. Connections which are not TCP over one IP version
+// can only be described as UNKNOWN.
+func proxyHeader(client, local net.Addr) string {
+	clientAddr, clientOK := client.(*net.TCPAddr)
+	localAddr, localOK := local.(*net.TCPAddr)
+	if !clientOK || !localOK {
+		return "PROXY UNKNOWN\r\n"
+	}
+	clientIP, localIP := clientAddr.IP.To4(), localAddr.IP.To4()
+	family := "TCP4"
+	if clientIP == nil || localIP == nil {
+		if clientIP != nil || localIP != nil {
+			return "PROXY UNKNOWN\r\n"
+		}
+		clientIP, localIP = clientAddr.IP.To16(), localAddr.IP.To16()
+		family = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %v %v %v %v %v\r\n", family, clientIP, localIP, clientAddr.Port, localAddr.Port)
+}
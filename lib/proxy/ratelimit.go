@@ -0,0 +1,89 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// SetAcceptRate limits how many new connections the proxy accepts per second,
+// allowing bursts of up to burst connections, to protect the backends during
+// traffic surges. Unlike SetMaxConnections, this caps how fast connections
+// arrive rather than how many are open: once the limit is reached the accept
+// loop waits before accepting the next connection, leaving it queued by the
+// kernel. A rate of 0 (the default) means unlimited; a burst below 1 is
+// treated as 1.
+func (p *Proxy) SetAcceptRate(perSecond int, burst int) {
+	p.acceptRate.set(perSecond, burst)
+}
+
+// acceptLimiter is a token bucket of connections that may be accepted
+type acceptLimiter struct {
+	l         sync.Mutex
+	perSecond int
+	burst     int
+	tokens    float64
+	updated   time.Time
+}
+
+func (a *acceptLimiter) set(perSecond int, burst int) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	a.perSecond, a.burst = perSecond, burst
+	a.tokens = float64(burst)
+	a.updated = time.Now()
+}
+
+func (a *acceptLimiter) settings() (perSecond int, burst int) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if a.perSecond <= 0 {
+		return 0, 0
+	}
+	return a.perSecond, a.burst
+}
+
+// reserve takes a token for one connection and returns how long to wait
+// before accepting it
+func (a *acceptLimiter) reserve() time.Duration {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if a.perSecond <= 0 {
+		return 0
+	}
+	now := time.Now()
+	a.tokens += now.Sub(a.updated).Seconds() * float64(a.perSecond)
+	if a.tokens > float64(a.burst) {
+		a.tokens = float64(a.burst)
+	}
+	a.updated = now
+	// tokens may go negative, so that parallel accept loops queue up behind
+	// each other rather than all waiting for the same token
+	a.tokens--
+	if a.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-a.tokens / float64(a.perSecond) * float64(time.Second))
+}
+
+// wait blocks until another connection may be accepted
+func (a *acceptLimiter) wait() {
+	if delay := a.reserve(); delay > 0 {
+		time.Sleep(delay)
+	}
+}
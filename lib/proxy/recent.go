@@ -0,0 +1,90 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentConnectionsSize is how many completed connections are remembered per
+// proxy
+const recentConnectionsSize = 256
+
+// ConnectionRecord describes a completed proxied connection
+type ConnectionRecord struct {
+	Client          string    `json:"client"`
+	Backend         string    `json:"backend"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	BytesIn         int64     `json:"bytesIn"`
+	BytesOut        int64     `json:"bytesOut"`
+}
+
+// recentConnections is a fixed size ring buffer of the most recently completed
+// connections
+type recentConnections struct {
+	l       sync.Mutex
+	records [recentConnectionsSize]ConnectionRecord
+	next    int
+	full    bool
+}
+
+func (r *recentConnections) add(record ConnectionRecord) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.records[r.next] = record
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *recentConnections) all() []ConnectionRecord {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.full {
+		out := make([]ConnectionRecord, len(r.records))
+		copy(out, r.records[:])
+		return out
+	}
+	out := make([]ConnectionRecord, r.next)
+	copy(out, r.records[:r.next])
+	return out
+}
+
+// SlowestConnections returns up to 'n' of the longest lived connections out
+// of those most recently completed, longest first.
+func (p *Proxy) SlowestConnections(n int) []ConnectionRecord {
+	records := p.recent.all()
+	sort.Slice(records, func(i, j int) bool { return records[i].DurationSeconds > records[j].DurationSeconds })
+	if len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
+
+// LargestConnections returns up to 'n' of the connections which transferred
+// the most bytes out of those most recently completed, largest first.
+func (p *Proxy) LargestConnections(n int) []ConnectionRecord {
+	records := p.recent.all()
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].BytesIn+records[i].BytesOut > records[j].BytesIn+records[j].BytesOut
+	})
+	if len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
@@ -0,0 +1,46 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import "sync/atomic"
+
+// ProxyStats are the totals of a proxy's connections since it was created
+type ProxyStats struct {
+	ActiveConnections int `json:"activeConnections"`
+	// TotalConnections counts the connections which were proxied to a
+	// backend, including active ones
+	TotalConnections int64 `json:"totalConnections"`
+	// BytesFromBackends and BytesToBackends count the bytes of completed
+	// connections read from and written to their backends
+	BytesFromBackends int64 `json:"bytesFromBackends"`
+	BytesToBackends   int64 `json:"bytesToBackends"`
+}
+
+// proxyCounters are updated atomically so that connections don't contend on
+// the proxy's locks to record them
+type proxyCounters struct {
+	connections       int64
+	bytesFromBackends int64
+	bytesToBackends   int64
+}
+
+// Stats returns the proxy's connection and byte totals
+func (p *Proxy) Stats() ProxyStats {
+	return ProxyStats{
+		ActiveConnections: p.activeConnectionCount(),
+		TotalConnections:  atomic.LoadInt64(&p.counters.connections),
+		BytesFromBackends: atomic.LoadInt64(&p.counters.bytesFromBackends),
+		BytesToBackends:   atomic.LoadInt64(&p.counters.bytesToBackends),
+	}
+}
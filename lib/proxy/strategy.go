@@ -0,0 +1,55 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import "fmt"
+
+// Strategy determines how a backend is chosen for each new connection
+type Strategy int
+
+const (
+	// Random picks a backend uniformly at random. It is the default.
+	Random Strategy = iota
+	// ConsistentHash maps each client IP onto a hash ring of the backends, so
+	// that a client keeps connecting to the same backend across backend
+	// updates for as long as that backend is present.
+	ConsistentHash
+	// LeastConnections picks the backend with the fewest active connections,
+	// which spreads long lived connections more evenly than Random does.
+	LeastConnections
+)
+
+var strategyNames = map[Strategy]string{
+	Random:           "random",
+	ConsistentHash:   "consistent-hash",
+	LeastConnections: "least-connections",
+}
+
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy with the given name, as rendered by
+// String
+func ParseStrategy(name string) (Strategy, error) {
+	for strategy, strategyName := range strategyNames {
+		if strategyName == name {
+			return strategy, nil
+		}
+	}
+	return Random, fmt.Errorf("Unknown strategy %q", name)
+}
@@ -0,0 +1,59 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import "sort"
+
+// SetMaxBackends limits the backends proxied to to at most n of those passed
+// to UpdateBackendHosts, e.g. to canary traffic to a few tasks. Once chosen,
+// a backend is kept for as long as it is passed; others are chosen in sorted
+// order, preferring ones which are not draining. A limit of 0 (the default)
+// means unlimited. It takes effect from the next call to UpdateBackendHosts.
+func (p *Proxy) SetMaxBackends(n int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.maxBackends = n
+}
+
+// selectBackends returns at most maxBackends of the given backends. It must be
+// called with l held.
+func (p *Proxy) selectBackends(backends []string) []string {
+	if p.maxBackends <= 0 || len(backends) <= p.maxBackends {
+		return backends
+	}
+	current := make(map[string]bool, len(p.currentBackends))
+	for _, backend := range p.currentBackends {
+		current[backend] = true
+	}
+	p.connsLock.Lock()
+	draining := p.draining
+	p.connsLock.Unlock()
+	// rank backends which are not draining first, and among them those
+	// already chosen
+	rank := func(backend string) int {
+		r := 0
+		if draining[backend] {
+			r += 2
+		}
+		if !current[backend] {
+			r++
+		}
+		return r
+	}
+
+	candidates := append([]string(nil), backends...)
+	sort.Strings(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool { return rank(candidates[i]) < rank(candidates[j]) })
+	return candidates[:p.maxBackends]
+}
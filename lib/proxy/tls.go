@@ -0,0 +1,50 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// EnableTLS terminates TLS on the proxy's listener with the given
+// configuration, so that clients connect over TLS while backends are still
+// dialed in plaintext. It must be called before Serve. A nil config (the
+// default) serves plaintext.
+func (p *Proxy) EnableTLS(config *tls.Config) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.tlsConfig = config
+}
+
+// EnableBackendTLS dials backends over TLS with the given configuration,
+// which may include a client certificate for backends requiring mutual TLS.
+// Unless the config sets a ServerName, each backend's certificate is verified
+// against its host, which is usually an IP. A nil config (the default) dials
+// backends in plaintext.
+func (p *Proxy) EnableBackendTLS(config *tls.Config) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.backendTLSConfig = config
+}
+
+// dialTimeout connects to the target, completing the TLS handshake within the
+// timeout too if tlsConfig is not nil
+func dialTimeout(target string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.DialTimeout("tcp", target, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", target, tlsConfig)
+}
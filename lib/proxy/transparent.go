@@ -0,0 +1,141 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Transparent accepts connections which have been redirected to it (e.g. via
+// an iptables REDIRECT rule) and hands each one to the Proxy registered for the
+// port the client originally connected to. This lets a single listener stand
+// in for every port of the proxied containers.
+//
+// The Proxies registered with a Transparent proxy should not be served
+// themselves; the Transparent proxy does the listening for them.
+type Transparent struct {
+	port int
+
+	// l guards the listener and whether it is active, as well as the proxies
+	l        sync.RWMutex
+	listener net.Listener
+	active   bool
+	proxies  map[uint16]*Proxy
+}
+
+// originalDestinationPort is a variable so it may be replaced in tests
+var originalDestinationPort = originalDstPort
+
+// NewTransparent returns a new transparent proxy that listens on the passed in
+// port once 'Serve' is called.
+func NewTransparent(port uint16) *Transparent {
+	return &Transparent{port: int(port), active: true, proxies: make(map[uint16]*Proxy)}
+}
+
+// Register routes connections originally destined for the given port to the
+// given proxy, replacing any proxy previously registered for that port.
+func (t *Transparent) Register(port uint16, p *Proxy) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.proxies[port] = p
+}
+
+// Unregister stops routing connections originally destined for the given port.
+// Connections for that port will be closed until another proxy is registered.
+func (t *Transparent) Unregister(port uint16) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	delete(t.proxies, port)
+}
+
+func (t *Transparent) proxyFor(port uint16) (*Proxy, bool) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	p, ok := t.proxies[port]
+	return p, ok
+}
+
+// Serve begins listening for redirected traffic and serving it. It will block
+// indefinitely in the happy path, so it's likely best to call with a
+// goroutine.
+// If it's unable to listen it will return an error.
+func (t *Transparent) Serve() error {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(t.port))
+	if err != nil {
+		return err
+	}
+
+	t.l.Lock()
+	if !t.active {
+		// closed while binding
+		t.l.Unlock()
+		l.Close()
+		return nil
+	}
+	t.listener = l
+	t.l.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Error("Error accepting connection", err)
+			continue
+		}
+		go t.handle(conn)
+	}
+}
+
+func (t *Transparent) handle(conn net.Conn) {
+	port, err := originalDestinationPort(conn)
+	if err != nil {
+		log.Warn("Could not determine original destination of connection; closing it: ", err)
+		conn.Close()
+		return
+	}
+	p, ok := t.proxyFor(port)
+	if !ok {
+		log.Debugf("No proxy for original destination port %v; closing connection", port)
+		conn.Close()
+		return
+	}
+	// as Serve would with the proxy's own listener; connections over the
+	// proxy's accept rate wait here rather than in the listen queue
+	p.acceptRate.wait()
+	p.l.RLock()
+	tlsConfig := p.tlsConfig
+	p.l.RUnlock()
+	if tlsConfig != nil {
+		conn = tls.Server(conn, tlsConfig)
+	}
+	p.handle(conn)
+}
+
+// Close stops listening. It does not close the registered proxies.
+func (t *Transparent) Close() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.active = false
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
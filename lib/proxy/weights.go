@@ -0,0 +1,88 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package proxy
+
+// BackendWeight describes how likely a backend is to be chosen for the next
+// connection, after every selection rule has been applied
+type BackendWeight struct {
+	Backend string `json:"backend"`
+	// Weight is the expected fraction of new connections which will go to
+	// this backend, between 0 and 1
+	Weight            float64 `json:"weight"`
+	ActiveConnections int     `json:"activeConnections"`
+	AtLimit           bool    `json:"atLimit"`
+	Healthy           bool    `json:"healthy"`
+	Draining          bool    `json:"draining"`
+}
+
+// Weights returns the effective weight of each current backend. With the
+// Random strategy, candidate backends (those that are healthy and have room
+// left in the connection budget) are chosen in proportion to their capacity,
+// as set by UpdateBackendHostsWeighted, and less often the more recent dial
+// errors they have. With ConsistentHash, each candidate's weight is its share
+// of the hash ring, plus a part, chosen the same way, of the share of the
+// other backends, whose clients are sent elsewhere at random. With
+// LeastConnections, only the candidates with the fewest active connections
+// have any weight, chosen between as with Random.
+func (p *Proxy) Weights() []BackendWeight {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	p.connsLock.Lock()
+	defer p.connsLock.Unlock()
+
+	candidates := p.candidates(nil)
+	weights := make([]BackendWeight, len(p.currentBackends))
+	for i, backend := range p.currentBackends {
+		weights[i] = BackendWeight{
+			Backend:           backend,
+			ActiveConnections: p.backendConns[backend],
+			AtLimit:           p.atLimit(backend),
+			Healthy:           !p.unhealthy[backend],
+			Draining:          p.draining[backend],
+		}
+	}
+	if len(candidates) == 0 {
+		return weights
+	}
+
+	// the share of connections which is spread evenly over the candidates
+	spread := 1.0
+	var shares map[string]float64
+	if p.strategy == ConsistentHash {
+		shares = p.ring.shares()
+		spread = 0
+		for _, w := range weights {
+			if !contains(candidates, w.Backend) {
+				spread += shares[w.Backend]
+			}
+		}
+	}
+	if p.strategy == LeastConnections {
+		candidates = p.leastConnected(candidates)
+	}
+	choiceWeights := p.choiceWeights(candidates)
+	totalChoiceWeight := 0.0
+	for _, w := range choiceWeights {
+		totalChoiceWeight += w
+	}
+	for i := range weights {
+		for j, candidate := range candidates {
+			if candidate == weights[i].Backend {
+				weights[i].Weight = shares[candidate] + spread*choiceWeights[j]/totalChoiceWeight
+				break
+			}
+		}
+	}
+	return weights
+}
@@ -15,13 +15,22 @@ package taskhelpers
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
 )
 
 // ContainerPorts returns all of the ports that a given container within the
-// tasks is listening on.
-func ContainerPorts(tasks []ecsclient.AugmentedTask, containerName string, protocol string) []uint16 {
+// tasks is listening on. The protocol must be "tcp" or "udp"; for any other, an
+// error is logged and no ports are returned.
+func ContainerPorts(tasks []ecsclient.AugmentedTask, containerName ecsclient.NameMatcher, protocol string) []uint16 {
+	if err := ValidateProtocol(protocol); err != nil {
+		log.Error(err)
+		return []uint16{}
+	}
 	// dedupe map to return the minimal array
 	seenPorts := make(map[uint16]bool)
 	output := make([]uint16, 0, len(tasks)/2)
@@ -44,10 +53,68 @@ func ContainerPorts(tasks []ecsclient.AugmentedTask, containerName string, proto
 	return output
 }
 
+// ContainerPortsMulti is like ContainerPorts, but returns the ports of every
+// one of the named containers.
+func ContainerPortsMulti(tasks []ecsclient.AugmentedTask, containerNames []ecsclient.NameMatcher, protocol string) []uint16 {
+	seenPorts := make(map[uint16]bool)
+	output := []uint16{}
+	for _, containerName := range containerNames {
+		for _, port := range ContainerPorts(tasks, containerName, protocol) {
+			if !seenPorts[port] {
+				output = append(output, port)
+				seenPorts[port] = true
+			}
+		}
+	}
+	return output
+}
+
+// protocols are the transport protocols a container port can be bound with
+var protocols = []string{"tcp", "udp"}
+
+// ValidateProtocol returns an error unless the protocol is one a container
+// port can be bound with, so that a typo such as "tpc" is reported rather
+// than matching no ports
+func ValidateProtocol(protocol string) error {
+	for _, valid := range protocols {
+		if protocol == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid protocol %q; it must be tcp or udp", protocol)
+}
+
+// OtherProtocolWithPorts returns a protocol, other than the given one, for
+// which the named container has port bindings. When a container has no ports
+// for the protocol being proxied, this tells apart a container with no ports
+// at all from one bound with the wrong protocol, which is an easy mistake.
+func OtherProtocolWithPorts(tasks []ecsclient.AugmentedTask, containerName ecsclient.NameMatcher, protocol string) (string, bool) {
+	for _, other := range protocols {
+		if other == protocol {
+			continue
+		}
+		if len(ContainerPorts(tasks, containerName, other)) > 0 {
+			return other, true
+		}
+	}
+	return "", false
+}
+
 // FilterIPPort returns the "ip:port" pair for the given containerName within
 // all tasks where the given container is known to be running.
-func FilterIPPort(tasks []ecsclient.AugmentedTask, containerName string, containerPort uint16, publicIP bool) []string {
+// If requiredPort is not 0, tasks whose container does not also have a binding
+// for requiredPort are skipped.
+func FilterIPPort(tasks []ecsclient.AugmentedTask, containerName ecsclient.NameMatcher, containerPort uint16, requiredPort uint16, publicIP bool) []string {
 	output := make([]string, 0, len(tasks)/2)
+	eachIPPort(tasks, containerName, containerPort, requiredPort, publicIP, func(backend string, _ ecsclient.AugmentedContainer) {
+		output = append(output, backend)
+	})
+	return output
+}
+
+// eachIPPort calls fn with each "ip:port" pair FilterIPPort returns, and the
+// container it is for
+func eachIPPort(tasks []ecsclient.AugmentedTask, containerName ecsclient.NameMatcher, containerPort uint16, requiredPort uint16, publicIP bool, fn func(string, ecsclient.AugmentedContainer)) {
 	for _, task := range tasks {
 		container := task.Container(containerName)
 		if container == nil {
@@ -56,8 +123,13 @@ func FilterIPPort(tasks []ecsclient.AugmentedTask, containerName string, contain
 		if !container.Running() {
 			continue
 		}
+		if requiredPort != 0 && container.ResolvePort(requiredPort) == 0 {
+			log.Debugf("Skipping task whose %v container does not expose required port %v", containerName, requiredPort)
+			continue
+		}
 		hostPort := container.ResolvePort(containerPort)
 		if hostPort == 0 {
+			log.Debugf("Skipping task whose %v container does not expose port %v", containerName, containerPort)
 			continue
 		}
 		var taskIP string
@@ -69,7 +141,157 @@ func FilterIPPort(tasks []ecsclient.AugmentedTask, containerName string, contain
 		if taskIP == "" {
 			continue
 		}
-		output = append(output, fmt.Sprintf("%s:%d", taskIP, hostPort))
+		fn(net.JoinHostPort(normalizeIP(taskIP), strconv.Itoa(int(hostPort))), container)
+	}
+}
+
+// FilterIPPortMulti is like FilterIPPort, but returns the "ip:port" pairs of
+// every one of the named containers. If several of them expose the same
+// containerPort, their backends are merged.
+func FilterIPPortMulti(tasks []ecsclient.AugmentedTask, containerNames []ecsclient.NameMatcher, containerPort uint16, requiredPort uint16, publicIP bool) []string {
+	seen := make(map[string]bool)
+	output := []string{}
+	for _, containerName := range containerNames {
+		for _, backend := range FilterIPPort(tasks, containerName, containerPort, requiredPort, publicIP) {
+			if !seen[backend] {
+				output = append(output, backend)
+				seen[backend] = true
+			}
+		}
 	}
 	return output
 }
+
+// FilterIPPortWeighted is like FilterIPPortMulti, but also weighs each backend
+// by what its container reserves: its cpu units if every container reserves
+// cpu, or else its memory if every one reserves memory. Otherwise, e.g. if the
+// task definitions were not described, every backend has weight 1.
+func FilterIPPortWeighted(tasks []ecsclient.AugmentedTask, containerNames []ecsclient.NameMatcher, containerPort uint16, requiredPort uint16, publicIP bool) map[string]int {
+	cpu := make(map[string]int64)
+	memory := make(map[string]int64)
+	for _, containerName := range containerNames {
+		eachIPPort(tasks, containerName, containerPort, requiredPort, publicIP, func(backend string, container ecsclient.AugmentedContainer) {
+			if _, seen := cpu[backend]; !seen {
+				cpu[backend], memory[backend] = container.Reservation()
+			}
+		})
+	}
+
+	reservations := map[string]int64{}
+	if allReserved(cpu) {
+		reservations = cpu
+	} else if allReserved(memory) {
+		reservations = memory
+	}
+	weights := make(map[string]int, len(cpu))
+	for backend := range cpu {
+		weights[backend] = 1
+		if reserved, ok := reservations[backend]; ok {
+			weights[backend] = int(reserved)
+		}
+	}
+	return weights
+}
+
+func allReserved(reservations map[string]int64) bool {
+	for _, reserved := range reservations {
+		if reserved <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IPChoice chooses, for each container port, whether its backends are the
+// public or the private IPs of the tasks
+type IPChoice struct {
+	// Public is the choice for every port not in PublicPorts
+	Public bool
+	// PublicPorts holds the container ports whose backends are always public
+	PublicPorts map[uint16]bool
+}
+
+// PublicIP returns whether the backends of the given container port should be
+// the public IPs of the tasks
+func (c IPChoice) PublicIP(containerPort uint16) bool {
+	return c.Public || c.PublicPorts[containerPort]
+}
+
+// ParsePorts parses a comma separated list of ports, e.g. "443,8443", as a
+// set. An empty list is an empty set.
+func ParsePorts(list string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("Invalid port %q", field)
+		}
+		ports[uint16(port)] = true
+	}
+	return ports, nil
+}
+
+// FilterEnvironment returns the tasks in which at least one of the named
+// containers has every one of the given environment variables set to its
+// value, e.g. 'ROLE=frontend'. With no variables, every task is returned.
+func FilterEnvironment(tasks []ecsclient.AugmentedTask, containerNames []ecsclient.NameMatcher, env map[string]string) []ecsclient.AugmentedTask {
+	if len(env) == 0 {
+		return tasks
+	}
+	output := make([]ecsclient.AugmentedTask, 0, len(tasks))
+	for _, task := range tasks {
+		for _, containerName := range containerNames {
+			container := task.Container(containerName)
+			if container != nil && hasEnvironment(container.Environment(), env) {
+				output = append(output, task)
+				break
+			}
+		}
+	}
+	return output
+}
+
+// FilterIPPortPreferZone is like FilterIPPortMulti, but returns only the
+// backends of tasks in the given availability zone, e.g. to avoid the cost and
+// latency of proxying across zones. If no task there has a backend for
+// containerPort, or the zone is empty, the backends of every task are returned.
+func FilterIPPortPreferZone(tasks []ecsclient.AugmentedTask, containerNames []ecsclient.NameMatcher, containerPort uint16, requiredPort uint16, publicIP bool, zone string) []string {
+	if zone != "" {
+		local := make([]ecsclient.AugmentedTask, 0, len(tasks))
+		for _, task := range tasks {
+			if task.AvailabilityZone() == zone {
+				local = append(local, task)
+			}
+		}
+		if backends := FilterIPPortMulti(local, containerNames, containerPort, requiredPort, publicIP); len(backends) > 0 {
+			return backends
+		}
+	}
+	return FilterIPPortMulti(tasks, containerNames, containerPort, requiredPort, publicIP)
+}
+
+func hasEnvironment(actual, required map[string]string) bool {
+	for key, value := range required {
+		if v, ok := actual[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeIP renders IPv4-mapped IPv6 addresses (e.g. '::ffff:1.2.3.4') as
+// plain IPv4 so that they are dialed the same way on every platform
+func normalizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
+	}
+	return parsed.String()
+}
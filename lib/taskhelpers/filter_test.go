@@ -25,7 +25,7 @@ import (
 func TestContainerPorts(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	containerName := "name"
+	containerName := ecsclient.ExactName("name")
 
 	containerPorts := []uint16{10, 20, 30, 40, 50}
 	mocktask := mock.NewMockAugmentedTask(ctrl)
@@ -44,7 +44,7 @@ func TestContainerPorts(t *testing.T) {
 func TestGetsAllContainerPorts(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	containerName := "name"
+	containerName := ecsclient.ExactName("name")
 
 	containerPorts1 := []uint16{10, 20, 30, 40, 50}
 	containerPorts2 := []uint16{80}
@@ -70,7 +70,7 @@ func TestGetsAllContainerPorts(t *testing.T) {
 func TestIgnoresNotRunningContainers(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	containerName := "name"
+	containerName := ecsclient.ExactName("name")
 
 	containerPorts1 := []uint16{10, 20, 30, 40, 50}
 	mocktask1 := mock.NewMockAugmentedTask(ctrl)
@@ -91,10 +91,48 @@ func TestIgnoresNotRunningContainers(t *testing.T) {
 	}
 }
 
+func TestOtherProtocolWithPorts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	mockContainer := mock.NewMockAugmentedContainer(ctrl)
+	mockContainer.EXPECT().Running().Return(true)
+	mockContainer.EXPECT().ContainerPorts("udp").Return([]uint16{53})
+	mocktask.EXPECT().Container(containerName).Return(mockContainer)
+
+	other, ok := OtherProtocolWithPorts([]ecsclient.AugmentedTask{mocktask}, containerName, "tcp")
+	if !ok || other != "udp" {
+		t.Errorf("Expected udp to have ports, got %v, %v", other, ok)
+	}
+}
+
+func TestInvalidProtocol(t *testing.T) {
+	for _, protocol := range []string{"tcp", "udp"} {
+		if err := ValidateProtocol(protocol); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", protocol, err)
+		}
+	}
+	for _, protocol := range []string{"tpc", "TCP", ""} {
+		if err := ValidateProtocol(protocol); err == nil {
+			t.Errorf("Expected %q to be invalid", protocol)
+		}
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	// no calls are expected of the task, rather than it being treated as tcp
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	if ports := ContainerPorts([]ecsclient.AugmentedTask{mocktask}, ecsclient.ExactName("name"), "tpc"); len(ports) != 0 {
+		t.Errorf("Expected no ports for an invalid protocol, got %v", ports)
+	}
+}
+
 func TestFilterIPPort(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	containerName := "name"
+	containerName := ecsclient.ExactName("name")
 
 	mocktask := mock.NewMockAugmentedTask(ctrl)
 	mockContainer := mock.NewMockAugmentedContainer(ctrl)
@@ -103,9 +141,289 @@ func TestFilterIPPort(t *testing.T) {
 	mocktask.EXPECT().Container(containerName).Return(mockContainer)
 	mocktask.EXPECT().PublicIP().Return("1.2.3.4")
 
-	result := FilterIPPort([]ecsclient.AugmentedTask{mocktask}, containerName, 10, true)
+	result := FilterIPPort([]ecsclient.AugmentedTask{mocktask}, containerName, 10, 0, true)
 
 	if !reflect.DeepEqual(result, []string{"1.2.3.4:99"}) {
 		t.Errorf("Expected result to be 1.2.3.4:99, was %v", result)
 	}
 }
+
+func TestFilterIPPortNormalizesIPv4MappedAddresses(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	mappedTask := mock.NewMockAugmentedTask(ctrl)
+	mappedContainer := mock.NewMockAugmentedContainer(ctrl)
+	mappedContainer.EXPECT().Running().Return(true)
+	mappedContainer.EXPECT().ResolvePort(uint16(10)).Return(uint16(99))
+	mappedTask.EXPECT().Container(containerName).Return(mappedContainer)
+	mappedTask.EXPECT().PrivateIP().Return("::ffff:1.2.3.4")
+
+	v6Task := mock.NewMockAugmentedTask(ctrl)
+	v6Container := mock.NewMockAugmentedContainer(ctrl)
+	v6Container.EXPECT().Running().Return(true)
+	v6Container.EXPECT().ResolvePort(uint16(10)).Return(uint16(99))
+	v6Task.EXPECT().Container(containerName).Return(v6Container)
+	v6Task.EXPECT().PrivateIP().Return("2001:db8::1")
+
+	result := FilterIPPort([]ecsclient.AugmentedTask{mappedTask, v6Task}, containerName, 10, 0, false)
+
+	expected := []string{"1.2.3.4:99", "[2001:db8::1]:99"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected result to be %v, was %v", expected, result)
+	}
+}
+
+func TestFilterIPPortSkipsTasksWithoutRequiredPort(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	debugTask := mock.NewMockAugmentedTask(ctrl)
+	debugContainer := mock.NewMockAugmentedContainer(ctrl)
+	debugContainer.EXPECT().Running().Return(true)
+	debugContainer.EXPECT().ResolvePort(uint16(9000)).Return(uint16(32000))
+	debugContainer.EXPECT().ResolvePort(uint16(10)).Return(uint16(99))
+	debugTask.EXPECT().Container(containerName).Return(debugContainer)
+	debugTask.EXPECT().PrivateIP().Return("1.2.3.4")
+
+	plainTask := mock.NewMockAugmentedTask(ctrl)
+	plainContainer := mock.NewMockAugmentedContainer(ctrl)
+	plainContainer.EXPECT().Running().Return(true)
+	plainContainer.EXPECT().ResolvePort(uint16(9000)).Return(uint16(0))
+	plainTask.EXPECT().Container(containerName).Return(plainContainer)
+
+	result := FilterIPPort([]ecsclient.AugmentedTask{debugTask, plainTask}, containerName, 10, 9000, false)
+
+	if !reflect.DeepEqual(result, []string{"1.2.3.4:99"}) {
+		t.Errorf("Expected only the task exposing port 9000, got %v", result)
+	}
+}
+
+func TestNilLastStatusIsIgnored(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	mockContainer := mock.NewMockAugmentedContainer(ctrl)
+	// A container whose LastStatus is nil reports that it is not running
+	mockContainer.EXPECT().Running().Return(false).Times(2)
+	mocktask.EXPECT().Container(containerName).Return(mockContainer).Times(2)
+
+	if ports := ContainerPorts([]ecsclient.AugmentedTask{mocktask}, containerName, "tcp"); len(ports) != 0 {
+		t.Errorf("Expected no ports, got %v", ports)
+	}
+	if backends := FilterIPPort([]ecsclient.AugmentedTask{mocktask}, containerName, 10, 0, false); len(backends) != 0 {
+		t.Errorf("Expected no backends, got %v", backends)
+	}
+}
+
+func TestMultipleContainerNames(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	web, api := ecsclient.ExactName("web"), ecsclient.ExactName("api")
+
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	webContainer := mock.NewMockAugmentedContainer(ctrl)
+	webContainer.EXPECT().Running().Return(true).AnyTimes()
+	webContainer.EXPECT().ContainerPorts("tcp").Return([]uint16{80})
+	webContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32080))
+	webContainer.EXPECT().ResolvePort(uint16(8080)).Return(uint16(0))
+	apiContainer := mock.NewMockAugmentedContainer(ctrl)
+	apiContainer.EXPECT().Running().Return(true).AnyTimes()
+	apiContainer.EXPECT().ContainerPorts("tcp").Return([]uint16{8080})
+	apiContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(0))
+	apiContainer.EXPECT().ResolvePort(uint16(8080)).Return(uint16(32081))
+	mocktask.EXPECT().Container(web).Return(webContainer).AnyTimes()
+	mocktask.EXPECT().Container(api).Return(apiContainer).AnyTimes()
+	mocktask.EXPECT().PrivateIP().Return("1.2.3.4").AnyTimes()
+
+	tasks := []ecsclient.AugmentedTask{mocktask}
+	names := []ecsclient.NameMatcher{web, api}
+	ports := ContainerPortsMulti(tasks, names, "tcp")
+	if !reflect.DeepEqual(ports, []uint16{80, 8080}) {
+		t.Errorf("Expected the ports of both containers, got %v", ports)
+	}
+	if backends := FilterIPPortMulti(tasks, names, 80, 0, false); !reflect.DeepEqual(backends, []string{"1.2.3.4:32080"}) {
+		t.Errorf("Expected only the web container on port 80, got %v", backends)
+	}
+	if backends := FilterIPPortMulti(tasks, names, 8080, 0, false); !reflect.DeepEqual(backends, []string{"1.2.3.4:32081"}) {
+		t.Errorf("Expected only the api container on port 8080, got %v", backends)
+	}
+}
+
+func TestMultipleContainerNamesOnTheSamePort(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	web, api := ecsclient.ExactName("web"), ecsclient.ExactName("api")
+
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	webContainer := mock.NewMockAugmentedContainer(ctrl)
+	webContainer.EXPECT().Running().Return(true)
+	webContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32080))
+	apiContainer := mock.NewMockAugmentedContainer(ctrl)
+	apiContainer.EXPECT().Running().Return(true)
+	apiContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32081))
+	mocktask.EXPECT().Container(web).Return(webContainer)
+	mocktask.EXPECT().Container(api).Return(apiContainer)
+	mocktask.EXPECT().PrivateIP().Return("1.2.3.4").Times(2)
+
+	backends := FilterIPPortMulti([]ecsclient.AugmentedTask{mocktask}, []ecsclient.NameMatcher{web, api}, 80, 0, false)
+	if !reflect.DeepEqual(backends, []string{"1.2.3.4:32080", "1.2.3.4:32081"}) {
+		t.Errorf("Expected the backends of both containers to be merged, got %v", backends)
+	}
+}
+
+func TestFilterEnvironment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	frontendTask := mock.NewMockAugmentedTask(ctrl)
+	frontend := mock.NewMockAugmentedContainer(ctrl)
+	frontend.EXPECT().Environment().Return(map[string]string{"ROLE": "frontend", "OTHER": "x"})
+	frontendTask.EXPECT().Container(containerName).Return(frontend)
+
+	backendTask := mock.NewMockAugmentedTask(ctrl)
+	backend := mock.NewMockAugmentedContainer(ctrl)
+	backend.EXPECT().Environment().Return(map[string]string{"ROLE": "backend"})
+	backendTask.EXPECT().Container(containerName).Return(backend)
+
+	bareTask := mock.NewMockAugmentedTask(ctrl)
+	bare := mock.NewMockAugmentedContainer(ctrl)
+	bare.EXPECT().Environment().Return(map[string]string{})
+	bareTask.EXPECT().Container(containerName).Return(bare)
+
+	tasks := []ecsclient.AugmentedTask{frontendTask, backendTask, bareTask}
+	result := FilterEnvironment(tasks, []ecsclient.NameMatcher{containerName}, map[string]string{"ROLE": "frontend"})
+	if len(result) != 1 || result[0] != frontendTask {
+		t.Errorf("Expected only the frontend task, got %v", result)
+	}
+
+	if result := FilterEnvironment(tasks, []ecsclient.NameMatcher{containerName}, nil); len(result) != 3 {
+		t.Errorf("Expected every task without an environment filter, got %v", result)
+	}
+}
+
+func TestFilterIPPortWeighted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	reserving := func(ip string, cpu, memory int64) ecsclient.AugmentedTask {
+		mocktask := mock.NewMockAugmentedTask(ctrl)
+		mockContainer := mock.NewMockAugmentedContainer(ctrl)
+		mockContainer.EXPECT().Running().Return(true).AnyTimes()
+		mockContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32768)).AnyTimes()
+		mockContainer.EXPECT().Reservation().Return(cpu, memory).AnyTimes()
+		mocktask.EXPECT().Container(containerName).Return(mockContainer).AnyTimes()
+		mocktask.EXPECT().PrivateIP().Return(ip).AnyTimes()
+		return mocktask
+	}
+	names := []ecsclient.NameMatcher{containerName}
+
+	tasks := []ecsclient.AugmentedTask{reserving("10.0.0.1", 256, 512), reserving("10.0.0.2", 512, 512)}
+	expected := map[string]int{"10.0.0.1:32768": 256, "10.0.0.2:32768": 512}
+	if weights := FilterIPPortWeighted(tasks, names, 80, 0, false); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Expected weights by cpu %v, got %v", expected, weights)
+	}
+
+	tasks = []ecsclient.AugmentedTask{reserving("10.0.0.1", 0, 512), reserving("10.0.0.2", 512, 1024)}
+	expected = map[string]int{"10.0.0.1:32768": 512, "10.0.0.2:32768": 1024}
+	if weights := FilterIPPortWeighted(tasks, names, 80, 0, false); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Expected weights by memory when not every container reserves cpu %v, got %v", expected, weights)
+	}
+
+	tasks = []ecsclient.AugmentedTask{reserving("10.0.0.1", 0, 0), reserving("10.0.0.2", 512, 1024)}
+	expected = map[string]int{"10.0.0.1:32768": 1, "10.0.0.2:32768": 1}
+	if weights := FilterIPPortWeighted(tasks, names, 80, 0, false); !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Expected equal weights without reservations %v, got %v", expected, weights)
+	}
+}
+
+func TestFilterIPPortPreferZone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+	names := []ecsclient.NameMatcher{containerName}
+
+	// inZone is a task whose container exposes container port 80, and 8080
+	// too if both is set
+	inZone := func(ip, zone string, running, both bool) ecsclient.AugmentedTask {
+		mocktask := mock.NewMockAugmentedTask(ctrl)
+		mockContainer := mock.NewMockAugmentedContainer(ctrl)
+		mockContainer.EXPECT().Running().Return(running).AnyTimes()
+		mockContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32768)).AnyTimes()
+		if both {
+			mockContainer.EXPECT().ResolvePort(uint16(8080)).Return(uint16(32769)).AnyTimes()
+		} else {
+			mockContainer.EXPECT().ResolvePort(uint16(8080)).Return(uint16(0)).AnyTimes()
+		}
+		mocktask.EXPECT().Container(containerName).Return(mockContainer).AnyTimes()
+		mocktask.EXPECT().AvailabilityZone().Return(zone).AnyTimes()
+		mocktask.EXPECT().PrivateIP().Return(ip).AnyTimes()
+		return mocktask
+	}
+	local := inZone("10.0.0.1", "us-east-1a", true, false)
+	remote := inZone("10.0.0.2", "us-east-1b", true, true)
+	stoppedLocal := inZone("10.0.0.3", "us-east-1a", false, true)
+
+	tasks := []ecsclient.AugmentedTask{remote, local, stoppedLocal}
+	expected := []string{"10.0.0.1:32768"}
+	if backends := FilterIPPortPreferZone(tasks, names, 80, 0, false, "us-east-1a"); !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Expected only the running task in the same zone %v, got %v", expected, backends)
+	}
+	// no running task in the zone exposes 8080, so every zone is proxied
+	// to on that port alone
+	expected = []string{"10.0.0.2:32769"}
+	if backends := FilterIPPortPreferZone(tasks, names, 8080, 0, false, "us-east-1a"); !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Expected the task in another zone for a port none in the zone expose %v, got %v", expected, backends)
+	}
+	expected = []string{"10.0.0.2:32768", "10.0.0.1:32768"}
+	if backends := FilterIPPortPreferZone(tasks, names, 80, 0, false, ""); !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Expected every task without a zone %v, got %v", expected, backends)
+	}
+}
+
+func TestIPChoicePerPort(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	containerName := ecsclient.ExactName("name")
+
+	publicPorts, err := ParsePorts("443, 8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(publicPorts, map[uint16]bool{443: true, 8443: true}) {
+		t.Errorf("Unexpected ports %v", publicPorts)
+	}
+	for _, invalid := range []string{"https", "0", "70000"} {
+		if _, err := ParsePorts(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	mocktask := mock.NewMockAugmentedTask(ctrl)
+	mockContainer := mock.NewMockAugmentedContainer(ctrl)
+	mockContainer.EXPECT().Running().Return(true).AnyTimes()
+	mockContainer.EXPECT().ResolvePort(uint16(443)).Return(uint16(32443))
+	mockContainer.EXPECT().ResolvePort(uint16(80)).Return(uint16(32080))
+	mocktask.EXPECT().Container(containerName).Return(mockContainer).AnyTimes()
+	mocktask.EXPECT().PublicIP().Return("54.0.0.1")
+	mocktask.EXPECT().PrivateIP().Return("10.0.0.1")
+	tasks := []ecsclient.AugmentedTask{mocktask}
+	names := []ecsclient.NameMatcher{containerName}
+
+	choice := IPChoice{PublicPorts: publicPorts}
+	if backends := FilterIPPortMulti(tasks, names, 443, 0, choice.PublicIP(443)); !reflect.DeepEqual(backends, []string{"54.0.0.1:32443"}) {
+		t.Errorf("Expected the public IP for a public port, got %v", backends)
+	}
+	if backends := FilterIPPortMulti(tasks, names, 80, 0, choice.PublicIP(80)); !reflect.DeepEqual(backends, []string{"10.0.0.1:32080"}) {
+		t.Errorf("Expected the private IP for another port, got %v", backends)
+	}
+	if !(IPChoice{Public: true}).PublicIP(80) {
+		t.Error("Expected every port to be public by default with Public set")
+	}
+}
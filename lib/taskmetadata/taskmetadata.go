@@ -0,0 +1,70 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+// Package taskmetadata reads information about the ECS task this program is
+// running in from the ECS task metadata endpoint
+package taskmetadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// metadataURIEnvVars are the environment variables the ECS agent sets to the
+// task metadata endpoint, newest version first
+var metadataURIEnvVars = []string{"ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"}
+
+// ErrNotInECS is returned when no task metadata endpoint is configured, which
+// means this program is not running as an ECS task
+var ErrNotInECS = errors.New("No ECS task metadata endpoint in the environment")
+
+const metadataTimeout = 2 * time.Second
+
+// TaskARN returns the ARN of the task this program is running in
+func TaskARN() (string, error) {
+	var uri string
+	for _, envVar := range metadataURIEnvVars {
+		if uri = os.Getenv(envVar); uri != "" {
+			break
+		}
+	}
+	if uri == "" {
+		return "", ErrNotInECS
+	}
+
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Get(strings.TrimRight(uri, "/") + "/task")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected status from task metadata endpoint: %v", resp.Status)
+	}
+
+	var task struct {
+		TaskARN string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return "", err
+	}
+	if task.TaskARN == "" {
+		return "", errors.New("Task metadata did not include a task ARN")
+	}
+	return task.TaskARN, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.-
+
+package taskmetadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestTaskARN(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/task" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"Cluster": "default", "TaskARN": "arn:aws:ecs:us-east-1:123456789012:task/abc"}`))
+	}))
+	defer server.Close()
+
+	os.Clearenv()
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", server.URL+"/v4")
+	arn, err := TaskARN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arn != "arn:aws:ecs:us-east-1:123456789012:task/abc" {
+		t.Errorf("Unexpected task ARN %v", arn)
+	}
+}
+
+func TestTaskARNOutsideECS(t *testing.T) {
+	os.Clearenv()
+	if _, err := TaskARN(); err != ErrNotInECS {
+		t.Errorf("Expected ErrNotInECS, got %v", err)
+	}
+}
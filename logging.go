@@ -0,0 +1,71 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/awslabs/ecs-task-kite/lib/taskmetadata"
+)
+
+// fieldFormatter adds a fixed set of fields to every log line. It copies each
+// entry rather than modifying it, since an entry may be logged from several
+// goroutines at once.
+type fieldFormatter struct {
+	log.Formatter
+	fields log.Fields
+}
+
+func (f *fieldFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(log.Fields, len(entry.Data)+len(f.fields))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	for k, v := range f.fields {
+		data[k] = v
+	}
+	entryCopy := *entry
+	entryCopy.Data = data
+	return f.Formatter.Format(&entryCopy)
+}
+
+// logTaskARN adds this kite's own task ARN to every log line when running in
+// ECS, so that the logs of one kite can be picked out of many
+func logTaskARN() {
+	taskARN, err := taskmetadata.TaskARN()
+	if err == taskmetadata.ErrNotInECS {
+		log.Debug("Not running in ECS; not logging task ARN")
+		return
+	}
+	if err != nil {
+		log.Warn("Could not read own task ARN from task metadata: ", err)
+		return
+	}
+	std := log.StandardLogger()
+	log.SetFormatter(&fieldFormatter{Formatter: std.Formatter, fields: log.Fields{"task_arn": taskARN}})
+}
+
+// awsDebugConfig enables logging of every AWS request and response, bodies
+// included, through logrus
+func awsDebugConfig() *aws.Config {
+	return aws.NewConfig().WithLogLevel(aws.LogDebugWithHTTPBody).WithLogger(awsLogger{})
+}
+
+// awsLogger implements aws.Logger. It logs at info level since it's only used
+// when the SDK's debug logging has been asked for explicitly.
+type awsLogger struct{}
+
+func (awsLogger) Log(args ...interface{}) {
+	log.WithField("source", "aws-sdk").Info(args...)
+}
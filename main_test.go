@@ -0,0 +1,459 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/proxy"
+)
+
+// freePort returns a port which was free a moment ago
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func testManager() *proxy.Manager {
+	return proxy.NewManager(func(port uint16) *proxy.Proxy {
+		p := proxy.New(port)
+		p.SetBindAddress("127.0.0.1")
+		return p
+	}, nil)
+}
+
+func TestProxyNewPortsEmptiesPortsWithoutBackends(t *testing.T) {
+	manager := testManager()
+	defer manager.Drain(0)
+	proxied, unproxied := freePort(t), freePort(t)
+	if _, err := manager.EnsurePort(proxied, "tcp", map[string]int{"10.0.0.1:80": 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	requirePort := uint(0)
+	target := proxyTarget{names: []ecsclient.NameMatcher{ecsclient.ExactName("app")}, requirePort: &requirePort}
+
+	// none of the tasks can be proxied to on either port
+	proxyNewPorts(target, nil, nil, []uint16{proxied, unproxied}, manager)
+	proxies := manager.Proxies()
+	if p, ok := proxies[proxied]; !ok || len(p.Backends()) != 0 {
+		t.Errorf("Expected the proxied port to be left without backends, got %v", proxies)
+	}
+	if _, ok := proxies[unproxied]; ok {
+		t.Error("Expected no proxy to be created for a port without backends")
+	}
+}
+
+// fakeTask is a running task on 127.0.0.1 whose container exposes container
+// port 80 on hostPort, and reserves the given cpu and memory
+type fakeTask struct {
+	arn         string
+	hostPort    uint16
+	cpu, memory int64
+}
+
+func (t *fakeTask) PublicIP() string  { return "127.0.0.1" }
+func (t *fakeTask) PrivateIP() string { return "127.0.0.1" }
+func (t *fakeTask) Container(ecsclient.NameMatcher) ecsclient.AugmentedContainer {
+	return &fakeContainer{t}
+}
+func (t *fakeTask) ContainerAt(int) ecsclient.AugmentedContainer { return &fakeContainer{t} }
+func (t *fakeTask) EC2Instance() *ec2.Instance                   { return &ec2.Instance{} }
+func (t *fakeTask) TaskDefinitionARN() string                    { return "" }
+func (t *fakeTask) AvailabilityZone() string                     { return "" }
+func (t *fakeTask) ECSTask() *ecs.Task {
+	return &ecs.Task{TaskArn: aws.String(t.arn), LastStatus: aws.String("RUNNING")}
+}
+
+type fakeContainer struct {
+	task *fakeTask
+}
+
+func (c *fakeContainer) ContainerPorts(string) []uint16   { return []uint16{80} }
+func (c *fakeContainer) Running() bool                    { return true }
+func (c *fakeContainer) Environment() map[string]string   { return nil }
+func (c *fakeContainer) Reservation() (cpu, memory int64) { return c.task.cpu, c.task.memory }
+func (c *fakeContainer) ECSContainer() *ecs.Container     { return &ecs.Container{} }
+func (c *fakeContainer) ResolvePort(containerPort uint16) uint16 {
+	if containerPort == 80 {
+		return c.task.hostPort
+	}
+	return 0
+}
+
+// fakeClient lists the same tasks on every poll, counting the polls after the
+// first
+type fakeClient struct {
+	ecsclient.ECSSimpleClient
+	tasks []ecsclient.AugmentedTask
+
+	l     sync.Mutex
+	polls int
+}
+
+func (c *fakeClient) TasksWithContext(ctx context.Context, family, service *string) ([]ecsclient.AugmentedTask, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.polls++
+	return c.tasks, nil
+}
+
+func (c *fakeClient) pollCount() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.polls
+}
+
+func (c *fakeClient) StreamTasks(ctx context.Context, family, service *string, fn func([]ecsclient.AugmentedTask) bool) error {
+	fn(c.tasks)
+	return nil
+}
+
+// echoBackend listens on 127.0.0.1, echoing what every connection sends until
+// it sends "q", when the connection is closed
+func echoBackend(t *testing.T) (uint16, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 1)
+				for {
+					if _, err := conn.Read(b); err != nil || b[0] == 'q' {
+						return
+					}
+					conn.Write(b)
+				}
+			}()
+		}
+	}()
+	return uint16(l.Addr().(*net.TCPAddr).Port), func() { l.Close() }
+}
+
+func TestSignalDrainsProxiesBeforeProxyTasksReturns(t *testing.T) {
+	backendPort, stop := echoBackend(t)
+	defer stop()
+	listenPort := freePort(t)
+	requirePort := uint(0)
+	target := proxyTarget{
+		key:           "app",
+		client:        &fakeClient{tasks: []ecsclient.AugmentedTask{&fakeTask{arn: "task", hostPort: backendPort}}},
+		names:         []ecsclient.NameMatcher{ecsclient.ExactName("app")},
+		requirePort:   &requirePort,
+		portOverrides: map[uint16]uint16{80: listenPort},
+	}
+	newProxy := func(port uint16) *proxy.Proxy {
+		p := proxy.New(port)
+		p.SetBindAddress("127.0.0.1")
+		return p
+	}
+
+	signals := make(chan os.Signal, 1)
+	ctx, stopPolling := context.WithCancel(context.Background())
+	stopOn(signals, stopPolling)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		proxyTasks(ctx, target, pollSchedule{interval: time.Hour}, newProxy, nil, nil, &proxySnapshot{}, newStoppedTaskGrace(0), 10*time.Second)
+	}()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(listenPort)))
+	var conn net.Conn
+	for i := 0; ; i++ {
+		var err error
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("The proxy never started listening:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-returned:
+		t.Fatal("Expected proxyTasks to wait for the open connection to finish")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// the open connection is still proxied while draining, but no new ones
+	// are accepted
+	conn.Write([]byte("y"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Expected the open connection to keep working while draining, got %v", err)
+	}
+	if other, err := net.Dial("tcp", addr); err == nil {
+		other.Close()
+		t.Error("Expected no new connection to be accepted while draining")
+	}
+
+	conn.Write([]byte("q"))
+	conn.Close()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected proxyTasks to return once the connection was closed")
+	}
+}
+
+func TestPollScheduleNext(t *testing.T) {
+	if wait := (pollSchedule{interval: time.Second}).next(); wait != time.Second {
+		t.Errorf("Expected no jitter to wait exactly the interval, got %v", wait)
+	}
+	schedule := pollSchedule{interval: time.Second, jitter: 0.5}
+	varied := false
+	for i := 0; i < 100; i++ {
+		wait := schedule.next()
+		if wait < time.Second || wait > 1500*time.Millisecond {
+			t.Fatalf("Expected a wait between 1s and 1.5s, got %v", wait)
+		}
+		varied = varied || wait != time.Second
+	}
+	if !varied {
+		t.Error("Expected jitter to vary the wait")
+	}
+}
+
+func TestPollIntervalAndJitterAreValidated(t *testing.T) {
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{}, true},
+		{[]string{"-poll-interval=1m", "-poll-jitter=0"}, true},
+		{[]string{"-poll-interval=0"}, false},
+		{[]string{"-poll-interval=-1s"}, false},
+		{[]string{"-poll-jitter=-0.5"}, false},
+	}
+	for _, test := range tests {
+		d := newDiscoveryFlags("proxy")
+		d.flags.SetOutput(ioutil.Discard)
+		args := append([]string{"-name=app", "-family=app"}, test.args...)
+		if valid := d.parse(args); valid != test.valid {
+			t.Errorf("Expected %v to be valid: %v, got %v", test.args, test.valid, valid)
+		}
+	}
+}
+
+func TestCollectTaskUpdatesPollsUntilCancelled(t *testing.T) {
+	client := &fakeClient{tasks: []ecsclient.AugmentedTask{&fakeTask{arn: "task"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	var polled int32
+	updates := collectTaskUpdates(ctx, client, nil, nil, pollSchedule{interval: time.Millisecond}, nil, func() { atomic.AddInt32(&polled, 1) })
+
+	// the first update is streamed, and the rest polled
+	for i := 0; i < 5; i++ {
+		select {
+		case tasks := <-updates:
+			if len(tasks) != 1 {
+				t.Errorf("Expected the task in every update, got %v", tasks)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected an update every interval")
+		}
+	}
+	if polls := client.pollCount(); polls < 4 {
+		t.Errorf("Expected at least 4 polls after the first, got %v", polls)
+	}
+	if n := atomic.LoadInt32(&polled); n < 4 {
+		t.Errorf("Expected polled to be called for each poll, got %v calls", n)
+	}
+
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the updates to stop once cancelled")
+		}
+	}
+}
+
+func TestCollectTaskUpdatesRefreshesPastTheCache(t *testing.T) {
+	inner := &fakeClient{tasks: []ecsclient.AugmentedTask{&fakeTask{arn: "task"}}}
+	client := ecsclient.NewCached(inner, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refresh := make(chan struct{}, 1)
+	updates := collectTaskUpdates(ctx, client, nil, nil, pollSchedule{interval: time.Hour}, refresh, func() {})
+
+	<-updates
+	for i := 1; i <= 2; i++ {
+		refresh <- struct{}{}
+		select {
+		case <-updates:
+		case <-time.After(time.Second):
+			t.Fatal("Expected a refresh not to wait for the interval")
+		}
+		if polls := inner.pollCount(); polls != i {
+			t.Errorf("Expected each refresh to list the tasks again, got %v polls after %v refreshes", polls, i)
+		}
+	}
+}
+
+func TestPortMapFlag(t *testing.T) {
+	m := portMapFlag{}
+	if err := m.Set("80:8080"); err != nil {
+		t.Fatal(err)
+	}
+	// repeated, and comma separated with spaces
+	if err := m.Set("443:8443, 9000:9090"); err != nil {
+		t.Fatal(err)
+	}
+	expected := portMapFlag{8080: 80, 8443: 443, 9090: 9000}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %v, got %v", expected, m)
+	}
+	if s := m.String(); s != "443:8443,80:8080,9000:9090" {
+		t.Errorf("Unexpected string %q", s)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"80",
+		"80:",
+		":8080",
+		"0:8080",
+		"80:0",
+		"http:8080",
+		"80:65536",
+		"80:8080:1",
+		"81:8080",     // container port mapped again
+		"80:7070",     // listen port mapped again
+		"82:82,83:82", // within one value
+	} {
+		m := portMapFlag{8080: 80}
+		if err := m.Set(invalid); err == nil {
+			t.Errorf("Expected %q to be refused, got %v", invalid, m)
+		}
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	target := proxyTarget{portOverrides: portMapFlag{8080: 80}}
+	if port := target.listenPort(8080); port != 80 {
+		t.Errorf("Expected a mapped port to be listened on as mapped, got %v", port)
+	}
+	if port := target.listenPort(443); port != 443 {
+		t.Errorf("Expected an unmapped port to be listened on as exposed, got %v", port)
+	}
+	if port := (proxyTarget{}).listenPort(443); port != 443 {
+		t.Errorf("Expected no mapping to listen on the exposed port, got %v", port)
+	}
+}
+
+// weightsOf returns the weight of each backend of the proxy on a port
+func weightsOf(manager *proxy.Manager, port uint16) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, w := range manager.Proxies()[port].Weights() {
+		weights[w.Backend] = w.Weight
+	}
+	return weights
+}
+
+func TestBackendsAreOnlyWeightedByReservationWhenAskedTo(t *testing.T) {
+	port := freePort(t)
+	requirePort := uint(0)
+	tasks := []ecsclient.AugmentedTask{
+		&fakeTask{arn: "small", hostPort: 8081, cpu: 256},
+		&fakeTask{arn: "large", hostPort: 8082, cpu: 768},
+	}
+	for _, weighted := range []bool{false, true} {
+		// the reservations are described for -env alone too, but should
+		// only be used with -weight-by-reservation
+		target := proxyTarget{
+			names:         []ecsclient.NameMatcher{ecsclient.ExactName("app")},
+			requirePort:   &requirePort,
+			env:           map[string]string{"STAGE": "prod"},
+			portOverrides: map[uint16]uint16{80: port},
+			weighted:      weighted,
+		}
+		manager := testManager()
+		proxyNewPorts(target, tasks, nil, []uint16{80}, manager)
+		weights := weightsOf(manager, port)
+		manager.Drain(0)
+
+		expected := map[string]float64{"127.0.0.1:8081": 0.5, "127.0.0.1:8082": 0.5}
+		if weighted {
+			expected = map[string]float64{"127.0.0.1:8081": 0.25, "127.0.0.1:8082": 0.75}
+		}
+		if !reflect.DeepEqual(weights, expected) {
+			t.Errorf("Expected weights %v when weighted is %v, got %v", expected, weighted, weights)
+		}
+	}
+}
+
+func TestAcceptParallelismIsRejectedWithTransparentPort(t *testing.T) {
+	args := []string{"-name", "app", "-family", "app", "-transparent-port", "15001", "-accept-parallelism", "2"}
+	if code := proxyCommand(args); code != 1 {
+		t.Errorf("Expected -accept-parallelism with -transparent-port to be rejected, got exit code %v", code)
+	}
+}
+
+func TestStatusGroupsPortsByTarget(t *testing.T) {
+	snapshot := &proxySnapshot{targets: 2}
+	web, api := proxy.New(80), proxy.New(8080)
+	web.UpdateBackendHosts([]string{"10.0.0.1:32768"})
+	api.UpdateBackendHosts([]string{"10.0.0.2:32769"})
+	snapshot.set("1/api", map[uint16]*proxy.Proxy{8080: api})
+	snapshot.set("0/web", map[uint16]*proxy.Proxy{80: web})
+
+	recorder := httptest.NewRecorder()
+	writeStatus(recorder, snapshot)
+	status := recorder.Body.String()
+	for _, expected := range []string{"Container: 0/web\n\n  Port 80: 1 backends\n", "Container: 1/api\n\n  Port 8080: 1 backends\n"} {
+		if !strings.Contains(status, expected) {
+			t.Errorf("Expected %q in the status page, got:\n%v", expected, status)
+		}
+	}
+	if strings.Index(status, "0/web") > strings.Index(status, "1/api") {
+		t.Errorf("Expected the targets in order, got:\n%v", status)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014-2015 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/awslabs/ecs-task-kite/lib/ecsclient"
+	"github.com/awslabs/ecs-task-kite/lib/taskhelpers"
+)
+
+// resolveCommand finds the tasks once and prints their backends, one
+// '<containerPort> <ip:port>' pair per line
+func resolveCommand(args []string) int {
+	d := newDiscoveryFlags("resolve")
+	if !d.parse(args) {
+		return 1
+	}
+
+	tasks, err := d.client().Tasks(d.family, d.service)
+	if err != nil {
+		log.Error("Error listing tasks: ", err)
+		return 1
+	}
+	os.Stdout.Write(formatBackends(tasks, d))
+	return 0
+}
+
+// watchCommand polls for tasks like the proxy does and prints their backends,
+// in the same format as resolve, each time they change. Updates are separated
+// by a blank line.
+func watchCommand(args []string) int {
+	d := newDiscoveryFlags("watch")
+	if !d.parse(args) {
+		return 1
+	}
+
+	var last []byte
+	for tasks := range collectTaskUpdates(context.Background(), d.client(), d.family, d.service, d.schedule(), nil, func() {}) {
+		backends := formatBackends(tasks, d)
+		if last != nil && bytes.Equal(backends, last) {
+			continue
+		}
+		if last != nil {
+			fmt.Println()
+		}
+		os.Stdout.Write(backends)
+		last = backends
+	}
+	return 0
+}
+
+// formatBackends renders the backends of the given tasks for every container
+// port, sorted by port and then backend
+func formatBackends(tasks []ecsclient.AugmentedTask, d *discoveryFlags) []byte {
+	ports, backends := portBackends(tasks, d.matchers, d.env, uint16(*d.requirePort), d.ips, "")
+
+	var out bytes.Buffer
+	for _, port := range ports {
+		for _, backend := range backends[port] {
+			fmt.Fprintf(&out, "%d %s\n", port, backend)
+		}
+	}
+	return out.Bytes()
+}
+
+// listTargets finds the tasks of every target once and prints the backends the
+// proxy would start with, one '<listenPort> <containerPort> <ip:port>' triple
+// per line, without listening on any port
+func listTargets(targets []proxyTarget, maxBackends int) int {
+	var out bytes.Buffer
+	for _, target := range targets {
+		tasks, err := target.client.Tasks(target.family, target.service)
+		if err != nil {
+			log.Errorf("Error listing tasks of %v: %v", target.key, err)
+			return 1
+		}
+		tasks = taskhelpers.FilterEnvironment(tasks, target.names, target.env)
+		ports, backends := portBackends(tasks, target.names, nil, uint16(*target.requirePort), target.ips, target.zone)
+		for _, port := range ports {
+			chosen := backends[port]
+			// a new proxy picks the first backends in sorted order
+			if maxBackends > 0 && len(chosen) > maxBackends {
+				chosen = chosen[:maxBackends]
+			}
+			for _, backend := range chosen {
+				fmt.Fprintf(&out, "%d %d %s\n", target.listenPort(port), port, backend)
+			}
+		}
+	}
+	os.Stdout.Write(out.Bytes())
+	return 0
+}
+
+// portBackends returns the tcp container ports of the given tasks, sorted, and
+// the sorted backends of each, preferring those in the given zone
+func portBackends(tasks []ecsclient.AugmentedTask, names []ecsclient.NameMatcher, env map[string]string, requirePort uint16, ips taskhelpers.IPChoice, zone string) ([]uint16, map[uint16][]string) {
+	tasks = taskhelpers.FilterEnvironment(tasks, names, env)
+	ports := taskhelpers.ContainerPortsMulti(tasks, names, "tcp")
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	backends := make(map[uint16][]string, len(ports))
+	for _, port := range ports {
+		hosts := taskhelpers.FilterIPPortPreferZone(tasks, names, port, requirePort, ips.PublicIP(port), zone)
+		sort.Strings(hosts)
+		backends[port] = hosts
+	}
+	return ports, backends
+}